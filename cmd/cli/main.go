@@ -1,15 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
-	"text/template"
 
+	"luamerge/internal/bytecode"
 	"luamerge/internal/config"
 	"luamerge/internal/merger"
+	"luamerge/internal/parser"
 	"luamerge/internal/preservation"
 	tmpl "luamerge/internal/template"
 
@@ -38,13 +38,16 @@ Each job can merge multiple tables from a pair of Lua files.`,
 		}
 
 		// Load embedded template
-		tpl, err := template.New("lua").Parse(tmpl.LuaTemplate)
+		tpl, err := tmpl.New()
 		if err != nil {
 			log.Fatalf("❌ Error loading embedded template: %v", err)
 		}
 
 		fmt.Printf("🚀 luamerge - Processing %d job(s)...\n\n", len(settings.Jobs))
 
+		// Input files shared by several jobs are parsed only once
+		files := merger.NewFileCache()
+
 		// Process each job
 		for i, job := range settings.Jobs {
 			jobName := job.Name
@@ -60,9 +63,43 @@ Each job can merge multiple tables from a pair of Lua files.`,
 				log.Fatalf("❌ Error resolving paths for job '%s': %v", jobName, err)
 			}
 
+			constantPaths, err := config.ResolveConstantPaths(job, settings.Options, inputPath)
+			if err != nil {
+				log.Fatalf("❌ Error resolving paths for job '%s': %v", jobName, err)
+			}
+
 			// Check if unmerged items should be preserved
 			keepUnmerged := job.GetKeepUnmergedItems(settings.Options)
 
+			// Includes are resolved in the input directory
+			includeRoot := ""
+			if job.GetFollowIncludes(settings.Options) {
+				includeRoot = inputPath
+			}
+
+			// Source text is converted to the encoding of the base file
+			options := merger.Options{
+				InputEncoding:  job.GetInputEncoding(settings.Options),
+				OutputEncoding: job.GetOutputEncoding(settings.Options),
+				Files:          files,
+				Duplicates:     job.GetDuplicateTables(settings.Options),
+				ParseMode:      job.GetParseMode(settings.Options),
+				LuaVersion:     job.GetLuaVersion(settings.Options),
+				EvalLimits:     job.GetEvalLimits(settings.Options),
+				IncludeRoot:    includeRoot,
+				Constants:      constantPaths,
+				Warn: func(message string) {
+					fmt.Printf("  ⚠️  %s\n", message)
+				},
+				Removed: func(path parser.Path, pos parser.Position) {
+					if pos.IsValid() {
+						fmt.Printf("  ➖ Removed %s (%s)\n", path, pos)
+					} else {
+						fmt.Printf("  ➖ Removed %s\n", path)
+					}
+				},
+			}
+
 			// Create output directory if it doesn't exist
 			outputDir := filepath.Dir(outputPath)
 			if err := os.MkdirAll(outputDir, 0755); err != nil {
@@ -71,53 +108,100 @@ Each job can merge multiple tables from a pair of Lua files.`,
 
 			var outputContent string
 
-			// Normalize tables configuration
+			// Normalize tables and calls configuration
 			tablesConfig := job.GetTablesConfig()
+			callsConfig := job.GetCallsConfig()
 
 			if keepUnmerged {
 				// Mode: Preserve original file and replace only merged tables
 				fmt.Printf("  ℹ️  Mode: Preserving unspecified items\n")
-				outputContent, err = preservation.MergeWithPreservation(basePath, sourcePath, tablesConfig, tpl)
+				outputContent, err = preservation.MergeWithPreservation(basePath, sourcePath, tablesConfig, callsConfig, options, tpl)
 				if err != nil {
 					log.Fatalf("❌ Error merging with preservation for job '%s': %v", jobName, err)
 				}
 			} else {
 				// Mode: Only specified tables (current behavior)
-				results, err := merger.MergeTables(basePath, sourcePath, tablesConfig)
-				if err != nil {
-					log.Fatalf("❌ Error merging job '%s': %v", jobName, err)
+				var results []merger.Result
+				if len(tablesConfig) > 0 || len(callsConfig) == 0 {
+					results, err = merger.MergeTables(basePath, sourcePath, tablesConfig, options)
+					if err != nil {
+						log.Fatalf("❌ Error merging job '%s': %v", jobName, err)
+					}
 				}
-
-				var buf []byte
-				for j, result := range results {
-					if j > 0 {
-						buf = append(buf, []byte("\n\n")...)
+				if len(callsConfig) > 0 {
+					callResults, err := merger.MergeCalls(basePath, sourcePath, callsConfig, options)
+					if err != nil {
+						log.Fatalf("❌ Error merging calls for job '%s': %v", jobName, err)
 					}
+					results = append(results, callResults...)
+				}
 
-					var resultBuf bytes.Buffer
-					if err := tpl.Execute(&resultBuf, result); err != nil {
-						log.Fatalf("❌ Error executing template for table '%s': %v", result.TableName, err)
-					}
-					buf = append(buf, resultBuf.Bytes()...)
+				baseFile, err := options.LoadBase(basePath)
+				if err != nil {
+					log.Fatalf("❌ Error reading base file for job '%s': %v", jobName, err)
+				}
+				outputContent, err = preservation.RenderResults(results, baseFile, tpl)
+				if err != nil {
+					log.Fatalf("❌ Error generating Lua for job '%s': %v", jobName, err)
+				}
+			}
+
+			outputData := []byte(outputContent)
+			if job.GetOutputFormat() == config.FormatBytecode {
+				fmt.Printf("  ℹ️  Format: Lua 5.1 bytecode\n")
+				outputData, err = compileOutput(basePath, outputPath, outputContent)
+				if err != nil {
+					log.Fatalf("❌ Error compiling output for job '%s': %v", jobName, err)
 				}
-				outputContent = string(buf)
 			}
 
 			// Write output file
-			if err := os.WriteFile(outputPath, []byte(outputContent), 0644); err != nil {
+			if err := os.WriteFile(outputPath, outputData, 0644); err != nil {
 				log.Fatalf("❌ Error writing output file '%s': %v", outputPath, err)
 			}
 
 			fmt.Printf("  ✓ Base: %s\n", filepath.Base(basePath))
 			fmt.Printf("  ✓ Source: %s\n", filepath.Base(sourcePath))
 			fmt.Printf("  ✓ Output: %s\n", outputPath)
-			fmt.Printf("  ✓ Tables: %d\n\n", len(job.Tables))
+			if len(job.Tables) > 0 || len(job.Calls) == 0 {
+				fmt.Printf("  ✓ Tables: %d\n", len(job.Tables))
+			}
+			if len(job.Calls) > 0 {
+				fmt.Printf("  ✓ Calls: %d\n", len(job.Calls))
+			}
+			fmt.Println()
 		}
 
 		fmt.Printf("🎉 All %d job(s) processed successfully!\n", len(settings.Jobs))
 	},
 }
 
+// compileOutput compiles the merged Lua source to a precompiled chunk.
+// A .lub base sets the platform of the chunk; otherwise the format of the
+// official clients is used. Source that holds functions or control flow
+// fails to compile, and the job stops before its output is written.
+func compileOutput(basePath, outputPath, content string) ([]byte, error) {
+	header := bytecode.DefaultHeader
+
+	base, err := os.ReadFile(basePath)
+	if err != nil {
+		return nil, err
+	}
+	if bytecode.IsBytecode(base) {
+		baseHeader, err := bytecode.ReadHeader(base)
+		if err != nil {
+			return nil, err
+		}
+		header = *baseHeader
+	}
+
+	data, err := bytecode.CompileSource(filepath.Base(outputPath), content, &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w (set outputFormat to \"lua\" to write the merged source instead)", err)
+	}
+	return data, nil
+}
+
 func init() {
 	rootCmd.Flags().StringVarP(&inputDir, "inputs", "i", "input", "Input directory containing settings.json")
 	rootCmd.SetVersionTemplate(fmt.Sprintf("v%s\n", version))
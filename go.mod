@@ -5,6 +5,7 @@ go 1.24.5
 require (
 	github.com/spf13/cobra v1.10.1
 	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/text v0.30.0
 )
 
 require (
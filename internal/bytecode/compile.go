@@ -0,0 +1,1089 @@
+package bytecode
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"luamerge/internal/parser"
+)
+
+// Limits of the Lua 5.1 virtual machine
+const (
+	maxStack   = 250
+	maxIndexRK = bitRK - 1
+	maxArgBx   = 1<<18 - 1
+	maxArgC    = 1<<9 - 1
+	multRet    = -1
+
+	// varargIsVararg is the is_vararg flag of main functions
+	varargIsVararg = 2
+)
+
+// expKind is the kind of an expression descriptor, as in lcode.h
+type expKind int
+
+const (
+	expVoid      expKind = iota
+	expNil               // nil constant
+	expTrue              // true constant
+	expFalse             // false constant
+	expK                 // info = index of the constant
+	expKNum              // nval = numerical value
+	expLocal             // info = register of the local variable
+	expGlobal            // info = constant index of the global name
+	expIndexed           // info = table register, aux = key RK
+	expNonReloc          // info = result register
+	expRelocable         // info = pc of the instruction whose A is the result
+	expCall              // info = pc of the CALL instruction
+	expVararg            // info = pc of the VARARG instruction
+)
+
+// expDesc describes an expression whose code is only partly generated
+type expDesc struct {
+	kind expKind
+	info int
+	aux  int
+	nval float64
+}
+
+// nilKey is the constant table key of nil
+type nilKey struct{}
+
+// compileError carries a compilation error through panics
+type compileError struct{ err error }
+
+// Compile compiles a parsed Lua data file into the main function of a
+// Lua 5.1 chunk. The code generated is the same luac 5.1 produces for
+// assignments, local declarations, calls, returns, table constructors and
+// arithmetic; function definitions and control flow are rejected.
+func Compile(file *parser.File) (proto *Proto, err error) {
+	c := &compiler{
+		file:      file,
+		proto:     &Proto{Source: "@" + file.Name, IsVararg: varargIsVararg, MaxStackSize: 2},
+		constants: map[any]int{},
+		line:      1,
+	}
+	for i := 0; i < len(file.Source); i++ {
+		if file.Source[i] == '\n' {
+			c.lineStarts = append(c.lineStarts, i+1)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			compileErr, ok := r.(compileError)
+			if !ok {
+				panic(r)
+			}
+			proto, err = nil, compileErr.err
+		}
+	}()
+
+	for _, stmt := range file.Chunk {
+		c.statement(stmt)
+		c.freeReg = c.nactvar
+	}
+
+	// Close the function: end the scope of the locals and add the final return
+	for _, v := range c.actvars {
+		c.proto.LocVars[v].EndPC = len(c.proto.Code)
+	}
+	if n := len(file.Chunk); n > 0 {
+		last := file.Chunk[n-1]
+		c.setLine(last)
+		c.consume(last.End(), len(file.Source))
+	}
+	c.codeABC(OpReturn, 0, 1, 0)
+
+	return c.proto, nil
+}
+
+// CompileSource parses Lua source and compiles it to a precompiled chunk
+// in the format described by header
+func CompileSource(name string, source string, header *Header) ([]byte, error) {
+	file, err := parser.ParseFile(name, source, parser.Lua51)
+	if err != nil {
+		return nil, err
+	}
+
+	proto, err := Compile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return Dump(header, proto)
+}
+
+// compiler holds the state of lparser.c's FuncState for the main function
+type compiler struct {
+	file       *parser.File
+	proto      *Proto
+	constants  map[any]int
+	actvars    []int // indexes in proto.LocVars of the active locals
+	nactvar    int
+	freeReg    int
+	line       int
+	lineStarts []int
+	stmt       parser.Stmt // the statement being compiled, for errors
+}
+
+func (c *compiler) errorf(node parser.Node, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	panic(compileError{fmt.Errorf("%s:%d: %s", c.file.Name, c.lineOf(node.Start()), msg)})
+}
+
+// entry names the variable or table field whose value holds node, in the
+// statement being compiled: T.Weapons[1].OnUse, OnUse in argument 1 of
+// AddItem, [2] in the returned value
+func (c *compiler) entry(node parser.Node) string {
+	contains := func(exp parser.Expr) bool {
+		return exp.Start() <= node.Start() && node.End() <= exp.End()
+	}
+
+	// The value of the statement that holds node, and what it is assigned to
+	var name string
+	var value parser.Expr
+	variable := false
+	switch s := c.stmt.(type) {
+	case *parser.AssignStmt:
+		for i, v := range s.Values {
+			if contains(v) {
+				value = v
+				if i < len(s.Targets) {
+					name, variable = c.file.Text(s.Targets[i]), true
+				} else {
+					name = fmt.Sprintf("value %d of the assignment", i+1)
+				}
+			}
+		}
+	case *parser.LocalStmt:
+		for i, v := range s.Values {
+			if contains(v) {
+				value = v
+				if i < len(s.Names) {
+					name, variable = s.Names[i].Text, true
+				} else {
+					name = fmt.Sprintf("value %d of the local declaration", i+1)
+				}
+			}
+		}
+	case *parser.ReturnStmt:
+		for i, v := range s.Values {
+			if contains(v) {
+				value = v
+				name = "the returned value"
+				if len(s.Values) > 1 {
+					name = fmt.Sprintf("returned value %d", i+1)
+				}
+			}
+		}
+	case *parser.CallStmt:
+		for i, v := range s.Call.Args {
+			if contains(v) {
+				value = v
+				name = fmt.Sprintf("argument %d of %s", i+1, c.file.Text(s.Call.Func))
+			}
+		}
+	}
+	if value == nil {
+		return "this statement"
+	}
+
+	// The fields of the constructors that hold node
+	var fields strings.Builder
+	for table, ok := value.(*parser.TableExpr); ok; table, ok = value.(*parser.TableExpr) {
+		index := 0
+		found := false
+		for _, f := range table.Fields {
+			if f.Key == nil {
+				index++
+			}
+			if !contains(f.Value) {
+				continue
+			}
+			switch {
+			case f.Key == nil:
+				fmt.Fprintf(&fields, "[%d]", index)
+			case f.Named:
+				fmt.Fprintf(&fields, ".%s", f.Key.(*parser.NameExpr).Name)
+			default:
+				fmt.Fprintf(&fields, "[%s]", c.file.Text(f.Key))
+			}
+			value, found = f.Value, true
+			break
+		}
+		if !found {
+			break
+		}
+	}
+
+	path := fields.String()
+	switch {
+	case path == "":
+		return name
+	case variable:
+		return name + path
+	default:
+		return strings.TrimPrefix(path, ".") + " in " + name
+	}
+}
+
+// lineOf returns the line number of a byte offset
+func (c *compiler) lineOf(offset int) int {
+	return 1 + sort.SearchInts(c.lineStarts, offset+1)
+}
+
+// Like luac, the compiler numbers each instruction with the line of the
+// last token read before it was generated, which is not always the last
+// token of the node being compiled: the '=' of an assignment, the operator
+// of a binary expression or the separator of a list.
+
+// setLine makes the next instructions belong to the line where node ends
+func (c *compiler) setLine(node parser.Node) {
+	c.line = c.lineOf(max(node.End()-1, 0))
+}
+
+// consume makes the next instructions belong to the line of the last token
+// between the offsets from and to, if there is one
+func (c *compiler) consume(from, to int) {
+	if tokens := c.tokens(from, to); len(tokens) > 0 {
+		c.line = c.lineOf(tokens[len(tokens)-1].End - 1)
+	}
+}
+
+// tokens returns the tokens of the source between the offsets from and to,
+// which are the bounds of tokens, with their offsets in the source
+func (c *compiler) tokens(from, to int) []parser.Token {
+	tokens, err := parser.Tokenize(c.file.Source[from:to])
+	if err != nil {
+		return nil
+	}
+	tokens = tokens[:len(tokens)-1] // EOF
+	for i := range tokens {
+		tokens[i].Start += from
+		tokens[i].End += from
+	}
+	return tokens
+}
+
+func (c *compiler) statement(stmt parser.Stmt) {
+	c.stmt = stmt
+	switch s := stmt.(type) {
+	case *parser.AssignStmt:
+		c.assignment(s)
+
+	case *parser.LocalStmt:
+		c.localStmt(s)
+
+	case *parser.CallStmt:
+		var e expDesc
+		c.suffixedExpr(s.Call, &e)
+		setArgC(&c.proto.Code[e.info], 1)
+
+	case *parser.ReturnStmt:
+		c.returnStmt(s)
+
+	case *parser.BlockStmt:
+		text, _, _ := strings.Cut(c.file.Text(s), "\n")
+		c.errorf(s, "cannot compile '%s': '%s' statements are not supported, only data files can be compiled", strings.TrimSpace(text), s.Keyword)
+
+	default:
+		c.errorf(stmt, "unexpected statement")
+	}
+}
+
+// assignment compiles Targets = Values (lparser.c assignment)
+func (c *compiler) assignment(s *parser.AssignStmt) {
+	targets := make([]expDesc, len(s.Targets))
+	for i, target := range s.Targets {
+		c.suffixedExpr(target, &targets[i])
+		if targets[i].kind < expLocal || targets[i].kind > expIndexed {
+			c.errorf(target, "syntax error: cannot assign to this expression")
+		}
+		if targets[i].kind == expLocal {
+			c.setLine(target)
+			c.checkConflict(targets[:i], &targets[i])
+		}
+	}
+
+	var e expDesc
+	c.consume(s.Targets[len(s.Targets)-1].End(), s.Values[0].Start())
+	nexps := c.exprList(s.Values, &e)
+	nvars := len(targets)
+	c.setLine(s)
+
+	last := nvars - 1
+	if nexps == nvars {
+		c.setOneRet(&e)
+		c.storeVar(&targets[last], &e)
+		last--
+	} else {
+		c.adjustAssign(nvars, nexps, &e)
+		if nexps > nvars {
+			c.freeReg -= nexps - nvars
+		}
+	}
+
+	// The remaining values are on the stack, last target first
+	for i := last; i >= 0; i-- {
+		e = expDesc{kind: expNonReloc, info: c.freeReg - 1}
+		c.storeVar(&targets[i], &e)
+	}
+}
+
+// checkConflict copies a local that is about to be assigned to a safe
+// register when a previous target of the same assignment indexes it
+func (c *compiler) checkConflict(previous []expDesc, v *expDesc) {
+	extra := c.freeReg
+	conflict := false
+	for i := len(previous) - 1; i >= 0; i-- {
+		lh := &previous[i]
+		if lh.kind != expIndexed {
+			continue
+		}
+		if lh.info == v.info {
+			conflict = true
+			lh.info = extra
+		}
+		if lh.aux == v.info {
+			conflict = true
+			lh.aux = extra
+		}
+	}
+	if conflict {
+		c.codeABC(OpMove, c.freeReg, v.info, 0)
+		c.reserveRegs(1)
+	}
+}
+
+// localStmt compiles local Names = Values
+func (c *compiler) localStmt(s *parser.LocalStmt) {
+	first := len(c.proto.LocVars)
+	for _, name := range s.Names {
+		c.proto.LocVars = append(c.proto.LocVars, LocVar{Name: name.Text})
+	}
+
+	var e expDesc
+	nexps := 0
+	if len(s.Values) > 0 {
+		c.consume(s.Names[len(s.Names)-1].End, s.Values[0].Start())
+		nexps = c.exprList(s.Values, &e)
+	}
+	c.setLine(s)
+	c.adjustAssign(len(s.Names), nexps, &e)
+
+	for i := range s.Names {
+		c.proto.LocVars[first+i].StartPC = len(c.proto.Code)
+		c.actvars = append(c.actvars, first+i)
+	}
+	c.nactvar += len(s.Names)
+}
+
+// returnStmt compiles return Values
+func (c *compiler) returnStmt(s *parser.ReturnStmt) {
+	first, nret := 0, 0
+	if len(s.Values) > 0 {
+		var e expDesc
+		c.line = c.lineOf(s.Start())
+		nret = c.exprList(s.Values, &e)
+		c.setLine(s)
+		switch {
+		case hasMultRet(e.kind):
+			c.setMultRet(&e)
+			if e.kind == expCall && nret == 1 {
+				setOpcode(&c.proto.Code[e.info], OpTailCall)
+			}
+			first = c.nactvar
+			nret = multRet
+		case nret == 1:
+			first = c.exp2AnyReg(&e)
+		default:
+			c.exp2NextReg(&e)
+			first = c.nactvar
+		}
+	}
+	c.setLine(s)
+	c.codeABC(OpReturn, first, nret+1, 0)
+}
+
+// adjustAssign makes nexps values fill nvars registers
+func (c *compiler) adjustAssign(nvars, nexps int, e *expDesc) {
+	extra := nvars - nexps
+	if hasMultRet(e.kind) {
+		extra++
+		if extra < 0 {
+			extra = 0
+		}
+		c.setReturns(e, extra)
+		if extra > 1 {
+			c.reserveRegs(extra - 1)
+		}
+		return
+	}
+
+	if e.kind != expVoid {
+		c.exp2NextReg(e)
+	}
+	if extra > 0 {
+		reg := c.freeReg
+		c.reserveRegs(extra)
+		c.loadNil(reg, extra)
+	}
+}
+
+// exprList compiles a list of expressions, leaving all but the last one on
+// the stack; the last one is left in e. Returns the number of expressions.
+func (c *compiler) exprList(exprs []parser.Expr, e *expDesc) int {
+	for i, exp := range exprs {
+		if i > 0 {
+			c.consume(exprs[i-1].End(), exp.Start())
+			c.exp2NextReg(e)
+		}
+		c.expr(exp, e)
+	}
+	return len(exprs)
+}
+
+// expr compiles an expression into e
+func (c *compiler) expr(exp parser.Expr, e *expDesc) {
+	switch x := exp.(type) {
+	case *parser.NilExpr:
+		*e = expDesc{kind: expNil}
+	case *parser.TrueExpr:
+		*e = expDesc{kind: expTrue}
+	case *parser.FalseExpr:
+		*e = expDesc{kind: expFalse}
+
+	case *parser.NumberExpr:
+		n, err := parser.ParseNumber(x.Token.Text, parser.Lua51)
+		if err != nil {
+			c.errorf(x, "%v", err)
+		}
+		*e = expDesc{kind: expKNum, nval: n.Float}
+
+	case *parser.StringExpr:
+		c.stringExpr(x, e)
+
+	case *parser.VarargExpr:
+		c.setLine(x)
+		*e = expDesc{kind: expVararg, info: c.codeABC(OpVararg, 0, 1, 0)}
+
+	case *parser.TableExpr:
+		c.constructor(x, e)
+
+	case *parser.UnaryExpr:
+		c.expr(x.Operand, e)
+		c.setLine(x)
+		c.prefix(x, e)
+
+	case *parser.BinaryExpr:
+		c.expr(x.Left, e)
+		c.consume(x.Left.End(), x.Right.Start())
+		c.infix(x, e)
+		var e2 expDesc
+		c.expr(x.Right, &e2)
+		c.setLine(x)
+		c.posfix(x, e, &e2)
+
+	case *parser.FunctionExpr:
+		c.errorf(x, "cannot compile the function of %s: functions are not supported, only data files can be compiled", c.entry(x))
+
+	default:
+		c.suffixedExpr(exp, e)
+	}
+}
+
+func (c *compiler) stringExpr(x *parser.StringExpr, e *expDesc) {
+	value, err := parser.UnquoteString(x.Token.Text, parser.Lua51)
+	if err != nil {
+		c.errorf(x, "%v", err)
+	}
+	*e = expDesc{kind: expK, info: c.stringK(value)}
+}
+
+// suffixedExpr compiles names, field accesses, calls and parenthesized
+// expressions (lparser.c primaryexp)
+func (c *compiler) suffixedExpr(exp parser.Expr, e *expDesc) {
+	switch x := exp.(type) {
+	case *parser.NameExpr:
+		c.singleVar(x.Name, e)
+
+	case *parser.ParenExpr:
+		c.expr(x.Inner, e)
+		c.setLine(x)
+		c.dischargeVars(e)
+
+	case *parser.IndexExpr:
+		c.suffixedExpr(x.Object, e)
+		c.setLine(x.Object)
+		c.exp2AnyReg(e)
+		var key expDesc
+		if x.Dot {
+			key = expDesc{kind: expK, info: c.stringK(x.Key.(*parser.NameExpr).Name)}
+		} else {
+			c.expr(x.Key, &key)
+			c.setLine(x.Key)
+			c.exp2Val(&key)
+		}
+		c.indexed(e, &key)
+
+	case *parser.CallExpr:
+		c.suffixedExpr(x.Func, e)
+		c.setLine(x.Func)
+
+		// The tokens before the arguments: ':' and the method name, then
+		// the '(' unless the argument is a string or a table
+		end := x.End()
+		if len(x.Args) > 0 {
+			end = x.Args[0].Start()
+		}
+		tokens := c.tokens(x.Func.End(), end)
+
+		if x.Method != "" {
+			c.line = c.lineOf(tokens[1].End - 1)
+			key := expDesc{kind: expK, info: c.stringK(x.Method)}
+			c.self(e, &key)
+			tokens = tokens[2:]
+		} else {
+			c.exp2NextReg(e)
+		}
+
+		// A string argument is read whole, so a long string that spans
+		// lines counts for the line where it ends
+		var line int
+		if len(tokens) > 0 {
+			line = c.lineOf(tokens[0].Start)
+		} else if str, ok := x.Args[0].(*parser.StringExpr); ok {
+			line = c.lineOf(str.End() - 1)
+		} else {
+			line = c.lineOf(x.Args[0].Start())
+		}
+		c.funcArgs(x, e, line)
+
+	default:
+		c.errorf(exp, "unexpected expression")
+	}
+}
+
+// singleVar resolves a name to the innermost active local or a global
+func (c *compiler) singleVar(name string, e *expDesc) {
+	for i := len(c.actvars) - 1; i >= 0; i-- {
+		if c.proto.LocVars[c.actvars[i]].Name == name {
+			*e = expDesc{kind: expLocal, info: i}
+			return
+		}
+	}
+	*e = expDesc{kind: expGlobal, info: c.stringK(name)}
+}
+
+// funcArgs compiles the arguments of a call and the CALL instruction, which
+// belongs to the line where the arguments start
+func (c *compiler) funcArgs(x *parser.CallExpr, f *expDesc, line int) {
+	var args expDesc
+	if len(x.Args) > 0 {
+		c.exprList(x.Args, &args)
+		c.setMultRet(&args)
+	}
+
+	c.setLine(x)
+	base := f.info
+	nparams := multRet
+	if !hasMultRet(args.kind) {
+		if args.kind != expVoid {
+			c.exp2NextReg(&args)
+		}
+		nparams = c.freeReg - (base + 1)
+	}
+
+	c.line = line
+	*f = expDesc{kind: expCall, info: c.codeABC(OpCall, base, nparams+1, 2)}
+	c.freeReg = base + 1
+}
+
+// constructor compiles a table constructor (lparser.c constructor)
+func (c *compiler) constructor(x *parser.TableExpr, t *expDesc) {
+	pc := c.codeABC(OpNewTable, 0, 0, 0)
+	*t = expDesc{kind: expRelocable, info: pc}
+	c.exp2NextReg(t)
+	c.line = c.lineOf(x.Open.Start)
+
+	var pending expDesc
+	na, nh, toStore := 0, 0, 0
+
+	for i, f := range x.Fields {
+		if i > 0 && x.Fields[i-1].Sep != nil {
+			c.line = c.lineOf(x.Fields[i-1].Sep.Start)
+		}
+
+		// Close the previous list item
+		if pending.kind != expVoid {
+			c.exp2NextReg(&pending)
+			pending.kind = expVoid
+			if toStore == fieldsPerFlush {
+				c.setList(t.info, na, toStore)
+				toStore = 0
+			}
+		}
+
+		if f.Key == nil {
+			c.expr(f.Value, &pending)
+			na++
+			toStore++
+			continue
+		}
+
+		// Record field: key = value or [key] = value
+		reg := c.freeReg
+		var key, value expDesc
+		if f.Named {
+			key = expDesc{kind: expK, info: c.stringK(f.Key.(*parser.NameExpr).Name)}
+		} else {
+			c.expr(f.Key, &key)
+			c.setLine(f.Key)
+			c.exp2Val(&key)
+		}
+		nh++
+		c.consume(f.Key.End(), f.Value.Start())
+		rkKey := c.exp2RK(&key)
+		c.expr(f.Value, &value)
+		c.setLine(f.Value)
+		c.codeABC(OpSetTable, t.info, rkKey, c.exp2RK(&value))
+		c.freeReg = reg
+	}
+
+	c.setLine(x)
+	if toStore > 0 {
+		if hasMultRet(pending.kind) {
+			c.setMultRet(&pending)
+			c.setList(t.info, na, multRet)
+			na--
+		} else {
+			if pending.kind != expVoid {
+				c.exp2NextReg(&pending)
+			}
+			c.setList(t.info, na, toStore)
+		}
+	}
+
+	setArgB(&c.proto.Code[pc], int2fb(na))
+	setArgC(&c.proto.Code[pc], int2fb(nh))
+}
+
+func (c *compiler) setList(base, nelems, toStore int) {
+	block := (nelems-1)/fieldsPerFlush + 1
+	b := toStore
+	if toStore == multRet {
+		b = 0
+	}
+	if block <= maxArgC {
+		c.codeABC(OpSetList, base, b, block)
+	} else {
+		c.codeABC(OpSetList, base, b, 0)
+		c.code(uint32(block))
+	}
+	c.freeReg = base + 1
+}
+
+// Code generation (lcode.c)
+
+func (c *compiler) code(i uint32) int {
+	c.proto.Code = append(c.proto.Code, i)
+	c.proto.LineInfo = append(c.proto.LineInfo, c.line)
+	return len(c.proto.Code) - 1
+}
+
+func (c *compiler) codeABC(op, a, b, cc int) int {
+	return c.code(uint32(op) | uint32(a)<<6 | uint32(cc)<<14 | uint32(b)<<23)
+}
+
+func (c *compiler) codeABx(op, a, bx int) int {
+	return c.code(uint32(op) | uint32(a)<<6 | uint32(bx)<<14)
+}
+
+func (c *compiler) checkStack(n int) {
+	newStack := c.freeReg + n
+	if newStack > c.proto.MaxStackSize {
+		if newStack >= maxStack {
+			panic(compileError{fmt.Errorf("%s: function or expression too complex", c.file.Name)})
+		}
+		c.proto.MaxStackSize = newStack
+	}
+}
+
+func (c *compiler) reserveRegs(n int) {
+	c.checkStack(n)
+	c.freeReg += n
+}
+
+func (c *compiler) freeRegister(reg int) {
+	if reg&bitRK == 0 && reg >= c.nactvar {
+		c.freeReg--
+	}
+}
+
+func (c *compiler) freeExp(e *expDesc) {
+	if e.kind == expNonReloc {
+		c.freeRegister(e.info)
+	}
+}
+
+// addK adds a constant, reusing an existing entry with the same value
+func (c *compiler) addK(key any, value Constant) int {
+	if index, ok := c.constants[key]; ok {
+		return index
+	}
+	index := len(c.proto.Constants)
+	if index > maxArgBx {
+		panic(compileError{fmt.Errorf("%s: constant table overflow", c.file.Name)})
+	}
+	c.constants[key] = index
+	c.proto.Constants = append(c.proto.Constants, value)
+	return index
+}
+
+func (c *compiler) stringK(s string) int  { return c.addK(s, s) }
+func (c *compiler) numberK(n float64) int { return c.addK(n, n) }
+func (c *compiler) boolK(b bool) int      { return c.addK(b, b) }
+func (c *compiler) nilK() int             { return c.addK(nilKey{}, nil) }
+
+// loadNil sets n registers from reg to nil, merging with a previous LOADNIL
+// and skipping registers that are still clean at the start of the function.
+// Data chunks have no jumps, so the previous instruction always runs first.
+func (c *compiler) loadNil(from, n int) {
+	pc := len(c.proto.Code)
+	if pc == 0 {
+		if from >= c.nactvar {
+			return
+		}
+	} else if previous := &c.proto.Code[pc-1]; opcode(*previous) == OpLoadNil {
+		pfrom, pto := argA(*previous), argB(*previous)
+		if pfrom <= from && from <= pto+1 {
+			if from+n-1 > pto {
+				setArgB(previous, from+n-1)
+			}
+			return
+		}
+	}
+	c.codeABC(OpLoadNil, from, from+n-1, 0)
+}
+
+func hasMultRet(kind expKind) bool {
+	return kind == expCall || kind == expVararg
+}
+
+func (c *compiler) setReturns(e *expDesc, nresults int) {
+	switch e.kind {
+	case expCall:
+		setArgC(&c.proto.Code[e.info], nresults+1)
+	case expVararg:
+		setArgB(&c.proto.Code[e.info], nresults+1)
+		setArgA(&c.proto.Code[e.info], c.freeReg)
+		c.reserveRegs(1)
+	}
+}
+
+func (c *compiler) setMultRet(e *expDesc) {
+	c.setReturns(e, multRet)
+}
+
+func (c *compiler) setOneRet(e *expDesc) {
+	switch e.kind {
+	case expCall:
+		e.kind = expNonReloc
+		e.info = argA(c.proto.Code[e.info])
+	case expVararg:
+		setArgB(&c.proto.Code[e.info], 2)
+		e.kind = expRelocable
+	}
+}
+
+func (c *compiler) dischargeVars(e *expDesc) {
+	switch e.kind {
+	case expLocal:
+		e.kind = expNonReloc
+	case expGlobal:
+		e.info = c.codeABx(OpGetGlobal, 0, e.info)
+		e.kind = expRelocable
+	case expIndexed:
+		c.freeRegister(e.aux)
+		c.freeRegister(e.info)
+		e.info = c.codeABC(OpGetTable, 0, e.info, e.aux)
+		e.kind = expRelocable
+	case expCall, expVararg:
+		c.setOneRet(e)
+	}
+}
+
+func (c *compiler) discharge2Reg(e *expDesc, reg int) {
+	c.dischargeVars(e)
+	switch e.kind {
+	case expNil:
+		c.loadNil(reg, 1)
+	case expTrue, expFalse:
+		b := 0
+		if e.kind == expTrue {
+			b = 1
+		}
+		c.codeABC(OpLoadBool, reg, b, 0)
+	case expK:
+		c.codeABx(OpLoadK, reg, e.info)
+	case expKNum:
+		c.codeABx(OpLoadK, reg, c.numberK(e.nval))
+	case expRelocable:
+		setArgA(&c.proto.Code[e.info], reg)
+	case expNonReloc:
+		if reg != e.info {
+			c.codeABC(OpMove, reg, e.info, 0)
+		}
+	default:
+		return
+	}
+	e.info = reg
+	e.kind = expNonReloc
+}
+
+func (c *compiler) discharge2AnyReg(e *expDesc) {
+	if e.kind != expNonReloc {
+		c.reserveRegs(1)
+		c.discharge2Reg(e, c.freeReg-1)
+	}
+}
+
+func (c *compiler) exp2Reg(e *expDesc, reg int) {
+	c.discharge2Reg(e, reg)
+	e.info = reg
+	e.kind = expNonReloc
+}
+
+func (c *compiler) exp2NextReg(e *expDesc) {
+	c.dischargeVars(e)
+	c.freeExp(e)
+	c.reserveRegs(1)
+	c.exp2Reg(e, c.freeReg-1)
+}
+
+func (c *compiler) exp2AnyReg(e *expDesc) int {
+	c.dischargeVars(e)
+	if e.kind == expNonReloc {
+		return e.info
+	}
+	c.exp2NextReg(e)
+	return e.info
+}
+
+func (c *compiler) exp2Val(e *expDesc) {
+	c.dischargeVars(e)
+}
+
+// exp2RK returns the RK operand of an expression: a constant index when it
+// fits, a register otherwise
+func (c *compiler) exp2RK(e *expDesc) int {
+	c.exp2Val(e)
+	switch e.kind {
+	case expKNum, expTrue, expFalse, expNil:
+		if len(c.proto.Constants) <= maxIndexRK {
+			switch e.kind {
+			case expNil:
+				e.info = c.nilK()
+			case expKNum:
+				e.info = c.numberK(e.nval)
+			default:
+				e.info = c.boolK(e.kind == expTrue)
+			}
+			e.kind = expK
+			return e.info | bitRK
+		}
+	case expK:
+		if e.info <= maxIndexRK {
+			return e.info | bitRK
+		}
+	}
+	return c.exp2AnyReg(e)
+}
+
+func (c *compiler) storeVar(v *expDesc, e *expDesc) {
+	switch v.kind {
+	case expLocal:
+		c.freeExp(e)
+		c.exp2Reg(e, v.info)
+		return
+	case expGlobal:
+		reg := c.exp2AnyReg(e)
+		c.codeABx(OpSetGlobal, reg, v.info)
+	case expIndexed:
+		rk := c.exp2RK(e)
+		c.codeABC(OpSetTable, v.info, v.aux, rk)
+	}
+	c.freeExp(e)
+}
+
+func (c *compiler) self(e *expDesc, key *expDesc) {
+	c.exp2AnyReg(e)
+	c.freeExp(e)
+	fn := c.freeReg
+	c.reserveRegs(2)
+	c.codeABC(OpSelf, fn, e.info, c.exp2RK(key))
+	c.freeExp(key)
+	e.info = fn
+	e.kind = expNonReloc
+}
+
+func (c *compiler) indexed(t *expDesc, key *expDesc) {
+	t.aux = c.exp2RK(key)
+	t.kind = expIndexed
+}
+
+// isNumeral reports whether an expression is a numeric constant
+func isNumeral(e *expDesc) bool {
+	return e.kind == expKNum
+}
+
+// arithOps maps the binary arithmetic operators to their opcodes
+var arithOps = map[string]int{
+	"+": OpAdd, "-": OpSub, "*": OpMul, "/": OpDiv, "%": OpMod, "^": OpPow,
+}
+
+func (c *compiler) prefix(x *parser.UnaryExpr, e *expDesc) {
+	e2 := expDesc{kind: expKNum}
+	switch x.Op {
+	case "-":
+		if !isNumeral(e) {
+			c.exp2AnyReg(e)
+		}
+		c.codeArith(OpUnm, e, &e2)
+	case "not":
+		c.codeNot(e)
+	case "#":
+		c.exp2AnyReg(e)
+		c.codeArith(OpLen, e, &e2)
+	default:
+		c.errorf(x, "unsupported operator '%s'", x.Op)
+	}
+}
+
+func (c *compiler) codeNot(e *expDesc) {
+	c.dischargeVars(e)
+	switch e.kind {
+	case expNil, expFalse:
+		e.kind = expTrue
+	case expK, expKNum, expTrue:
+		e.kind = expFalse
+	default:
+		c.discharge2AnyReg(e)
+		c.freeExp(e)
+		e.info = c.codeABC(OpNot, 0, e.info, 0)
+		e.kind = expRelocable
+	}
+}
+
+func (c *compiler) infix(x *parser.BinaryExpr, v *expDesc) {
+	switch {
+	case x.Op == "..":
+		c.exp2NextReg(v)
+	case arithOps[x.Op] != 0:
+		if !isNumeral(v) {
+			c.exp2RK(v)
+		}
+	default:
+		c.errorf(x, "operator '%s' cannot be compiled, only data files are supported", x.Op)
+	}
+}
+
+func (c *compiler) posfix(x *parser.BinaryExpr, e1, e2 *expDesc) {
+	if x.Op != ".." {
+		c.codeArith(arithOps[x.Op], e1, e2)
+		return
+	}
+
+	c.exp2Val(e2)
+	if e2.kind == expRelocable && opcode(c.proto.Code[e2.info]) == OpConcat {
+		c.freeExp(e1)
+		setArgB(&c.proto.Code[e2.info], e1.info)
+		e1.kind = expRelocable
+		e1.info = e2.info
+		return
+	}
+	c.exp2NextReg(e2)
+	c.codeArith(OpConcat, e1, e2)
+}
+
+func (c *compiler) codeArith(op int, e1, e2 *expDesc) {
+	if constFolding(op, e1, e2) {
+		return
+	}
+
+	o2 := 0
+	if op != OpUnm && op != OpLen {
+		o2 = c.exp2RK(e2)
+	}
+	o1 := c.exp2RK(e1)
+	if o1 > o2 {
+		c.freeExp(e1)
+		c.freeExp(e2)
+	} else {
+		c.freeExp(e2)
+		c.freeExp(e1)
+	}
+	e1.info = c.codeABC(op, 0, o1, o2)
+	e1.kind = expRelocable
+}
+
+// constFolding evaluates arithmetic on numeric constants at compile time
+func constFolding(op int, e1, e2 *expDesc) bool {
+	if !isNumeral(e1) || !isNumeral(e2) {
+		return false
+	}
+
+	v1, v2 := e1.nval, e2.nval
+	var r float64
+	switch op {
+	case OpAdd:
+		r = v1 + v2
+	case OpSub:
+		r = v1 - v2
+	case OpMul:
+		r = v1 * v2
+	case OpDiv:
+		if v2 == 0 {
+			return false
+		}
+		r = v1 / v2
+	case OpMod:
+		if v2 == 0 {
+			return false
+		}
+		r = v1 - math.Floor(v1/v2)*v2
+	case OpPow:
+		r = math.Pow(v1, v2)
+	case OpUnm:
+		r = -v1
+	default:
+		return false
+	}
+	if math.IsNaN(r) {
+		return false
+	}
+	e1.nval = r
+	return true
+}
+
+// int2fb encodes an integer as a "floating point byte" (eeeeexxx),
+// the format of the NEWTABLE size hints
+func int2fb(x int) int {
+	e := 0
+	for x >= 16 {
+		x = (x + 1) >> 1
+		e++
+	}
+	if x < 8 {
+		return x
+	}
+	return (e+1)<<3 | (x - 8)
+}
+
+func setOpcode(i *uint32, op int) { *i = *i&^0x3f | uint32(op) }
+func setArgA(i *uint32, a int)    { *i = *i&^(0xff<<6) | uint32(a)<<6 }
+func setArgB(i *uint32, b int)    { *i = *i&^(0x1ff<<23) | uint32(b)<<23 }
+func setArgC(i *uint32, c int)    { *i = *i&^(0x1ff<<14) | uint32(c)<<14 }
@@ -0,0 +1,81 @@
+package bytecode
+
+import (
+	"testing"
+
+	"luamerge/internal/parser"
+)
+
+func TestCompileUnsupported(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string
+	}{
+		{
+			name:   "field",
+			source: "A = 1\nT = {\n\tx = 1,\n\tWeapons = { { OnUse = function() end } },\n}",
+			want:   "test.lua:4: cannot compile the function of T.Weapons[1].OnUse: functions are not supported, only data files can be compiled",
+		},
+		{
+			name:   "local",
+			source: "local f = function() end",
+			want:   "test.lua:1: cannot compile the function of f: functions are not supported, only data files can be compiled",
+		},
+		{
+			name:   "bracket key",
+			source: "T = { [SKID.SM_BASH] = function() end }",
+			want:   "test.lua:1: cannot compile the function of T[SKID.SM_BASH]: functions are not supported, only data files can be compiled",
+		},
+		{
+			name:   "call argument",
+			source: `AddItem("x", { OnUse = function() end })`,
+			want:   "test.lua:1: cannot compile the function of OnUse in argument 2 of AddItem: functions are not supported, only data files can be compiled",
+		},
+		{
+			name:   "return",
+			source: "return { 1, function() end }",
+			want:   "test.lua:1: cannot compile the function of [2] in the returned value: functions are not supported, only data files can be compiled",
+		},
+		{
+			name:   "function statement",
+			source: "A = 1\nfunction main()\n\treturn A\nend",
+			want:   "test.lua:2: cannot compile 'function main()': 'function' statements are not supported, only data files can be compiled",
+		},
+		{
+			name:   "control flow",
+			source: "for i = 1, 3 do\n\tA = i\nend",
+			want:   "test.lua:1: cannot compile 'for i = 1, 3 do': 'for' statements are not supported, only data files can be compiled",
+		},
+	}
+
+	for _, tt := range tests {
+		file, err := parser.ParseFile("test.lua", tt.source, parser.Lua51)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		proto, err := Compile(file)
+		if err == nil {
+			t.Errorf("%s: compiled to %d instructions, want an error", tt.name, len(proto.Code))
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("%s: got error %q, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestCompileEscapes(t *testing.T) {
+	// Lua 5.1 keeps the letter of the escapes it does not know
+	file, err := parser.ParseFile("test.lua", `S = "\x41\z\u{48}"`, parser.Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto, err := Compile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := proto.Constants[1]; got != "x41zu{48}" {
+		t.Errorf("got constant %q, want %q", got, "x41zu{48}")
+	}
+}
@@ -0,0 +1,779 @@
+package bytecode
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"luamerge/internal/parser"
+)
+
+// Decompile reconstructs Lua source from a precompiled Lua 5.1 data chunk.
+// Table constructors (NEWTABLE, SETTABLE and SETLIST with constants),
+// global and local assignments, calls and return statements are supported;
+// chunks with control flow or function definitions are rejected, since they
+// are not data files.
+// The result is plain Lua source that parser.ParseFile reads like any other file.
+func Decompile(name string, data []byte) (string, error) {
+	_, proto, err := Undump(data)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+
+	// Values that would not run in the order of the chunk where they are
+	// used are bound to temporaries where they are computed, and the chunk
+	// is run again until every value is in order
+	bound := map[int]bool{}
+	for {
+		d := &decompiler{
+			name:   name,
+			proto:  proto,
+			regs:   make([]expr, proto.MaxStackSize+1),
+			stamps: make([]int, proto.MaxStackSize+1),
+			bound:  bound,
+			calls:  map[int]int{},
+		}
+		if err := d.run(); err != nil {
+			return "", err
+		}
+
+		unordered := d.check()
+		if len(unordered) == 0 {
+			var sb strings.Builder
+			for _, stmt := range d.stmts {
+				sb.WriteString(stmt.format())
+				sb.WriteString("\n")
+			}
+			return sb.String(), nil
+		}
+		for _, pc := range unordered {
+			if bound[pc] {
+				return "", d.errorf(pc, "the value cannot be written in the order the chunk computes it")
+			}
+			bound[pc] = true
+		}
+	}
+}
+
+// expr is a reconstructed expression: one of the *Expr types below
+type expr interface {
+	format(indent string) string
+}
+
+// access identifies a value read or computed by an instruction, with the
+// number of side effects (calls and assignments) run before it
+type access struct {
+	pc  int
+	seq int
+}
+
+type constExpr struct{ value Constant }
+
+// nameExpr is a global variable
+type nameExpr struct {
+	name string
+	access
+}
+
+// localExpr is a local variable, or a temporary declared by the decompiler
+type localExpr string
+
+type varargExpr struct{}
+
+type indexExpr struct {
+	object expr
+	key    expr
+	access
+}
+
+type field struct {
+	key   expr // nil for positional items
+	value expr
+	seq   int // fields stored in constructors before it was computed
+}
+
+type tableExpr struct {
+	fields []field
+	items  int
+	pc     int  // the NEWTABLE instruction
+	bind   bool // bound to a temporary when it is first used
+}
+
+type methodExpr struct {
+	object expr
+	name   string
+}
+
+type callExpr struct {
+	fn     expr
+	method string
+	args   []expr
+	access // seq counts the call itself
+}
+
+type unaryExpr struct {
+	op      string
+	operand expr
+}
+
+type binaryExpr struct {
+	op          string
+	left, right expr
+}
+
+type concatExpr struct{ parts []expr }
+
+// parenExpr truncates a call or vararg to its first value
+type parenExpr struct{ inner expr }
+
+// statement is a reconstructed statement. Statements are formatted only
+// once the whole chunk has run, so tables are printed with all their fields.
+type statement struct {
+	local  bool
+	target expr   // assignment target, nil for calls and returns
+	values []expr // a single call for call statements
+	ret    bool
+	seq    int // side effects run once an assignment is done
+}
+
+func (s statement) format() string {
+	values := formatList(s.values, "")
+	switch {
+	case s.ret:
+		return strings.TrimSpace("return " + values)
+	case s.target == nil:
+		return values
+	case s.local && len(s.values) == 0:
+		return "local " + s.target.format("")
+	case s.local:
+		return "local " + s.target.format("") + " = " + values
+	default:
+		return s.target.format("") + " = " + values
+	}
+}
+
+// decompiler runs the main function symbolically, keeping an expression
+// in each register instead of a value
+type decompiler struct {
+	name    string
+	proto   *Proto
+	regs    []expr
+	top     int
+	stmts   []statement
+	bound   map[int]bool // instructions whose value is bound to a temporary
+	temps   int          // temporaries declared
+	effects int          // calls and assignments run
+	stored  int          // fields stored in table constructors
+	stamps  []int        // stored when each register was set
+	calls   map[int]int  // instructions of the calls whose result is used, by seq
+}
+
+func (d *decompiler) run() error {
+	code := d.proto.Code
+	if len(d.proto.Protos) > 0 {
+		return d.errorf(0, "function definitions are not supported")
+	}
+
+	for pc := 0; pc < len(code); pc++ {
+		d.declareLocals(pc)
+
+		i := code[pc]
+		a, b, c := argA(i), argB(i), argC(i)
+		if err := d.checkOperands(pc, opcode(i), a, b, c); err != nil {
+			return err
+		}
+
+		switch op := opcode(i); op {
+		case OpMove:
+			d.setReg(a, d.reg(b))
+
+		case OpLoadK:
+			k, err := d.constant(argBx(i))
+			if err != nil {
+				return d.errorf(pc, "%v", err)
+			}
+			d.setReg(a, k)
+
+		case OpLoadBool:
+			if c != 0 {
+				return d.errorf(pc, "conditional expressions are not supported")
+			}
+			d.setReg(a, constExpr{b != 0})
+
+		case OpLoadNil:
+			for r := a; r <= b; r++ {
+				d.setReg(r, constExpr{nil})
+			}
+
+		case OpGetGlobal:
+			name, err := d.global(argBx(i), d.access(pc))
+			if err != nil {
+				return d.errorf(pc, "%v", err)
+			}
+			d.setResult(pc, a, name)
+
+		case OpSetGlobal:
+			name, err := d.global(argBx(i), access{})
+			if err != nil {
+				return d.errorf(pc, "%v", err)
+			}
+			d.assign(name, d.reg(a))
+
+		case OpGetTable:
+			key, err := d.rk(c)
+			if err != nil {
+				return d.errorf(pc, "%v", err)
+			}
+			d.setResult(pc, a, indexExpr{d.reg(b), key, d.access(pc)})
+
+		case OpSetTable:
+			key, err := d.rk(b)
+			if err != nil {
+				return d.errorf(pc, "%v", err)
+			}
+			value, err := d.rk(c)
+			if err != nil {
+				return d.errorf(pc, "%v", err)
+			}
+
+			// Fields of a table that is still in a register go into its
+			// constructor; anything else becomes an assignment statement
+			if table, ok := d.constructor(a); ok {
+				d.stored++
+				table.fields = append(table.fields, field{key, value, d.stored})
+			} else {
+				d.assign(indexExpr{object: d.reg(a), key: key}, value)
+			}
+
+		case OpNewTable:
+			d.setReg(a, &tableExpr{pc: pc, bind: d.bound[pc]})
+
+		case OpSetList:
+			table, ok := d.constructor(a)
+			if !ok {
+				return d.errorf(pc, "SETLIST on a value that is not a table constructor")
+			}
+			if c == 0 {
+				// The block number does not fit in C and is stored as the next instruction
+				pc++
+				if pc >= len(code) {
+					return d.errorf(pc, "truncated SETLIST")
+				}
+				c = int(code[pc])
+			}
+			n := b
+			if b == 0 {
+				n = -1
+			}
+			// Items go before the fields stored after they were computed
+			for j, value := range d.list(a+1, n) {
+				index := (c-1)*fieldsPerFlush + j + 1
+				seq := d.stored
+				if r := a + 1 + j; r < len(d.stamps) {
+					seq = d.stamps[r]
+				}
+				if index == table.items+1 {
+					table.items++
+					table.insert(field{nil, value, seq})
+				} else {
+					table.insert(field{constExpr{float64(index)}, value, seq})
+				}
+			}
+
+		case OpSelf:
+			key, err := d.rk(c)
+			if err != nil {
+				return d.errorf(pc, "%v", err)
+			}
+			method, ok := nameConstant(key)
+			if !ok {
+				return d.errorf(pc, "invalid method name")
+			}
+			object := d.reg(b)
+			d.setReg(a, methodExpr{object, method})
+			d.setReg(a+1, object)
+
+		case OpAdd, OpSub, OpMul, OpDiv, OpMod, OpPow:
+			left, err := d.rk(b)
+			if err != nil {
+				return d.errorf(pc, "%v", err)
+			}
+			right, err := d.rk(c)
+			if err != nil {
+				return d.errorf(pc, "%v", err)
+			}
+			d.setReg(a, binaryExpr{string("+-*/%^"[op-OpAdd]), left, right})
+
+		case OpUnm:
+			d.setReg(a, unaryExpr{"-", d.reg(b)})
+		case OpNot:
+			d.setReg(a, unaryExpr{"not ", d.reg(b)})
+		case OpLen:
+			d.setReg(a, unaryExpr{"#", d.reg(b)})
+
+		case OpConcat:
+			parts := make([]expr, 0, c-b+1)
+			for r := b; r <= c; r++ {
+				parts = append(parts, d.reg(r))
+			}
+			d.setReg(a, concatExpr{parts})
+
+		case OpCall, OpTailCall:
+			call := d.call(a, b, pc)
+			switch {
+			case op == OpTailCall:
+				d.stmts = append(d.stmts, statement{ret: true, values: []expr{call}})
+				return nil
+			case c == 1:
+				d.stmts = append(d.stmts, statement{values: []expr{call}})
+			case c == 0:
+				if d.bound[pc] {
+					return d.errorf(pc, "the results of the call cannot be written in the order the chunk computes them")
+				}
+				d.calls[call.seq] = pc
+				d.setReg(a, call)
+				d.top = a + 1
+			case c == 2:
+				d.calls[call.seq] = pc
+				d.setResult(pc, a, call)
+			default:
+				return d.errorf(pc, "calls with several results are not supported")
+			}
+
+		case OpVararg:
+			if b != 0 && b != 2 {
+				return d.errorf(pc, "vararg expressions with several results are not supported")
+			}
+			d.setReg(a, varargExpr{})
+			d.top = a + 1
+
+		case OpReturn:
+			if b != 1 {
+				d.stmts = append(d.stmts, statement{ret: true, values: d.list(a, b-1)})
+			}
+			return nil
+
+		case OpClose:
+			// No upvalues to close in a data chunk
+
+		case OpClosure:
+			return d.errorf(pc, "function definitions are not supported")
+
+		case OpJmp, OpEq, OpLt, OpLe, OpTest, OpTestSet, OpForLoop, OpForPrep, OpTForLoop:
+			return d.errorf(pc, "control flow (%s) is not supported", opName(op))
+
+		default:
+			return d.errorf(pc, "unsupported instruction %s", opName(op))
+		}
+	}
+
+	return nil
+}
+
+// checkOperands reports an error when an instruction refers to registers
+// outside the stack frame of the function, as in a corrupted chunk.
+// Constants are checked where they are read (see constant).
+func (d *decompiler) checkOperands(pc, op, a, b, c int) error {
+	// Ranges of registers, first to last
+	var ranges [][2]int
+	switch op {
+	case OpMove, OpUnm, OpNot, OpLen:
+		ranges = [][2]int{{a, a}, {b, b}}
+	case OpLoadK, OpLoadBool, OpGetGlobal, OpSetGlobal, OpNewTable, OpVararg,
+		OpSetTable, OpAdd, OpSub, OpMul, OpDiv, OpMod, OpPow:
+		ranges = [][2]int{{a, a}}
+	case OpLoadNil:
+		ranges = [][2]int{{a, b}}
+	case OpGetTable:
+		ranges = [][2]int{{a, a}, {b, b}}
+	case OpSelf:
+		ranges = [][2]int{{a, a + 1}, {b, b}}
+	case OpConcat:
+		ranges = [][2]int{{a, a}, {b, c}}
+	case OpSetList:
+		ranges = [][2]int{{a, a + max(b, 0)}}
+	case OpCall, OpTailCall:
+		ranges = [][2]int{{a, a + max(b-1, 0)}, {a, a + max(c-2, 0)}}
+	case OpReturn:
+		if b > 1 {
+			ranges = [][2]int{{a, a + b - 2}}
+		}
+	}
+
+	for _, r := range ranges {
+		if r[0] > r[1] || r[1] >= d.proto.MaxStackSize {
+			return d.errorf(pc, "%s refers to registers %d to %d, outside the stack frame of %d registers", opName(op), r[0], r[1], d.proto.MaxStackSize)
+		}
+	}
+
+	// Register operands of B and C that may be constants
+	switch op {
+	case OpSetTable, OpAdd, OpSub, OpMul, OpDiv, OpMod, OpPow:
+		return d.checkRK(pc, op, b, c)
+	case OpGetTable, OpSelf:
+		return d.checkRK(pc, op, c)
+	}
+	return nil
+}
+
+// checkRK reports an error when a B or C argument that is a register is
+// outside the stack frame
+func (d *decompiler) checkRK(pc, op int, args ...int) error {
+	for _, arg := range args {
+		if arg&bitRK == 0 && arg >= d.proto.MaxStackSize {
+			return d.errorf(pc, "%s refers to register %d, outside the stack frame of %d registers", opName(op), arg, d.proto.MaxStackSize)
+		}
+	}
+	return nil
+}
+
+// declareLocals emits a local statement for every local variable whose
+// scope starts at pc, and makes its register refer to the variable by name.
+// Without debug information (luac -s) locals stay anonymous and their
+// values are written where they are used.
+func (d *decompiler) declareLocals(pc int) {
+	reg := 0
+	for _, v := range d.proto.LocVars {
+		// A local declared by the last statement starts and ends at the
+		// final return, so a scope that starts here is always counted
+		if v.StartPC > pc || (v.EndPC <= pc && v.StartPC != pc) {
+			continue
+		}
+		if v.StartPC == pc && reg < len(d.regs) {
+			stmt := statement{local: true, target: localExpr(v.Name)}
+			if d.regs[reg] != nil {
+				stmt.values = []expr{d.reg(reg)}
+			}
+			d.stmts = append(d.stmts, stmt)
+			d.regs[reg] = localExpr(v.Name)
+		}
+		reg++
+	}
+}
+
+// reg returns the expression held by register r. A table constructor
+// that has to be bound to a temporary is bound when it is first used.
+func (d *decompiler) reg(r int) expr {
+	if r < 0 || r >= len(d.regs) || d.regs[r] == nil {
+		return constExpr{nil}
+	}
+	if table, ok := d.regs[r].(*tableExpr); ok && table.bind {
+		d.bind(r)
+	}
+	return d.regs[r]
+}
+
+// constructor returns the table constructor held by register r, which the
+// fields stored into the register are added to
+func (d *decompiler) constructor(r int) (*tableExpr, bool) {
+	if r < 0 || r >= len(d.regs) {
+		return nil, false
+	}
+	table, ok := d.regs[r].(*tableExpr)
+	return table, ok
+}
+
+func (d *decompiler) setReg(r int, value expr) {
+	if r < len(d.regs) {
+		d.regs[r] = value
+		d.stamps[r] = d.stored
+	}
+}
+
+// setResult sets register r to the value computed by instruction pc, and
+// binds it to a temporary when it has to be written where it is computed
+func (d *decompiler) setResult(pc, r int, value expr) {
+	d.setReg(r, value)
+	if d.bound[pc] && r < len(d.regs) {
+		d.bind(r)
+	}
+}
+
+// bind declares a temporary holding the expression of register r, and
+// makes the register refer to it
+func (d *decompiler) bind(r int) {
+	value := d.regs[r]
+	if table, ok := value.(*tableExpr); ok {
+		table.bind = false
+	}
+
+	name := d.temp()
+	d.stmts = append(d.stmts, statement{local: true, target: name, values: []expr{value}})
+	d.regs[r] = name
+}
+
+// temp returns the name of a new temporary, one that no global, field or
+// local variable of the chunk is named
+func (d *decompiler) temp() localExpr {
+	for {
+		d.temps++
+		name := fmt.Sprintf("_t%d", d.temps)
+		if !slices.Contains(d.proto.Constants, Constant(name)) &&
+			!slices.ContainsFunc(d.proto.LocVars, func(v LocVar) bool { return v.Name == name }) {
+			return localExpr(name)
+		}
+	}
+}
+
+// access returns the access of a value computed by instruction pc
+func (d *decompiler) access(pc int) access {
+	return access{pc, d.effects}
+}
+
+// assign adds an assignment statement, which is a side effect
+func (d *decompiler) assign(target, value expr) {
+	d.effects++
+	d.stmts = append(d.stmts, statement{target: target, values: []expr{value}, seq: d.effects})
+}
+
+// list returns n registers starting at a; n < 0 means up to the top set by
+// the last multi-result call or vararg
+func (d *decompiler) list(a, n int) []expr {
+	fixed := n >= 0
+	if !fixed {
+		n = d.top - a
+	}
+	values := make([]expr, 0, max(n, 0))
+	for r := a; r < a+n; r++ {
+		values = append(values, d.reg(r))
+	}
+	if fixed && len(values) > 0 {
+		values[len(values)-1] = single(values[len(values)-1])
+	}
+	return values
+}
+
+// single wraps calls and varargs in parentheses, so they produce exactly
+// one value at the end of a list
+func single(e expr) expr {
+	switch e.(type) {
+	case *callExpr, varargExpr:
+		return parenExpr{e}
+	}
+	return e
+}
+
+// call builds the call expression of the CALL or TAILCALL instruction pc
+func (d *decompiler) call(a, b, pc int) *callExpr {
+	call := &callExpr{fn: d.reg(a), args: d.list(a+1, b-1)}
+	d.effects++
+	call.access = d.access(pc)
+	if method, ok := call.fn.(methodExpr); ok {
+		call.fn = method.object
+		call.method = method.name
+		if len(call.args) > 0 {
+			call.args = call.args[1:]
+		}
+	}
+	return call
+}
+
+func (d *decompiler) constant(index int) (constExpr, error) {
+	if index < 0 || index >= len(d.proto.Constants) {
+		return constExpr{}, fmt.Errorf("constant %d out of range", index)
+	}
+	return constExpr{d.proto.Constants[index]}, nil
+}
+
+// rk returns the register or constant referred to by a B or C argument
+func (d *decompiler) rk(arg int) (expr, error) {
+	if arg&bitRK != 0 {
+		return d.constant(arg &^ bitRK)
+	}
+	return d.reg(arg), nil
+}
+
+// global returns the expression for the global variable named by a constant
+func (d *decompiler) global(index int, at access) (expr, error) {
+	k, err := d.constant(index)
+	if err != nil {
+		return nil, err
+	}
+	name, ok := k.value.(string)
+	if !ok {
+		return nil, fmt.Errorf("global name is not a string")
+	}
+	if !parser.IsName(name) {
+		return indexExpr{nameExpr{"_G", at}, k, at}, nil
+	}
+	return nameExpr{name, at}, nil
+}
+
+// errorf reports an error at an instruction, with its source line when the
+// chunk has debug information
+func (d *decompiler) errorf(pc int, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if pc < len(d.proto.LineInfo) {
+		return fmt.Errorf("%s:%d: %s", d.name, d.proto.LineInfo[pc], msg)
+	}
+	return fmt.Errorf("%s: instruction %d: %s", d.name, pc+1, msg)
+}
+
+func (e constExpr) format(string) string {
+	switch v := e.value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return formatNumber(v)
+	case string:
+		return parser.QuoteString(v, '"')
+	}
+	return "nil"
+}
+
+func (e nameExpr) format(string) string { return e.name }
+
+func (e localExpr) format(string) string { return string(e) }
+
+func (varargExpr) format(string) string { return "..." }
+
+func (e parenExpr) format(indent string) string {
+	return "(" + e.inner.format(indent) + ")"
+}
+
+func (e indexExpr) format(indent string) string {
+	if name, ok := nameConstant(e.key); ok {
+		return prefix(e.object, indent) + "." + name
+	}
+	return prefix(e.object, indent) + "[" + e.key.format(indent) + "]"
+}
+
+func (e methodExpr) format(indent string) string {
+	return prefix(e.object, indent) + ":" + e.name
+}
+
+func (e *callExpr) format(indent string) string {
+	fn := prefix(e.fn, indent)
+	if e.method != "" {
+		fn += ":" + e.method
+	}
+	return fn + "(" + formatList(e.args, indent) + ")"
+}
+
+func (e unaryExpr) format(indent string) string {
+	return e.op + operand(e.operand, indent)
+}
+
+func (e binaryExpr) format(indent string) string {
+	return operand(e.left, indent) + " " + e.op + " " + operand(e.right, indent)
+}
+
+func (e concatExpr) format(indent string) string {
+	parts := make([]string, len(e.parts))
+	for i, part := range e.parts {
+		parts[i] = operand(part, indent)
+	}
+	return strings.Join(parts, " .. ")
+}
+
+// format writes small tables of plain values on one line and everything
+// else one field per line
+func (e *tableExpr) format(indent string) string {
+	if len(e.fields) == 0 {
+		return "{}"
+	}
+
+	inline := len(e.fields) <= 10
+	for _, f := range e.fields {
+		if _, ok := f.value.(*tableExpr); ok {
+			inline = false
+		}
+	}
+
+	inner := indent + "\t"
+	parts := make([]string, len(e.fields))
+	for i, f := range e.fields {
+		value := f.value
+		if paren, ok := value.(parenExpr); ok && f.key == nil && i < len(e.fields)-1 {
+			// Only the last item of a constructor takes several values
+			value = paren.inner
+		}
+		parts[i] = value.format(inner)
+		if f.key == nil {
+			continue
+		}
+		if name, ok := nameConstant(f.key); ok {
+			parts[i] = name + " = " + parts[i]
+		} else {
+			parts[i] = "[" + f.key.format(inner) + "] = " + parts[i]
+		}
+	}
+
+	if inline {
+		return "{ " + strings.Join(parts, ", ") + " }"
+	}
+	return "{\n" + inner + strings.Join(parts, ",\n"+inner) + ",\n" + indent + "}"
+}
+
+// insert adds a field after the fields stored before it was computed
+func (e *tableExpr) insert(f field) {
+	i := len(e.fields)
+	for i > 0 && e.fields[i-1].seq > f.seq {
+		i--
+	}
+	e.fields = slices.Insert(e.fields, i, f)
+}
+
+// prefix formats an expression used as the object of an index or a call,
+// adding parentheses where Lua requires them
+func prefix(e expr, indent string) string {
+	switch e.(type) {
+	case nameExpr, localExpr, indexExpr, *callExpr, parenExpr:
+		return e.format(indent)
+	}
+	return "(" + e.format(indent) + ")"
+}
+
+// operand formats an operand of an operator; nested operations are
+// parenthesized so precedence never has to be worked out
+func operand(e expr, indent string) string {
+	switch e.(type) {
+	case unaryExpr, binaryExpr, concatExpr:
+		return "(" + e.format(indent) + ")"
+	}
+	if k, ok := e.(constExpr); ok {
+		if f, ok := k.value.(float64); ok && (f < 0 || math.Signbit(f)) {
+			return "(" + e.format(indent) + ")"
+		}
+	}
+	return e.format(indent)
+}
+
+// nameConstant returns the string of a constant that is a valid identifier
+func nameConstant(e expr) (string, bool) {
+	k, ok := e.(constExpr)
+	if !ok {
+		return "", false
+	}
+	name, ok := k.value.(string)
+	return name, ok && parser.IsName(name)
+}
+
+func formatList(values []expr, indent string) string {
+	parts := make([]string, len(values))
+	for i, value := range values {
+		parts[i] = value.format(indent)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// formatNumber writes a number constant so it reads back to the same value
+func formatNumber(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "1e999"
+	case math.IsInf(f, -1):
+		return "-1e999"
+	case math.IsNaN(f):
+		return "(0/0)"
+	case f == 0 && math.Signbit(f):
+		return "-0"
+	case f == math.Trunc(f) && math.Abs(f) < 1<<53:
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
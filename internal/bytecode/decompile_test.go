@@ -0,0 +1,160 @@
+package bytecode
+
+import (
+	"strings"
+	"testing"
+
+	"luamerge/internal/parser"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// decompile compiles source and decompiles it again, without the debug
+// information when strip is set, like a chunk written by luac -s
+func decompile(t *testing.T, source string, strip bool) string {
+	t.Helper()
+
+	file, err := parser.ParseFile("test.lua", source, parser.Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proto, err := Compile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strip {
+		proto.LineInfo, proto.LocVars = nil, nil
+	}
+	data, err := Dump(&DefaultHeader, proto)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompiled, err := Decompile("test.lua", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decompiled
+}
+
+// prelude defines functions that log their calls and change globals, so
+// running a chunk in another order gives another result
+const prelude = `
+calls = ""
+X = 1
+function f() calls = calls .. "f"; X = X + 1; return X end
+function g() calls = calls .. "g"; X = X * 10; return X end
+function GetColor(n) calls = calls .. "c"; return n * 100 + X end
+function AddItem(t, name) calls = calls .. name .. #t end
+`
+
+// outcome serializes the calls and the globals a chunk sets
+const outcome = `
+local function dump(v)
+	if type(v) ~= "table" then return tostring(v) end
+	local keys = {}
+	for k in pairs(v) do keys[#keys + 1] = k end
+	table.sort(keys, function(a, b) return tostring(a) < tostring(b) end)
+	local s = "{"
+	for _, k in ipairs(keys) do s = s .. tostring(k) .. "=" .. dump(v[k]) .. "," end
+	return s .. "}"
+end
+return calls .. " X=" .. X .. " A=" .. dump(A) .. " B=" .. dump(B) .. " T=" .. dump(T) .. " same=" .. tostring(A ~= nil and A == B)
+`
+
+// run runs source after the prelude and returns its outcome
+func run(t *testing.T, source string) string {
+	t.Helper()
+
+	L := lua.NewState()
+	defer L.Close()
+	for _, chunk := range []string{prelude, source, outcome} {
+		if err := L.DoString(chunk); err != nil {
+			t.Fatalf("%v\n%s", err, source)
+		}
+	}
+	return L.Get(-1).String()
+}
+
+func TestDecompileOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"constructor", `T = { GetColor(3), x = f(), GetColor(4), [g()] = f() }`},
+		{"nested calls", `T = { GetColor(X, f()), y = X }`},
+		{"global reassigned", "local a = X\nX = 2\nA = a"},
+		{"result used twice", "local c = f()\nA = c\nB = c"},
+		{"calls swapped", "local a = f()\nlocal b = g()\nT = { b, a }"},
+		{"read before call", "local a = f()\nT = { X, a }"},
+		{"result unused", "local a = f()\nA = X"},
+		{"table used twice", "local t = { 1, f() }\nA = t\nB = t"},
+		{"field reassigned", "local t = { x = f() }\nA = t\nt.x = g()\nB = t"},
+		{"call statement", "local a = X\ng()\nA = a\nB = f()"},
+	}
+
+	for _, tt := range tests {
+		want := run(t, tt.source)
+		for _, strip := range []bool{false, true} {
+			decompiled := decompile(t, tt.source, strip)
+			if got := run(t, decompiled); got != want {
+				t.Errorf("%s (stripped: %v): got %s, want %s\n%s", tt.name, strip, got, want, decompiled)
+			}
+		}
+	}
+}
+
+func TestDecompileConstructor(t *testing.T) {
+	got := decompile(t, `T = { GetColor(3), x = f() }`, true)
+	want := "T = { GetColor(3), x = f() }\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecompileTemporaries(t *testing.T) {
+	got := decompile(t, "local c = f()\nA = c\nB = c", true)
+	want := "local _t1 = f()\nA = _t1\nB = _t1\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDecompileCorrupted(t *testing.T) {
+	abc := func(op, a, b, c int) uint32 { return uint32(op) | uint32(a)<<6 | uint32(c)<<14 | uint32(b)<<23 }
+	abx := func(op, a, bx int) uint32 { return uint32(op) | uint32(a)<<6 | uint32(bx)<<14 }
+	ret := abc(OpReturn, 0, 1, 0)
+
+	tests := []struct {
+		name string
+		code []uint32
+		want string
+	}{
+		{"concat backwards", []uint32{abc(OpConcat, 0, 1, 0), ret}, "CONCAT refers to registers 1 to 0"},
+		{"concat past frame", []uint32{abc(OpConcat, 0, 0, 200), ret}, "CONCAT refers to registers 0 to 200"},
+		{"move", []uint32{abc(OpMove, 0, 9, 0), ret}, "MOVE refers to registers 9 to 9"},
+		{"target", []uint32{abx(OpLoadK, 255, 0), ret}, "LOADK refers to registers 255 to 255"},
+		{"loadnil", []uint32{abc(OpLoadNil, 1, 0, 0), ret}, "LOADNIL refers to registers 1 to 0"},
+		{"settable value", []uint32{abc(OpNewTable, 0, 0, 0), abc(OpSetTable, 0, bitRK, 100), ret}, "SETTABLE refers to register 100"},
+		{"call", []uint32{abx(OpGetGlobal, 0, 0), abc(OpCall, 0, 100, 1), ret}, "CALL refers to registers 0 to 99"},
+		{"setlist", []uint32{abc(OpNewTable, 0, 0, 0), abc(OpSetList, 0, 50, 1), ret}, "SETLIST refers to registers 0 to 50"},
+		{"constant", []uint32{abx(OpLoadK, 0, 7), ret}, "constant 7 out of range"},
+		{"return", []uint32{abc(OpReturn, 1, 5, 0)}, "RETURN refers to registers 1 to 4"},
+	}
+
+	for _, tt := range tests {
+		proto := &Proto{Source: "@test.lua", IsVararg: varargIsVararg, MaxStackSize: 2, Code: tt.code, Constants: []Constant{"x"}}
+		data, err := Dump(&DefaultHeader, proto)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		source, err := Decompile("test.lua", data)
+		if err == nil {
+			t.Errorf("%s: decompiled to %q, want an error", tt.name, source)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %q, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package bytecode
+
+import (
+	"fmt"
+	"math"
+)
+
+// DefaultHeader is the platform of the official game clients:
+// 32-bit little-endian with double numbers, the output of a stock x86 luac 5.1
+var DefaultHeader = Header{
+	LittleEndian: true,
+	IntSize:      4,
+	SizeTSize:    4,
+	NumberSize:   8,
+}
+
+// ReadHeader returns the header of a precompiled Lua 5.1 chunk
+func ReadHeader(data []byte) (*Header, error) {
+	r := &reader{data: data}
+	return r.header()
+}
+
+// Dump writes a function as a precompiled Lua 5.1 chunk for the platform
+// described by header, in the format of luac 5.1 (lundump.c/ldump.c)
+func Dump(header *Header, proto *Proto) ([]byte, error) {
+	w := &writer{Header: header}
+
+	w.data = append(w.data, Signature...)
+	w.data = append(w.data, version51, 0, boolByte(header.LittleEndian),
+		byte(header.IntSize), byte(header.SizeTSize), 4, byte(header.NumberSize), boolByte(header.Integral))
+
+	if err := w.proto(proto, ""); err != nil {
+		return nil, err
+	}
+	return w.data, nil
+}
+
+// writer encodes the binary chunk format
+type writer struct {
+	*Header
+	data []byte
+}
+
+func boolByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// uint writes an unsigned integer of the given size in the chunk's byte order
+func (w *writer) uint(n uint64, size int) {
+	for i := range size {
+		shift := 8 * i
+		if !w.LittleEndian {
+			shift = 8 * (size - 1 - i)
+		}
+		w.data = append(w.data, byte(n>>shift))
+	}
+}
+
+func (w *writer) int(n int) {
+	w.uint(uint64(n), w.IntSize)
+}
+
+func (w *writer) string(s string, null bool) {
+	if null {
+		w.uint(0, w.SizeTSize)
+		return
+	}
+	w.uint(uint64(len(s)+1), w.SizeTSize)
+	w.data = append(w.data, s...)
+	w.data = append(w.data, 0)
+}
+
+func (w *writer) number(f float64) error {
+	switch {
+	case w.Integral:
+		if f != math.Trunc(f) {
+			return fmt.Errorf("number %v cannot be stored in an integral chunk", f)
+		}
+		w.uint(uint64(int64(f)), w.NumberSize)
+	case w.NumberSize == 4:
+		w.uint(uint64(math.Float32bits(float32(f))), 4)
+	default:
+		w.uint(math.Float64bits(f), 8)
+	}
+	return nil
+}
+
+func (w *writer) proto(p *Proto, parentSource string) error {
+	// Nested functions from the same file do not repeat the source name
+	w.string(p.Source, p.Source == parentSource)
+	w.int(p.LineDefined)
+	w.int(p.LastLine)
+	w.data = append(w.data, byte(p.NumUpvalues), byte(p.NumParams), byte(p.IsVararg), byte(p.MaxStackSize))
+
+	w.int(len(p.Code))
+	for _, ins := range p.Code {
+		w.uint(uint64(ins), 4)
+	}
+
+	w.int(len(p.Constants))
+	for _, k := range p.Constants {
+		switch v := k.(type) {
+		case nil:
+			w.data = append(w.data, constNil)
+		case bool:
+			w.data = append(w.data, constBoolean, boolByte(v))
+		case float64:
+			w.data = append(w.data, constNumber)
+			if err := w.number(v); err != nil {
+				return err
+			}
+		case string:
+			w.data = append(w.data, constString)
+			w.string(v, false)
+		default:
+			return fmt.Errorf("invalid constant %v", k)
+		}
+	}
+
+	w.int(len(p.Protos))
+	for _, child := range p.Protos {
+		if err := w.proto(child, p.Source); err != nil {
+			return err
+		}
+	}
+
+	w.int(len(p.LineInfo))
+	for _, line := range p.LineInfo {
+		w.int(line)
+	}
+
+	w.int(len(p.LocVars))
+	for _, v := range p.LocVars {
+		w.string(v.Name, false)
+		w.int(v.StartPC)
+		w.int(v.EndPC)
+	}
+
+	w.int(len(p.Upvalues))
+	for _, name := range p.Upvalues {
+		w.string(name, false)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package bytecode
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"luamerge/internal/parser"
+)
+
+// The chunks in testdata stand for those luac 5.1 writes for the .lua
+// file of the same name on x86: name.luac with debug information, and
+// name.s.luac stripped (luac -s). No luac 5.1 was at hand when they were
+// written, so they were assembled by hand after lcode.c and lparser.c of
+// Lua 5.1.5, instruction by instruction: until testdata/generate.sh is run
+// with a stock luac 5.1, they only check the compiler against that reading.
+
+// goldenSources returns the names of the Lua files in testdata
+func goldenSources(t *testing.T) []string {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.lua"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no Lua files in testdata")
+	}
+
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = strings.TrimSuffix(filepath.Base(path), ".lua")
+	}
+	return names
+}
+
+// readGolden reads a file of testdata
+func readGolden(t *testing.T, name string) []byte {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDumpGolden(t *testing.T) {
+	for _, name := range goldenSources(t) {
+		file, err := parser.ParseFile(name+".lua", string(readGolden(t, name+".lua")), parser.Lua51)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, strip := range []bool{false, true} {
+			golden := name + ".luac"
+			if strip {
+				golden = name + ".s.luac"
+			}
+			want := readGolden(t, golden)
+
+			proto, err := Compile(file)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if strip {
+				proto.Source, proto.LineInfo, proto.LocVars = "", nil, nil
+			}
+			header, err := ReadHeader(want)
+			if err != nil {
+				t.Fatalf("%s: %v", golden, err)
+			}
+
+			got, err := Dump(header, proto)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: got\n% x\nwant\n% x", golden, got, want)
+			}
+		}
+	}
+}
+
+func TestDecompileGolden(t *testing.T) {
+	for _, name := range goldenSources(t) {
+		want := run(t, string(readGolden(t, name+".lua")))
+
+		for _, golden := range []string{name + ".luac", name + ".s.luac"} {
+			decompiled, err := Decompile(golden, readGolden(t, golden))
+			if err != nil {
+				t.Errorf("%s: %v", golden, err)
+				continue
+			}
+			if got := run(t, decompiled); got != want {
+				t.Errorf("%s: got %s, want %s\n%s", golden, got, want, decompiled)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package bytecode
+
+// Opcodes of the Lua 5.1 virtual machine
+const (
+	OpMove = iota
+	OpLoadK
+	OpLoadBool
+	OpLoadNil
+	OpGetUpval
+	OpGetGlobal
+	OpGetTable
+	OpSetGlobal
+	OpSetUpval
+	OpSetTable
+	OpNewTable
+	OpSelf
+	OpAdd
+	OpSub
+	OpMul
+	OpDiv
+	OpMod
+	OpPow
+	OpUnm
+	OpNot
+	OpLen
+	OpConcat
+	OpJmp
+	OpEq
+	OpLt
+	OpLe
+	OpTest
+	OpTestSet
+	OpCall
+	OpTailCall
+	OpReturn
+	OpForLoop
+	OpForPrep
+	OpTForLoop
+	OpSetList
+	OpClose
+	OpClosure
+	OpVararg
+)
+
+var opNames = [...]string{
+	"MOVE", "LOADK", "LOADBOOL", "LOADNIL", "GETUPVAL", "GETGLOBAL",
+	"GETTABLE", "SETGLOBAL", "SETUPVAL", "SETTABLE", "NEWTABLE", "SELF",
+	"ADD", "SUB", "MUL", "DIV", "MOD", "POW", "UNM", "NOT", "LEN", "CONCAT",
+	"JMP", "EQ", "LT", "LE", "TEST", "TESTSET", "CALL", "TAILCALL", "RETURN",
+	"FORLOOP", "FORPREP", "TFORLOOP", "SETLIST", "CLOSE", "CLOSURE", "VARARG",
+}
+
+// Instruction layout: OP(6) A(8) C(9) B(9), or OP(6) A(8) Bx(18)
+const (
+	// bitRK marks a B or C argument that refers to a constant
+	bitRK = 1 << 8
+
+	// fieldsPerFlush is the number of list items stored by each SETLIST
+	fieldsPerFlush = 50
+)
+
+func opcode(i uint32) int { return int(i & 0x3f) }
+func argA(i uint32) int   { return int(i >> 6 & 0xff) }
+func argB(i uint32) int   { return int(i >> 23 & 0x1ff) }
+func argC(i uint32) int   { return int(i >> 14 & 0x1ff) }
+func argBx(i uint32) int  { return int(i >> 14) }
+
+// opName returns the mnemonic of an opcode
+func opName(op int) string {
+	if op < len(opNames) {
+		return opNames[op]
+	}
+	return "UNKNOWN"
+}
@@ -0,0 +1,119 @@
+package bytecode
+
+import "slices"
+
+// checker walks the decompiled statements in the order the Lua source
+// runs them, and compares it with the order the chunk ran them in
+type checker struct {
+	effects   int          // side effects run so far
+	calls     map[int]int  // instructions of the calls whose result is used, by seq
+	seen      map[int]bool // instructions of the calls and constructors written
+	unordered []int        // calls and constructors
+	reads     []int
+}
+
+// check returns the instructions whose value has to be bound to a
+// temporary for the decompiled source to run as the chunk does: calls that
+// would run out of order, twice or not at all, reads of variables that a
+// side effect would run before or after, and table constructors written
+// twice, which would build two tables.
+// Reads are only returned once the calls are in order, since binding a
+// call moves the reads of its arguments as well.
+func (d *decompiler) check() []int {
+	c := &checker{calls: d.calls, seen: map[int]bool{}}
+	for _, stmt := range d.stmts {
+		if index, ok := stmt.target.(indexExpr); ok {
+			// The table and key of the target are computed before the value
+			c.walk(index.object)
+			c.walk(index.key)
+		}
+		for _, value := range stmt.values {
+			c.walk(value)
+		}
+		if stmt.seq > 0 {
+			c.effects = stmt.seq
+		}
+	}
+
+	// Calls whose result is never used are not written at all
+	for _, pc := range d.calls {
+		if !c.seen[pc] {
+			c.unordered = append(c.unordered, pc)
+		}
+	}
+
+	unordered := c.unordered
+	if len(unordered) == 0 {
+		unordered = c.reads
+	}
+	slices.Sort(unordered)
+	return slices.Compact(unordered)
+}
+
+// walk visits an expression in the order Lua evaluates it
+func (c *checker) walk(e expr) {
+	switch e := e.(type) {
+	case nameExpr:
+		c.read(e.access)
+	case indexExpr:
+		c.walk(e.object)
+		c.walk(e.key)
+		c.read(e.access)
+	case methodExpr:
+		c.walk(e.object)
+	case *callExpr:
+		if c.seen[e.pc] {
+			c.unordered = append(c.unordered, e.pc)
+			return
+		}
+		c.seen[e.pc] = true
+		c.walk(e.fn)
+		for _, arg := range e.args {
+			c.walk(arg)
+		}
+		if e.seq <= c.effects {
+			c.unordered = append(c.unordered, e.pc)
+		} else {
+			c.effects = e.seq
+		}
+	case *tableExpr:
+		if c.seen[e.pc] {
+			c.unordered = append(c.unordered, e.pc)
+			return
+		}
+		c.seen[e.pc] = true
+		for _, f := range e.fields {
+			if f.key != nil {
+				c.walk(f.key)
+			}
+			c.walk(f.value)
+		}
+	case unaryExpr:
+		c.walk(e.operand)
+	case binaryExpr:
+		c.walk(e.left)
+		c.walk(e.right)
+	case concatExpr:
+		for _, part := range e.parts {
+			c.walk(part)
+		}
+	case parenExpr:
+		c.walk(e.inner)
+	}
+}
+
+// read checks that a variable is read after the side effects that ran
+// before it, and before the others
+func (c *checker) read(at access) {
+	switch {
+	case at.seq < c.effects:
+		c.reads = append(c.reads, at.pc)
+	case at.seq > c.effects:
+		// The calls that ran before the read are written after it
+		for seq := c.effects + 1; seq <= at.seq; seq++ {
+			if pc, ok := c.calls[seq]; ok {
+				c.unordered = append(c.unordered, pc)
+			}
+		}
+	}
+}
@@ -0,0 +1 @@
+A = 1
@@ -0,0 +1 @@
+T = { a = 1, "x", b = { 2 } }
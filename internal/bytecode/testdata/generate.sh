@@ -0,0 +1,13 @@
+#!/bin/sh
+# Writes the chunks of the golden tests with a stock luac 5.1:
+# name.luac with debug information, name.s.luac stripped.
+# The tests read the platform from each chunk, so any build of luac works.
+# Usage: ./generate.sh [luac]
+set -e
+cd "$(dirname "$0")"
+LUAC=${1:-luac5.1}
+for src in *.lua; do
+	name=${src%.lua}
+	"$LUAC" -o "$name.luac" "$src"
+	"$LUAC" -s -o "$name.s.luac" "$src"
+done
@@ -0,0 +1,7 @@
+T = {
+	a = 1,
+	"x",
+	"y"
+}
+GetColor(T.a,
+	1)
@@ -0,0 +1,3 @@
+local t = { 1, 2 }
+AddItem(t, "x")
+return t
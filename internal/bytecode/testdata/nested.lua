@@ -0,0 +1,4 @@
+T = {
+	{ 1, { "a" } },
+	k = { x = { y = 2 } },
+}
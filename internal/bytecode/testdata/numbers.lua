@@ -0,0 +1 @@
+N = { -1, 2.5, -0.25, 1e100, 0x10, n = -7 }
@@ -0,0 +1,352 @@
+package bytecode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Signature is the magic number at the start of every precompiled Lua chunk
+const Signature = "\x1bLua"
+
+// version51 is the version byte of Lua 5.1 chunks
+const version51 = 0x51
+
+// Constant types of a Lua 5.1 chunk
+const (
+	constNil     = 0
+	constBoolean = 1
+	constNumber  = 3
+	constString  = 4
+)
+
+// Header describes the platform a chunk was compiled for
+type Header struct {
+	LittleEndian bool
+	IntSize      int
+	SizeTSize    int
+	NumberSize   int
+	Integral     bool
+}
+
+// Constant is an entry of a function's constant table:
+// nil, bool, float64 or string
+type Constant any
+
+// LocVar is the debug information of a local variable: its register is
+// active for the instructions [StartPC, EndPC)
+type LocVar struct {
+	Name    string
+	StartPC int
+	EndPC   int
+}
+
+// Proto is a Lua 5.1 function prototype
+type Proto struct {
+	Source       string
+	LineDefined  int
+	LastLine     int
+	NumUpvalues  int
+	NumParams    int
+	IsVararg     int
+	MaxStackSize int
+	Code         []uint32
+	Constants    []Constant
+	Protos       []*Proto
+	LineInfo     []int
+	LocVars      []LocVar
+	Upvalues     []string
+}
+
+// IsBytecode reports whether data is a precompiled Lua chunk
+func IsBytecode(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Signature))
+}
+
+// Undump reads a precompiled Lua 5.1 chunk (as written by luac 5.1)
+// and returns its header and main function
+func Undump(data []byte) (*Header, *Proto, error) {
+	r := &reader{data: data}
+
+	header, err := r.header()
+	if err != nil {
+		return nil, nil, err
+	}
+	r.Header = header
+
+	proto, err := r.proto("")
+	if err != nil {
+		return nil, nil, err
+	}
+	if r.pos != len(data) {
+		return nil, nil, fmt.Errorf("unexpected data after chunk at offset %d", r.pos)
+	}
+
+	return header, proto, nil
+}
+
+// reader decodes the binary chunk format
+type reader struct {
+	*Header
+	data []byte
+	pos  int
+}
+
+var errTruncated = errors.New("truncated precompiled chunk")
+
+func (r *reader) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(r.data)-r.pos {
+		return nil, errTruncated
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *reader) byte() (int, error) {
+	b, err := r.bytes(1)
+	if err != nil {
+		return 0, err
+	}
+	return int(b[0]), nil
+}
+
+// uint reads an unsigned integer of the given size in the chunk's byte order
+func (r *reader) uint(size int) (uint64, error) {
+	b, err := r.bytes(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for i := range b {
+		shift := 8 * i
+		if !r.LittleEndian {
+			shift = 8 * (size - 1 - i)
+		}
+		n |= uint64(b[i]) << shift
+	}
+	return n, nil
+}
+
+func (r *reader) int() (int, error) {
+	n, err := r.uint(r.IntSize)
+	if err != nil {
+		return 0, err
+	}
+	return int(signExtend(n, r.IntSize)), nil
+}
+
+// signExtend interprets the low size bytes of n as a signed integer
+func signExtend(n uint64, size int) int64 {
+	shift := 64 - 8*size
+	return int64(n<<shift) >> shift
+}
+
+// count reads a vector length, rejecting lengths larger than the data left
+func (r *reader) count() (int, error) {
+	n, err := r.int()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > len(r.data)-r.pos {
+		return 0, errTruncated
+	}
+	return n, nil
+}
+
+func (r *reader) string() (string, error) {
+	size, err := r.uint(r.SizeTSize)
+	if err != nil {
+		return "", err
+	}
+	if size == 0 {
+		return "", nil
+	}
+	if size > uint64(len(r.data)-r.pos) {
+		return "", errTruncated
+	}
+
+	// The size includes the terminating '\0'
+	b, err := r.bytes(int(size))
+	if err != nil {
+		return "", err
+	}
+	return string(b[:len(b)-1]), nil
+}
+
+func (r *reader) number() (float64, error) {
+	n, err := r.uint(r.NumberSize)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case r.Integral:
+		return float64(signExtend(n, r.NumberSize)), nil
+	case r.NumberSize == 4:
+		return float64(math.Float32frombits(uint32(n))), nil
+	default:
+		return math.Float64frombits(n), nil
+	}
+}
+
+func (r *reader) header() (*Header, error) {
+	b, err := r.bytes(12)
+	if err != nil {
+		return nil, errors.New("not a precompiled Lua chunk")
+	}
+	if string(b[:4]) != Signature {
+		return nil, errors.New("not a precompiled Lua chunk")
+	}
+	if b[4] != version51 {
+		return nil, fmt.Errorf("unsupported bytecode version %d.%d (only Lua 5.1 is supported)", b[4]>>4, b[4]&0xf)
+	}
+	if b[5] != 0 {
+		return nil, fmt.Errorf("unsupported bytecode format %d", b[5])
+	}
+
+	header := &Header{
+		LittleEndian: b[6] == 1,
+		IntSize:      int(b[7]),
+		SizeTSize:    int(b[8]),
+		NumberSize:   int(b[10]),
+		Integral:     b[11] != 0,
+	}
+
+	switch {
+	case header.IntSize != 4 && header.IntSize != 8:
+		return nil, fmt.Errorf("unsupported int size %d", header.IntSize)
+	case header.SizeTSize != 4 && header.SizeTSize != 8:
+		return nil, fmt.Errorf("unsupported size_t size %d", header.SizeTSize)
+	case b[9] != 4:
+		return nil, fmt.Errorf("unsupported instruction size %d", b[9])
+	case header.NumberSize != 4 && header.NumberSize != 8 && !header.Integral,
+		header.NumberSize < 1 || header.NumberSize > 8:
+		return nil, fmt.Errorf("unsupported number size %d", header.NumberSize)
+	}
+
+	return header, nil
+}
+
+func (r *reader) proto(parentSource string) (*Proto, error) {
+	var err error
+	p := &Proto{}
+
+	if p.Source, err = r.string(); err != nil {
+		return nil, err
+	}
+	if p.Source == "" {
+		p.Source = parentSource
+	}
+	if p.LineDefined, err = r.int(); err != nil {
+		return nil, err
+	}
+	if p.LastLine, err = r.int(); err != nil {
+		return nil, err
+	}
+
+	var b []byte
+	if b, err = r.bytes(4); err != nil {
+		return nil, err
+	}
+	p.NumUpvalues, p.NumParams, p.IsVararg, p.MaxStackSize = int(b[0]), int(b[1]), int(b[2]), int(b[3])
+
+	// Code
+	n, err := r.count()
+	if err != nil {
+		return nil, err
+	}
+	p.Code = make([]uint32, n)
+	for i := range p.Code {
+		ins, err := r.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		p.Code[i] = uint32(ins)
+	}
+
+	// Constants
+	if n, err = r.count(); err != nil {
+		return nil, err
+	}
+	p.Constants = make([]Constant, n)
+	for i := range p.Constants {
+		t, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case constNil:
+			p.Constants[i] = nil
+		case constBoolean:
+			v, err := r.byte()
+			if err != nil {
+				return nil, err
+			}
+			p.Constants[i] = v != 0
+		case constNumber:
+			if p.Constants[i], err = r.number(); err != nil {
+				return nil, err
+			}
+		case constString:
+			if p.Constants[i], err = r.string(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("invalid constant type %d", t)
+		}
+	}
+
+	// Nested functions
+	if n, err = r.count(); err != nil {
+		return nil, err
+	}
+	p.Protos = make([]*Proto, n)
+	for i := range p.Protos {
+		if p.Protos[i], err = r.proto(p.Source); err != nil {
+			return nil, err
+		}
+	}
+
+	// Debug information (empty when stripped with luac -s)
+	if n, err = r.count(); err != nil {
+		return nil, err
+	}
+	p.LineInfo = make([]int, n)
+	for i := range p.LineInfo {
+		if p.LineInfo[i], err = r.int(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n, err = r.count(); err != nil {
+		return nil, err
+	}
+	p.LocVars = make([]LocVar, n)
+	for i := range p.LocVars {
+		v := &p.LocVars[i]
+		if v.Name, err = r.string(); err != nil {
+			return nil, err
+		}
+		if v.StartPC, err = r.int(); err != nil {
+			return nil, err
+		}
+		if v.EndPC, err = r.int(); err != nil {
+			return nil, err
+		}
+	}
+
+	if n, err = r.count(); err != nil {
+		return nil, err
+	}
+	p.Upvalues = make([]string, n)
+	for i := range p.Upvalues {
+		if p.Upvalues[i], err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
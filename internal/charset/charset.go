@@ -0,0 +1,76 @@
+package charset
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// aliases maps code page names commonly used for game client files to
+// their WHATWG encoding labels
+var aliases = map[string]string{
+	"utf8":  "utf-8",
+	"cp949": "euc-kr",
+	"uhc":   "euc-kr",
+	"cp950": "big5",
+	"cp936": "gbk",
+	"cp932": "shift_jis",
+	"cp874": "windows-874",
+}
+
+// Lookup returns the encoding registered under name (utf-8, cp949/euc-kr,
+// cp1252, big5, gbk, shift_jis, ...). Names are case-insensitive.
+func Lookup(name string) (encoding.Encoding, error) {
+	label := strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := aliases[label]; ok {
+		label = alias
+	}
+
+	if label == "utf-8" {
+		return unicode.UTF8, nil
+	}
+
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, fmt.Errorf("unknown encoding '%s'", name)
+	}
+	return enc, nil
+}
+
+// Converter returns a function that converts text from one encoding to another.
+// It returns nil when no conversion is needed: either name is empty or both
+// name the same encoding.
+func Converter(from, to string) (func(string) (string, error), error) {
+	if from == "" || to == "" {
+		return nil, nil
+	}
+
+	fromEnc, err := Lookup(from)
+	if err != nil {
+		return nil, err
+	}
+	toEnc, err := Lookup(to)
+	if err != nil {
+		return nil, err
+	}
+
+	if fromEnc == toEnc {
+		return nil, nil
+	}
+
+	return func(text string) (string, error) {
+		decoded, err := fromEnc.NewDecoder().String(text)
+		if err != nil {
+			return "", fmt.Errorf("cannot decode text as %s: %w", from, err)
+		}
+
+		encoded, err := toEnc.NewEncoder().String(decoded)
+		if err != nil {
+			return "", fmt.Errorf("cannot encode text as %s: %w", to, err)
+		}
+		return encoded, nil
+	}, nil
+}
@@ -0,0 +1,56 @@
+package charset
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding/korean"
+)
+
+func TestLookup(t *testing.T) {
+	for _, name := range []string{"cp949", "CP949", " uhc ", "euc-kr"} {
+		enc, err := Lookup(name)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if enc != korean.EUCKR {
+			t.Errorf("%s: got %v, want EUC-KR", name, enc)
+		}
+	}
+
+	if _, err := Lookup("cp9999"); err == nil || err.Error() != "unknown encoding 'cp9999'" {
+		t.Errorf("got error %v, want an unknown encoding", err)
+	}
+}
+
+func TestConverter(t *testing.T) {
+	for _, pair := range [][2]string{{"", "cp949"}, {"utf-8", ""}, {"utf8", "UTF-8"}, {"cp949", "euc-kr"}} {
+		convert, err := Converter(pair[0], pair[1])
+		if err != nil || convert != nil {
+			t.Errorf("%s to %s: got a conversion (%v), want none", pair[0], pair[1], err)
+		}
+	}
+
+	if _, err := Converter("utf-8", "cp9999"); err == nil {
+		t.Error("got no error for an unknown encoding")
+	}
+
+	toCP949, err := Converter("utf-8", "cp949")
+	if err != nil {
+		t.Fatal(err)
+	}
+	toUTF8, err := Converter("cp949", "utf-8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 한글 in CP949
+	got, err := toCP949("한글 ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\xc7\xd1\xb1\xdb ok"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if back, err := toUTF8(got); err != nil || back != "한글 ok" {
+		t.Errorf("converted back to %q (%v), want %q", back, err, "한글 ok")
+	}
+}
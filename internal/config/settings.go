@@ -3,28 +3,78 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"luamerge/internal/charset"
+	"luamerge/internal/merger"
+	"luamerge/internal/parser"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 // GlobalOptions represents global options for all jobs
 type GlobalOptions struct {
-	KeepUnmergedItems bool `json:"keepUnmergedItems"`
+	KeepUnmergedItems bool     `json:"keepUnmergedItems"`
+	InputEncoding     string   `json:"inputEncoding,omitempty"`
+	OutputEncoding    string   `json:"outputEncoding,omitempty"`
+	DuplicateTables   string   `json:"duplicateTables,omitempty"`
+	ParseMode         string   `json:"parseMode,omitempty"`
+	LuaVersion        string   `json:"luaVersion,omitempty"`
+	EvalInstructions  int      `json:"evalInstructions,omitempty"`
+	EvalTimeout       float64  `json:"evalTimeout,omitempty"`
+	EvalMemory        int      `json:"evalMemory,omitempty"`
+	FollowIncludes    bool     `json:"followIncludes,omitempty"`
+	Constants         []string `json:"constants,omitempty"`
 }
 
 // JobOptions represents job-specific options (can override global options)
 type JobOptions struct {
-	KeepUnmergedItems *bool `json:"keepUnmergedItems,omitempty"`
+	KeepUnmergedItems *bool    `json:"keepUnmergedItems,omitempty"`
+	InputEncoding     string   `json:"inputEncoding,omitempty"`
+	OutputEncoding    string   `json:"outputEncoding,omitempty"`
+	OutputFormat      string   `json:"outputFormat,omitempty"`
+	DuplicateTables   string   `json:"duplicateTables,omitempty"`
+	ParseMode         string   `json:"parseMode,omitempty"`
+	LuaVersion        string   `json:"luaVersion,omitempty"`
+	EvalInstructions  int      `json:"evalInstructions,omitempty"`
+	EvalTimeout       float64  `json:"evalTimeout,omitempty"`
+	EvalMemory        int      `json:"evalMemory,omitempty"`
+	FollowIncludes    *bool    `json:"followIncludes,omitempty"`
+	Constants         []string `json:"constants,omitempty"`
 }
 
+// Default limits of a file run in eval mode
+const (
+	DefaultEvalInstructions = 100_000_000
+	DefaultEvalTimeout      = 30 * time.Second
+	DefaultEvalMemory       = 512 // MiB
+)
+
+// Output formats
+const (
+	FormatSource   = "lua" // Lua source text
+	FormatBytecode = "lub" // Precompiled Lua 5.1 chunk
+)
+
 // Job represents a merge task configured in settings.json
 type Job struct {
-	Name    string                 `json:"name"`
-	Base    string                 `json:"base"`
-	Source  string                 `json:"source"`
-	Output  string                 `json:"output"`
-	Tables  map[string]any         `json:"tables"`
-	Options *JobOptions            `json:"options,omitempty"`
+	Name    string                `json:"name"`
+	Base    string                `json:"base"`
+	Source  string                `json:"source"`
+	Output  string                `json:"output"`
+	Tables  map[string]any        `json:"tables"`
+	Calls   map[string]CallConfig `json:"calls,omitempty"`
+	Options *JobOptions           `json:"options,omitempty"`
+}
+
+// CallConfig configures the merge of the call statements of a function,
+// such as AddItem{ ... } or Register("name", { ... }).
+// The calls are paired by the argument at position KeyArg (1-based) or by
+// the field KeyField of their table argument; Rules works as in tables.
+type CallConfig struct {
+	KeyArg   int    `json:"keyArg,omitempty"`
+	KeyField string `json:"keyField,omitempty"`
+	Rules    any    `json:"rules"`
 }
 
 // GetTablesConfig normalizes the tables configuration to the format expected by the merger
@@ -50,6 +100,33 @@ func (j *Job) GetTablesConfig() map[string]map[string]any {
 	return result
 }
 
+// GetCallsConfig normalizes the calls configuration to the format expected by the merger
+func (j *Job) GetCallsConfig() map[string]merger.CallTarget {
+	result := make(map[string]merger.CallTarget)
+
+	for function, call := range j.Calls {
+		target := merger.CallTarget{KeyArg: call.KeyArg, KeyField: call.KeyField}
+
+		switch v := call.Rules.(type) {
+		case nil:
+			// No rules: replace the whole table argument
+		case bool:
+			if !v {
+				continue
+			}
+		case map[string]any:
+			target.Rules = v
+		default:
+			// Ignore invalid values
+			continue
+		}
+
+		result[function] = target
+	}
+
+	return result
+}
+
 // Settings represents the complete job configuration
 type Settings struct {
 	Options *GlobalOptions `json:"options,omitempty"`
@@ -72,6 +149,167 @@ func (j *Job) GetKeepUnmergedItems(globalOptions *GlobalOptions) bool {
 	return false
 }
 
+// GetFollowIncludes returns whether the dofile and require includes of the
+// input files are followed, respecting the hierarchy. Defaults to false.
+func (j *Job) GetFollowIncludes(globalOptions *GlobalOptions) bool {
+	if j.Options != nil && j.Options.FollowIncludes != nil {
+		return *j.Options.FollowIncludes
+	}
+
+	if globalOptions != nil {
+		return globalOptions.FollowIncludes
+	}
+
+	return false
+}
+
+// GetConstants returns the constant files of the job, relative to the input
+// folder, respecting the hierarchy. The files of the job replace the global
+// ones.
+func (j *Job) GetConstants(globalOptions *GlobalOptions) []string {
+	if j.Options != nil && j.Options.Constants != nil {
+		return j.Options.Constants
+	}
+
+	if globalOptions != nil {
+		return globalOptions.Constants
+	}
+
+	return nil
+}
+
+// GetInputEncoding returns the encoding of the source file, respecting the hierarchy.
+// An empty string means the source is read as is.
+func (j *Job) GetInputEncoding(globalOptions *GlobalOptions) string {
+	if j.Options != nil && j.Options.InputEncoding != "" {
+		return j.Options.InputEncoding
+	}
+
+	if globalOptions != nil {
+		return globalOptions.InputEncoding
+	}
+
+	return ""
+}
+
+// GetOutputEncoding returns the encoding of the base and output files, respecting the hierarchy.
+// An empty string means the base is written back as is.
+func (j *Job) GetOutputEncoding(globalOptions *GlobalOptions) string {
+	if j.Options != nil && j.Options.OutputEncoding != "" {
+		return j.Options.OutputEncoding
+	}
+
+	if globalOptions != nil {
+		return globalOptions.OutputEncoding
+	}
+
+	return ""
+}
+
+// GetDuplicateTables returns the policy for tables defined more than once in
+// an input file, respecting the hierarchy. Defaults to a warning.
+func (j *Job) GetDuplicateTables(globalOptions *GlobalOptions) string {
+	if j.Options != nil && j.Options.DuplicateTables != "" {
+		return strings.ToLower(j.Options.DuplicateTables)
+	}
+
+	if globalOptions != nil && globalOptions.DuplicateTables != "" {
+		return strings.ToLower(globalOptions.DuplicateTables)
+	}
+
+	return merger.DuplicatesWarn
+}
+
+// GetParseMode returns how syntax errors in the input files are handled,
+// respecting the hierarchy. Defaults to strict.
+func (j *Job) GetParseMode(globalOptions *GlobalOptions) string {
+	if j.Options != nil && j.Options.ParseMode != "" {
+		return strings.ToLower(j.Options.ParseMode)
+	}
+
+	if globalOptions != nil && globalOptions.ParseMode != "" {
+		return strings.ToLower(globalOptions.ParseMode)
+	}
+
+	return merger.ParseStrict
+}
+
+// luaVersion returns the Lua version of the input files as written in the
+// settings, respecting the hierarchy. Defaults to 5.1.
+func (j *Job) luaVersion(globalOptions *GlobalOptions) string {
+	if j.Options != nil && j.Options.LuaVersion != "" {
+		return j.Options.LuaVersion
+	}
+
+	if globalOptions != nil && globalOptions.LuaVersion != "" {
+		return globalOptions.LuaVersion
+	}
+
+	return parser.Lua51.String()
+}
+
+// GetEvalLimits returns the limits of a file run in eval mode, respecting
+// the hierarchy for each of them. evalTimeout is in seconds, evalMemory in
+// MiB.
+func (j *Job) GetEvalLimits(globalOptions *GlobalOptions) parser.EvalLimits {
+	limits := parser.EvalLimits{
+		Instructions: DefaultEvalInstructions,
+		Timeout:      DefaultEvalTimeout,
+		Memory:       DefaultEvalMemory << 20,
+	}
+
+	if globalOptions != nil {
+		if globalOptions.EvalInstructions != 0 {
+			limits.Instructions = globalOptions.EvalInstructions
+		}
+		if globalOptions.EvalTimeout != 0 {
+			limits.Timeout = time.Duration(globalOptions.EvalTimeout * float64(time.Second))
+		}
+		if globalOptions.EvalMemory != 0 {
+			limits.Memory = int64(globalOptions.EvalMemory) << 20
+		}
+	}
+
+	if j.Options != nil {
+		if j.Options.EvalInstructions != 0 {
+			limits.Instructions = j.Options.EvalInstructions
+		}
+		if j.Options.EvalTimeout != 0 {
+			limits.Timeout = time.Duration(j.Options.EvalTimeout * float64(time.Second))
+		}
+		if j.Options.EvalMemory != 0 {
+			limits.Memory = int64(j.Options.EvalMemory) << 20
+		}
+	}
+
+	return limits
+}
+
+// GetLuaVersion returns the grammar the input files are parsed with.
+// The version is checked when the settings are loaded; an invalid one
+// falls back to Lua 5.1.
+func (j *Job) GetLuaVersion(globalOptions *GlobalOptions) parser.Version {
+	version, err := parser.ParseVersion(j.luaVersion(globalOptions))
+	if err != nil {
+		return parser.Lua51
+	}
+	return version
+}
+
+// GetOutputFormat returns the format of the output file: the job option if
+// set, otherwise bytecode for a .lub output and source text for anything else
+func (j *Job) GetOutputFormat() string {
+	if j.Options != nil && j.Options.OutputFormat != "" {
+		return strings.ToLower(j.Options.OutputFormat)
+	}
+
+	if strings.EqualFold(filepath.Ext(j.Output), ".lub") {
+		return FormatBytecode
+	}
+
+	return FormatSource
+}
+
 // LoadSettingsFromInput loads the settings.json file from the input folder
 func LoadSettingsFromInput(inputDir string) (*Settings, error) {
 	settingsPath := filepath.Join(inputDir, "settings.json")
@@ -101,7 +339,7 @@ func LoadSettingsFromInput(inputDir string) (*Settings, error) {
 
 	// Validate each job
 	for i, job := range settings.Jobs {
-		if err := validateJob(job, i); err != nil {
+		if err := validateJob(job, i, settings.Options); err != nil {
 			return nil, err
 		}
 	}
@@ -110,7 +348,7 @@ func LoadSettingsFromInput(inputDir string) (*Settings, error) {
 }
 
 // validateJob validates an individual job
-func validateJob(job Job, index int) error {
+func validateJob(job Job, index int, globalOptions *GlobalOptions) error {
 	jobID := fmt.Sprintf("job[%d]", index)
 	if job.Name != "" {
 		jobID = fmt.Sprintf("job[%d] (%s)", index, job.Name)
@@ -128,8 +366,84 @@ func validateJob(job Job, index int) error {
 		return fmt.Errorf("%s: 'output' field is required", jobID)
 	}
 
-	if len(job.Tables) == 0 {
-		return fmt.Errorf("%s: 'tables' field is required and must contain at least one table", jobID)
+	if len(job.Tables) == 0 && len(job.Calls) == 0 {
+		return fmt.Errorf("%s: 'tables' or 'calls' field is required and must contain at least one entry", jobID)
+	}
+
+	for tableName, rules := range job.GetTablesConfig() {
+		if err := merger.CheckRules(rules); err != nil {
+			return fmt.Errorf("%s: table '%s': %w", jobID, tableName, err)
+		}
+	}
+
+	for function, call := range job.Calls {
+		if rules, ok := call.Rules.(map[string]any); ok {
+			if err := merger.CheckRules(rules); err != nil {
+				return fmt.Errorf("%s: call '%s': %w", jobID, function, err)
+			}
+		}
+		if call.KeyArg < 0 {
+			return fmt.Errorf("%s: call '%s': 'keyArg' must be a positive argument position", jobID, function)
+		}
+		if call.KeyArg > 0 && call.KeyField != "" {
+			return fmt.Errorf("%s: call '%s': 'keyArg' and 'keyField' cannot be used together", jobID, function)
+		}
+	}
+
+	if format := job.GetOutputFormat(); format != FormatSource && format != FormatBytecode {
+		return fmt.Errorf("%s: invalid 'outputFormat' '%s' (expected '%s' or '%s')", jobID, format, FormatSource, FormatBytecode)
+	}
+
+	switch policy := job.GetDuplicateTables(globalOptions); policy {
+	case merger.DuplicatesWarn, merger.DuplicatesError, merger.DuplicatesIgnore:
+	default:
+		return fmt.Errorf("%s: invalid 'duplicateTables' '%s' (expected '%s', '%s' or '%s')", jobID, policy, merger.DuplicatesWarn, merger.DuplicatesError, merger.DuplicatesIgnore)
+	}
+
+	switch mode := job.GetParseMode(globalOptions); mode {
+	case merger.ParseStrict, merger.ParseRecover:
+	case merger.ParseEval:
+		// Evaluated tables have no source text to edit, and no call statements
+		if job.GetKeepUnmergedItems(globalOptions) {
+			return fmt.Errorf("%s: 'parseMode' '%s' cannot be used with 'keepUnmergedItems'", jobID, mode)
+		}
+		if len(job.Calls) > 0 {
+			return fmt.Errorf("%s: 'parseMode' '%s' cannot be used with 'calls'", jobID, mode)
+		}
+		if job.GetLuaVersion(globalOptions) != parser.Lua51 {
+			return fmt.Errorf("%s: 'parseMode' '%s' requires 'luaVersion' 5.1", jobID, mode)
+		}
+		if job.GetFollowIncludes(globalOptions) {
+			return fmt.Errorf("%s: 'parseMode' '%s' cannot be used with 'followIncludes'", jobID, mode)
+		}
+		if len(job.GetConstants(globalOptions)) > 0 {
+			return fmt.Errorf("%s: 'parseMode' '%s' cannot be used with 'constants'", jobID, mode)
+		}
+	default:
+		return fmt.Errorf("%s: invalid 'parseMode' '%s' (expected '%s', '%s' or '%s')", jobID, mode, merger.ParseStrict, merger.ParseRecover, merger.ParseEval)
+	}
+
+	if limits := job.GetEvalLimits(globalOptions); limits.Instructions < 0 || limits.Timeout < 0 || limits.Memory < 0 {
+		return fmt.Errorf("%s: 'evalInstructions', 'evalTimeout' and 'evalMemory' cannot be negative", jobID)
+	}
+
+	if _, err := parser.ParseVersion(job.luaVersion(globalOptions)); err != nil {
+		return fmt.Errorf("%s: invalid 'luaVersion': %w", jobID, err)
+	}
+
+	for _, name := range job.GetConstants(globalOptions) {
+		if name == "" {
+			return fmt.Errorf("%s: 'constants' cannot contain an empty path", jobID)
+		}
+	}
+
+	for _, name := range []string{job.GetInputEncoding(globalOptions), job.GetOutputEncoding(globalOptions)} {
+		if name == "" {
+			continue
+		}
+		if _, err := charset.Lookup(name); err != nil {
+			return fmt.Errorf("%s: %w", jobID, err)
+		}
 	}
 
 	return nil
@@ -166,3 +480,17 @@ func ResolveJobPaths(job Job, inputDir string) (basePath, sourcePath, outputPath
 
 	return basePath, sourcePath, outputPath, nil
 }
+
+// ResolveConstantPaths resolves the constant files of a job relative to the
+// input folder
+func ResolveConstantPaths(job Job, globalOptions *GlobalOptions, inputDir string) ([]string, error) {
+	var paths []string
+	for _, name := range job.GetConstants(globalOptions) {
+		path := filepath.Join(inputDir, name)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, fmt.Errorf("constants file not found: %s", path)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
@@ -0,0 +1,134 @@
+package merger
+
+import (
+	"fmt"
+	"luamerge/internal/bytecode"
+	"luamerge/internal/charset"
+	"luamerge/internal/parser"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileCache keeps the parsed input files of a run, so a file shared by
+// several tables or jobs is read and parsed only once.
+// Merges never modify a parsed file: every table is extracted anew from
+// the syntax tree, so cached files can be reused safely.
+type FileCache struct {
+	files    map[fileKey]*parser.File
+	reported map[*parser.File]bool
+}
+
+// fileKey identifies a parsed file: the same file read with another
+// encoding conversion, or parsed with another grammar or mode, is a
+// different entry. In eval mode, so is the same file run with other limits.
+type fileKey struct {
+	path    string
+	from    string
+	to      string
+	version parser.Version
+	mode    string
+	limits  parser.EvalLimits
+	root    string
+	consts  string
+}
+
+// Syntax describes how a file is read: the grammar of its Lua version and
+// the parse mode (see Options). Limits bound the evaluation in eval mode.
+// IncludeRoot and Constants only keep apart the files whose includes are
+// followed or that use constant files, as those files are attached to them.
+type Syntax struct {
+	Version     parser.Version
+	Mode        string
+	Limits      parser.EvalLimits
+	IncludeRoot string
+	Constants   []string
+}
+
+// NewFileCache creates an empty file cache
+func NewFileCache() *FileCache {
+	return &FileCache{
+		files:    make(map[fileKey]*parser.File),
+		reported: make(map[*parser.File]bool),
+	}
+}
+
+// Load returns the parsed Lua file at path, converted from one encoding to
+// another when both are set and differ, and read as described by syntax.
+// A nil cache loads the file every time.
+func (c *FileCache) Load(path, fromEncoding, toEncoding string, syntax Syntax) (*parser.File, error) {
+	if c == nil {
+		return loadFile(path, fromEncoding, toEncoding, syntax)
+	}
+
+	key := fileKey{path: path, from: fromEncoding, to: toEncoding, version: syntax.Version, mode: syntax.Mode, root: syntax.IncludeRoot, consts: strings.Join(syntax.Constants, "\n")}
+	if abs, err := filepath.Abs(path); err == nil {
+		key.path = abs
+	}
+	if syntax.Mode == ParseEval {
+		key.limits = syntax.Limits
+	}
+
+	if file, ok := c.files[key]; ok {
+		return file, nil
+	}
+
+	file, err := loadFile(path, fromEncoding, toEncoding, syntax)
+	if err != nil {
+		return nil, err
+	}
+	c.files[key] = file
+	return file, nil
+}
+
+// report reports whether the errors of a parsed file still have to be
+// reported, and marks them as reported. A nil cache always reports them.
+func (c *FileCache) report(file *parser.File) bool {
+	if c == nil {
+		return true
+	}
+	if c.reported[file] {
+		return false
+	}
+	c.reported[file] = true
+	return true
+}
+
+// loadFile reads and parses a Lua file.
+// Precompiled Lua 5.1 chunks (.lub) are decompiled, so they can be
+// merged like any other file.
+// In recover mode, syntax errors do not fail the load (see
+// parser.ParseFileRecover); in eval mode, the file is run instead of
+// parsed (see parser.EvalFile).
+func loadFile(path, fromEncoding, toEncoding string, syntax Syntax) (*parser.File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	text := string(data)
+	if bytecode.IsBytecode(data) {
+		if text, err = bytecode.Decompile(path, data); err != nil {
+			return nil, err
+		}
+	}
+
+	convert, err := charset.Converter(fromEncoding, toEncoding)
+	if err != nil {
+		return nil, err
+	}
+	if convert != nil {
+		if text, err = parser.Transcode(path, text, syntax.Version, convert); err != nil {
+			return nil, fmt.Errorf("failed to transcode: %w", err)
+		}
+	}
+
+	switch syntax.Mode {
+	case ParseRecover:
+		return parser.ParseFileRecover(path, text, syntax.Version), nil
+	case ParseEval:
+		return parser.EvalFile(path, text, syntax.Limits)
+	default:
+		return parser.ParseFile(path, text, syntax.Version)
+	}
+}
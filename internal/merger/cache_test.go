@@ -0,0 +1,79 @@
+package merger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"luamerge/internal/parser"
+)
+
+// writeBenchFiles writes a base and a source file with several large
+// tables, like the client files that many jobs read
+func writeBenchFiles(b *testing.B, tables, entries int) (string, string) {
+	b.Helper()
+
+	write := func(name, title string) string {
+		var sb strings.Builder
+		for t := 0; t < tables; t++ {
+			fmt.Fprintf(&sb, "Table%d = {\n", t)
+			for i := 1; i <= entries; i++ {
+				fmt.Fprintf(&sb, "\t[%d] = { Title = \"%s %d\", Description = \"Entry %d of table %d\", Level = %d },\n", i, title, i, i, t, i%99)
+			}
+			sb.WriteString("}\n\n")
+		}
+
+		path := filepath.Join(b.TempDir(), name)
+		if err := os.WriteFile(path, []byte(sb.String()), 0644); err != nil {
+			b.Fatal(err)
+		}
+		return path
+	}
+
+	return write("base.lua", "Base"), write("source.lua", "Source")
+}
+
+// BenchmarkMergeTables runs several jobs that merge one table each from
+// the same pair of files, with and without a shared FileCache
+func BenchmarkMergeTables(b *testing.B) {
+	const jobs = 8
+	basePath, sourcePath := writeBenchFiles(b, jobs, 2000)
+
+	run := func(b *testing.B, files func() *FileCache) {
+		for b.Loop() {
+			options := Options{Files: files()}
+			for job := 0; job < jobs; job++ {
+				config := map[string]map[string]any{
+					fmt.Sprintf("Table%d", job): {"entry": map[string]any{"Title": true}},
+				}
+				if _, err := MergeTables(basePath, sourcePath, config, options); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+
+	b.Run("NoCache", func(b *testing.B) {
+		run(b, func() *FileCache { return nil })
+	})
+	b.Run("SharedCache", func(b *testing.B) {
+		run(b, NewFileCache)
+	})
+}
+
+func TestFileCacheEvalLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "loop.lua")
+	if err := os.WriteFile(path, []byte("T = {}\nfor i = 1, 1000 do T[i] = i end\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	files := NewFileCache()
+	if _, err := files.Load(path, "", "", Syntax{Mode: ParseEval, Limits: parser.EvalLimits{Instructions: 1000000}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := files.Load(path, "", "", Syntax{Mode: ParseEval, Limits: parser.EvalLimits{Instructions: 100}}); err == nil {
+		t.Error("a run with a lower instruction limit reused the earlier result")
+	}
+}
@@ -0,0 +1,162 @@
+package merger
+
+import (
+	"fmt"
+	"luamerge/internal/parser"
+	"os"
+)
+
+// CallTarget describes how the calls to one function are paired up and merged.
+// The key of a call is taken from the argument at position KeyArg (1-based)
+// or from the field KeyField of its table argument. When neither is set, the
+// first string or number argument is the key.
+type CallTarget struct {
+	KeyArg   int
+	KeyField string
+	Rules    map[string]any
+}
+
+// mergeCall applies the rules to the table argument of a base call.
+// Without rules, the whole table is taken from the source call.
+// path is the path of the call (function and key), for reports.
+func mergeCall(base, source *parser.Call, rules map[string]any, path parser.Path, options Options) {
+	if len(rules) == 0 {
+		for sourceEntry := range source.Table.Range() {
+			base.Table.AddOrReplaceEntry(sourceEntry)
+		}
+		return
+	}
+	applyRules(base.Table, source.Table, rules, path, options)
+}
+
+// callKey extracts the key that pairs up base and source calls
+func callKey(call *parser.Call, target CallTarget, version parser.Version) (parser.Key, error) {
+	var value *parser.Value
+
+	switch {
+	case target.KeyField != "":
+		v, ok := call.Table.Get(call.Table.ResolveKey(parser.ParseKey(target.KeyField, version)))
+		if !ok {
+			return parser.Key{}, fmt.Errorf("%s: table argument has no field '%s'", call.Pos(), target.KeyField)
+		}
+		value = v
+	case target.KeyArg > 0:
+		if target.KeyArg > len(call.Args) {
+			return parser.Key{}, fmt.Errorf("%s: call has no argument %d", call.Pos(), target.KeyArg)
+		}
+		value = call.Args[target.KeyArg-1]
+	default:
+		for _, arg := range call.Args {
+			if arg.Type == parser.TypeString || arg.Type == parser.TypeNumber {
+				value = arg
+				break
+			}
+		}
+		if value == nil {
+			return parser.Key{}, fmt.Errorf("%s: call has no string or number argument to use as key (set keyArg or keyField)", call.Pos())
+		}
+	}
+
+	key, err := value.Key()
+	if err != nil {
+		return parser.Key{}, fmt.Errorf("%s: key %w", call.Pos(), err)
+	}
+	return key, nil
+}
+
+// findCalls resolves the calls to a function in a file, keyed for pairing.
+// Calls that share a key are reported according to the duplicates policy.
+func findCalls(file *parser.File, function parser.Path, target CallTarget, options Options) ([]*parser.Call, []parser.Key, error) {
+	calls, err := file.FindCalls(function)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]parser.Key, len(calls))
+	first := make(map[parser.Key]*parser.Call)
+	for i, call := range calls {
+		key, err := callKey(call, target, options.LuaVersion)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[i] = key
+
+		previous, ok := first[key]
+		if !ok {
+			first[key] = call
+			continue
+		}
+
+		switch options.Duplicates {
+		case DuplicatesIgnore:
+		case DuplicatesError:
+			return nil, nil, fmt.Errorf("key %s is used by several calls (%s, %s)", key, previous.Pos(), call.Pos())
+		default:
+			options.warnf("key %s of '%s' is used by several calls (%s, %s)", key, function, previous.Pos(), call.Pos())
+		}
+	}
+	return calls, keys, nil
+}
+
+// MergeCalls merges the table arguments of call statements from two Lua files.
+// Every base call is paired with the last source call that has the same key;
+// base calls without a match are left unchanged.
+// Returns one Result per function, holding all of its base calls.
+func MergeCalls(basePath, sourcePath string, callsConfig map[string]CallTarget, options Options) ([]Result, error) {
+	if len(callsConfig) == 0 {
+		return nil, fmt.Errorf("calls configuration cannot be empty")
+	}
+
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("base file not found: %s", basePath)
+	}
+	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("source file not found: %s", sourcePath)
+	}
+
+	baseFile, err := options.LoadBase(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read base file '%s': %w", basePath, err)
+	}
+	sourceFile, err := options.LoadSource(sourcePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source file '%s': %w", sourcePath, err)
+	}
+
+	var results []Result
+
+	for name, target := range callsConfig {
+		function, err := parser.ParsePath(name, options.LuaVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		baseCalls, baseKeys, err := findCalls(baseFile, function, target, options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse calls to '%s' in base file: %w", name, err)
+		}
+
+		sourceCalls, sourceKeys, err := findCalls(sourceFile, function, target, options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse calls to '%s' in source file: %w", name, err)
+		}
+
+		sources := make(map[parser.Key]*parser.Call, len(sourceCalls))
+		for i, call := range sourceCalls {
+			sources[sourceKeys[i]] = call
+		}
+
+		for i, call := range baseCalls {
+			if source, ok := sources[baseKeys[i]]; ok {
+				mergeCall(call, source, target.Rules, append(function[:len(function):len(function)], baseKeys[i]), options)
+			}
+		}
+
+		results = append(results, Result{
+			TableName: name,
+			Calls:     baseCalls,
+		})
+	}
+
+	return results, nil
+}
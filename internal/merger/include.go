@@ -0,0 +1,89 @@
+package merger
+
+import (
+	"fmt"
+	"luamerge/internal/parser"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// resolveIncludes loads the files included by file (read from path) and
+// attaches them to it. Included files are read like the file itself, with
+// the same encodings, and their own includes are followed in turn.
+// Includes that cannot be resolved or loaded are reported and skipped.
+func (o Options) resolveIncludes(file *parser.File, path, fromEncoding, toEncoding string, active map[string]bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	active[abs] = true
+	defer delete(active, abs)
+
+	files := make(map[*parser.CallStmt]*parser.File)
+	for _, include := range file.Includes() {
+		includePath, err := o.includePath(path, include)
+		if err != nil {
+			o.warnf("%s: %s (include skipped)", include.Pos(), err)
+			continue
+		}
+		if active[includePath] {
+			o.warnf("%s: '%s' includes itself (include skipped)", include.Pos(), include.Name)
+			continue
+		}
+
+		included, err := o.loadIncluded(includePath, fromEncoding, toEncoding, active)
+		if err != nil {
+			o.warnf("%s: failed to read '%s': %s (include skipped)", include.Pos(), include.Name, err)
+			continue
+		}
+		files[include.Stmt] = included
+	}
+
+	file.ResolveIncludes(files)
+}
+
+// includePath finds the file an include loads. dofile paths, and require
+// module names (a.b is a/b.lua or a/b.lub), are looked up next to the
+// including file, then in the include root. Files outside the root are
+// never read.
+func (o Options) includePath(from string, include parser.Include) (string, error) {
+	root, err := filepath.Abs(o.IncludeRoot)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.Abs(filepath.Dir(from))
+	if err != nil {
+		return "", err
+	}
+
+	name := filepath.FromSlash(strings.ReplaceAll(include.Name, `\`, "/"))
+	names := []string{name}
+	if include.Require {
+		module := filepath.FromSlash(strings.ReplaceAll(include.Name, ".", "/"))
+		names = []string{module + ".lua", module + ".lub"}
+	}
+
+	outside := false
+	for _, base := range []string{dir, root} {
+		for _, name := range names {
+			path := filepath.Join(base, name)
+			if filepath.IsAbs(name) {
+				path = filepath.Clean(name)
+			}
+
+			if rel, err := filepath.Rel(root, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				outside = true
+				continue
+			}
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				return path, nil
+			}
+		}
+	}
+
+	if outside {
+		return "", fmt.Errorf("'%s' is outside of %s", include.Name, o.IncludeRoot)
+	}
+	return "", fmt.Errorf("'%s' was not found", include.Name)
+}
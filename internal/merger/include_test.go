@@ -0,0 +1,111 @@
+package merger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"luamerge/internal/parser"
+)
+
+// writeTree writes files, by slash-separated path, in a temporary
+// directory and returns the directory
+func writeTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for name, source := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestIncludes(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string // main.lua includes the others
+		want     string            // T.a, or the error of finding T
+		warnings []string          // with {root} for the directory
+	}{
+		{
+			name: "table in an included file",
+			files: map[string]string{
+				"main.lua":       "dofile(\"data/items.lua\")\nT.b = 2\n",
+				"data/items.lua": "T = { a = 1 }\n",
+			},
+			want: "1",
+		},
+		{
+			name: "relative require",
+			files: map[string]string{
+				"main.lua":            "require \"data.items\"\n",
+				"data/items.lua":      "require \"skill.info\"\n",
+				"data/skill/info.lua": "T = { a = 2 }\n",
+			},
+			want: "2",
+		},
+		{
+			name: "missing file",
+			files: map[string]string{
+				"main.lua": "A = 1\ndofile(\"missing.lua\")\nT = { a = 3 }\n",
+			},
+			want:     "3",
+			warnings: []string{"{root}/main.lua:2:1: 'missing.lua' was not found (include skipped)"},
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.lua": "dofile(\"a.lua\")\nT.b = 2\n",
+				"a.lua":    "T = { a = 4 }\ndofile(\"b.lua\")\n",
+				"b.lua":    "dofile(\"a.lua\")\n",
+			},
+			want:     "4",
+			warnings: []string{"{root}/b.lua:1:1: 'a.lua' includes itself (include skipped)"},
+		},
+		{
+			name: "self",
+			files: map[string]string{
+				"main.lua": "dofile(\"main.lua\")\nT = { a = 5 }\n",
+			},
+			want:     "5",
+			warnings: []string{"{root}/main.lua:1:1: 'main.lua' includes itself (include skipped)"},
+		},
+	}
+
+	for _, tt := range tests {
+		root := writeTree(t, tt.files)
+
+		var warnings []string
+		options := Options{IncludeRoot: root, Warn: func(message string) { warnings = append(warnings, message) }}
+		file, err := options.LoadBase(filepath.Join(root, "main.lua"))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		got := ""
+		if table, err := findTable(file, parser.Path{parser.StringKey("T")}, options); err != nil {
+			got = err.Error()
+		} else if value, ok := table.Get(parser.StringKey("a")); ok {
+			got = value.Raw()
+		}
+		if got != tt.want {
+			t.Errorf("%s: got T.a = %s, want %s", tt.name, got, tt.want)
+		}
+
+		want := make([]string, len(tt.warnings))
+		for i, warning := range tt.warnings {
+			want[i] = strings.ReplaceAll(warning, "{root}/", root+string(filepath.Separator))
+		}
+		if strings.Join(warnings, "\n") != strings.Join(want, "\n") {
+			t.Errorf("%s: got warnings %q, want %q", tt.name, warnings, want)
+		}
+	}
+}
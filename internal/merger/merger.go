@@ -4,23 +4,41 @@ import (
 	"fmt"
 	"luamerge/internal/parser"
 	"os"
+	"strconv"
+	"strings"
 )
 
 // applyRules recursively applies merge rules to a table.
-// Supports deep merging at any nesting level.
-func applyRules(base, source *parser.Table, rules map[string]any) {
+// Supports deep merging at any nesting level. Nested rules that meet a
+// value which is not a table are reported as warnings. Keys missing from
+// the base are only merged with the addMissing strategy, and keys missing
+// from the source only removed with the removeMissing strategy.
+// path is the path of the table, for reports.
+func applyRules(base, source *parser.Table, rules map[string]any, path parser.Path, options Options) {
+	strategy, rules := splitStrategies(rules)
+	missing := make(map[parser.Key]bool)
+	stale := make(map[parser.Key]bool)
+
 	for ruleKey, ruleValue := range rules {
-		baseValue, baseExists := base.Get(ruleKey)
-		sourceValue, sourceExists := source.Get(ruleKey)
+		key, baseValue, baseExists := lookup(base, ruleKey, options.LuaVersion)
+		sourceKey, sourceValue, sourceExists := lookup(source, ruleKey, options.LuaVersion)
 
-		// If the key doesn't exist in both, skip
-		if !baseExists || !sourceExists {
+		// Keys missing from either side are left alone, unless a strategy
+		// adds or removes them
+		if !sourceExists {
+			if baseExists {
+				stale[key] = true
+			}
+			continue
+		}
+		if !baseExists {
+			missing[sourceKey] = true
 			continue
 		}
 
 		// If the rule is true, replace the value completely
 		if ruleBool, ok := ruleValue.(bool); ok && ruleBool {
-			base.AddOrReplace(ruleKey, sourceValue)
+			base.AddOrReplace(key, sourceValue)
 			continue
 		}
 
@@ -31,20 +49,65 @@ func applyRules(base, source *parser.Table, rules map[string]any) {
 
 			// Both need to be tables for recursive merge
 			if baseIsTable == nil && sourceIsTable == nil {
-				applyRules(baseTable, sourceTable, nestedRules)
+				applyRules(baseTable, sourceTable, nestedRules, append(path[:len(path):len(path)], key), options)
+				continue
+			}
+
+			for _, value := range []*parser.Value{baseValue, sourceValue} {
+				if value.Type != parser.TypeTable {
+					options.warnf("%s: rule '%s' expects a table, found %s", value.Pos(), ruleKey, value.Type)
+				}
 			}
 		}
 	}
+
+	if strategy.removeMissing && len(stale) > 0 {
+		removeMissing(base, source, func(key parser.Key) bool { return stale[key] }, path, options)
+	}
+	if strategy.addMissing != "" && len(missing) > 0 {
+		addMissing(base, source, func(key parser.Key) bool { return missing[key] }, strategy.addMissing)
+	}
+}
+
+// lookup finds the entry a rule refers to. Rule keys use the Lua notation
+// of paths (name, [12], ["my key"]); a bare integer also matches the
+// numeric key, as rules have always allowed. A key that names a constant
+// ([SKID.SM_BASH]) is resolved through the constants of the table's file.
+func lookup(table *parser.Table, rule string, version parser.Version) (parser.Key, *parser.Value, bool) {
+	key := table.ResolveKey(parser.ParseKey(rule, version))
+	if value, ok := table.Get(key); ok {
+		return key, value, true
+	}
+
+	if i, err := strconv.ParseInt(rule, 10, 64); err == nil {
+		key = parser.IntKey(i)
+		value, ok := table.Get(key)
+		return key, value, ok
+	}
+	return key, nil, false
 }
 
 // mergeInternal applies rules to all entries of a top-level table.
 // Iterates over all entries in the base table and applies merge rules.
-func mergeInternal(baseTable, sourceTable *parser.Table, rules map[string]any) {
+// With the addMissing strategy, the source entries the base lacks are
+// inserted as well, and with the removeMissing strategy, the base entries
+// the source lacks are deleted. path is the path of the table, for reports.
+func mergeInternal(baseTable, sourceTable *parser.Table, rules map[string]any, path parser.Path, options Options) {
+	strategy, rules := splitStrategies(rules)
+	all := func(parser.Key) bool { return true }
+
+	if strategy.removeMissing {
+		removeMissing(baseTable, sourceTable, all, path, options)
+	}
+
 	// If rules is nil or empty, replace the entire table
 	if len(rules) == 0 {
+		if strategy.addMissing != "" {
+			addMissing(baseTable, sourceTable, all, strategy.addMissing)
+		}
 		// Clear the base table and copy everything from source
 		for sourceEntry := range sourceTable.Range() {
-			baseTable.AddOrReplace(sourceEntry.Name, sourceEntry.Value)
+			baseTable.AddOrReplaceEntry(sourceEntry)
 		}
 		return
 	}
@@ -52,9 +115,12 @@ func mergeInternal(baseTable, sourceTable *parser.Table, rules map[string]any) {
 	// If the rules indicate complete replacement (true), replace everything
 	for key, ruleValue := range rules {
 		if ruleBool, ok := ruleValue.(bool); ok && ruleBool {
+			if strategy.addMissing != "" {
+				addMissing(baseTable, sourceTable, all, strategy.addMissing)
+			}
 			// Complete replacement of all entries
 			for sourceEntry := range sourceTable.Range() {
-				baseTable.AddOrReplace(sourceEntry.Name, sourceEntry.Value)
+				baseTable.AddOrReplaceEntry(sourceEntry)
 			}
 			return
 		}
@@ -62,7 +128,7 @@ func mergeInternal(baseTable, sourceTable *parser.Table, rules map[string]any) {
 		// If it's a map of rules, apply recursively to each entry
 		if nestedRules, ok := ruleValue.(map[string]any); ok {
 			for baseEntry := range baseTable.Range() {
-				sourceEntry, sourceExists := sourceTable.Get(baseEntry.Name)
+				sourceEntry, sourceExists := sourceTable.Get(baseEntry.Key)
 				if !sourceExists {
 					continue
 				}
@@ -71,19 +137,53 @@ func mergeInternal(baseTable, sourceTable *parser.Table, rules map[string]any) {
 				sourceSubTable, sourceIsTable := sourceEntry.Table()
 
 				if baseIsTable == nil && sourceIsTable == nil {
-					applyRules(baseSubTable, sourceSubTable, nestedRules)
+					applyRules(baseSubTable, sourceSubTable, nestedRules, append(path[:len(path):len(path)], baseEntry.Key), options)
 				}
 			}
 		}
 
 		_ = key
 	}
+
+	if strategy.addMissing != "" {
+		addMissing(baseTable, sourceTable, all, strategy.addMissing)
+	}
+}
+
+// findTable resolves the table at path, applying the duplicates policy when
+// the file defines it more than once. The last definition is the one Lua
+// would see, so it is the one that gets merged.
+func findTable(file *parser.File, path parser.Path, options Options) (*parser.Table, error) {
+	definitions, err := file.FindDefinitions(path)
+	if err != nil {
+		return nil, err
+	}
+
+	table := definitions[len(definitions)-1]
+	for _, skipped := range table.Skipped() {
+		options.warnf("%s (entry skipped)", skipped)
+	}
+	if len(definitions) == 1 || options.Duplicates == DuplicatesIgnore {
+		return table, nil
+	}
+
+	locations := make([]string, len(definitions))
+	for i, definition := range definitions {
+		locations[i] = definition.Pos().String()
+	}
+
+	if options.Duplicates == DuplicatesError {
+		return nil, fmt.Errorf("table '%s' is defined %d times (%s)", path, len(definitions), strings.Join(locations, ", "))
+	}
+
+	options.warnf("table '%s' is defined %d times (%s); using the last definition", path, len(definitions), strings.Join(locations, ", "))
+	return table, nil
 }
 
 // MergeTables merges multiple tables from two Lua files.
-// Receives the file paths and a table configuration map.
+// Receives the file paths, a table configuration map and the read options.
 // Returns a slice of Result containing the merged tables.
-func MergeTables(basePath, sourcePath string, tablesConfig map[string]map[string]any) ([]Result, error) {
+func MergeTables(basePath, sourcePath string, tablesConfig map[string]map[string]any, options Options) ([]Result, error) {
 	// Input validations
 	if basePath == "" {
 		return nil, fmt.Errorf("base file path cannot be empty")
@@ -103,17 +203,18 @@ func MergeTables(basePath, sourcePath string, tablesConfig map[string]map[string
 		return nil, fmt.Errorf("source file not found: %s", sourcePath)
 	}
 
-	baseF, err := os.Open(basePath)
+	// Each file is parsed once; every table is then extracted from the same tree
+	baseFile, err := options.LoadBase(basePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open base file '%s': %w", basePath, err)
+		return nil, fmt.Errorf("failed to read base file '%s': %w", basePath, err)
 	}
-	defer baseF.Close()
 
-	sourceF, err := os.Open(sourcePath)
+	// The source is brought into the encoding of the base file, so merged
+	// values can be copied into the output byte-for-byte
+	sourceFile, err := options.LoadSource(sourcePath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open source file '%s': %w", sourcePath, err)
+		return nil, fmt.Errorf("failed to read source file '%s': %w", sourcePath, err)
 	}
-	defer sourceF.Close()
 
 	var results []Result
 
@@ -122,23 +223,29 @@ func MergeTables(basePath, sourcePath string, tablesConfig map[string]map[string
 			return nil, fmt.Errorf("empty table name found in configuration")
 		}
 
-		baseTable, err := parser.Parse(baseF, basePath, tableName)
+		path, err := parser.ParsePath(tableName, options.LuaVersion)
+		if err != nil {
+			return nil, err
+		}
+
+		baseTable, err := findTable(baseFile, path, options)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse table '%s' in base file: %w", tableName, err)
 		}
-		baseF.Seek(0, 0)
 
-		sourceTable, err := parser.Parse(sourceF, sourcePath, tableName)
+		sourceTable, err := findTable(sourceFile, path, options)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse table '%s' in source file: %w", tableName, err)
 		}
-		sourceF.Seek(0, 0)
 
-		mergeInternal(baseTable, sourceTable, fieldsToReplace)
+		mergeInternal(baseTable, sourceTable, fieldsToReplace, path, options)
 
 		results = append(results, Result{
 			TableName: tableName,
+			Path:      path,
 			Table:     baseTable,
+			Local:     baseTable.Local(),
+			Return:    tableName == parser.ReturnTable,
 		})
 	}
 
@@ -0,0 +1,191 @@
+package merger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"luamerge/internal/parser"
+)
+
+func TestLookup(t *testing.T) {
+	const source = `T = {
+	name = "a",
+	[12] = "b",
+	["my key"] = "c",
+	[SKID.SM_BASH] = "d",
+	"e",
+}
+`
+	tests := []struct {
+		rule string
+		key  parser.Key
+		want string
+	}{
+		{"name", parser.StringKey("name"), `"a"`},
+		{"[12]", parser.IntKey(12), `"b"`},
+		{"12", parser.IntKey(12), `"b"`},
+		{"1", parser.IntKey(1), `"e"`},
+		{`["my key"]`, parser.StringKey("my key"), `"c"`},
+		{"[SKID.SM_BASH]", parser.ExprKey("SKID.SM_BASH"), `"d"`},
+		{"[ SKID.SM_BASH ]", parser.ExprKey("SKID.SM_BASH"), `"d"`},
+	}
+
+	file, err := parser.ParseFile("test.lua", source, parser.Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := file.FindTable(parser.Path{parser.StringKey("T")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		key, value, ok := lookup(table, tt.rule, parser.Lua51)
+		if !ok {
+			t.Errorf("rule '%s' matches no entry", tt.rule)
+			continue
+		}
+		if key != tt.key || value.Raw() != tt.want {
+			t.Errorf("rule '%s' matches %s = %s, want %s = %s", tt.rule, key, value.Raw(), tt.key, tt.want)
+		}
+	}
+
+	for _, rule := range []string{"missing", "[13]", `["name "]`, "[SKID.SM_FOO]"} {
+		if key, _, ok := lookup(table, rule, parser.Lua51); ok {
+			t.Errorf("rule '%s' matches %s", rule, key)
+		}
+	}
+}
+
+func TestMergeExpressionKeyRule(t *testing.T) {
+	base, err := parser.ParseFile("base.lua", "T = { x = { [SKID.SM_BASH] = 1 } }", parser.Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, err := parser.ParseFile("source.lua", "T = { x = { [SKID.SM_BASH] = 2 } }", parser.Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := parser.Path{parser.StringKey("T")}
+	baseTable, _ := base.FindTable(path)
+	sourceTable, _ := source.FindTable(path)
+
+	mergeInternal(baseTable, sourceTable, map[string]any{"*": map[string]any{"[SKID.SM_BASH]": true}}, path, Options{})
+
+	x, _ := baseTable.Get(parser.StringKey("x"))
+	table, _ := x.Table()
+	if value, _ := table.Get(parser.ExprKey("SKID.SM_BASH")); value.Raw() != "2" {
+		t.Errorf("[SKID.SM_BASH] = %s, want 2", value.Raw())
+	}
+}
+
+func TestLookupConstant(t *testing.T) {
+	constants, err := parser.ParseFile("skillid.lua", "SKID = { SM_BASH = 5 }", parser.Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := parser.ParseFile("test.lua", `T = { [SKID.SM_BASH] = "a", [OTHER.X] = "b" }`, parser.Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.UseConstants([]*parser.File{constants})
+	table, err := file.FindTable(parser.Path{parser.StringKey("T")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rule string
+		key  parser.Key
+	}{
+		{"[SKID.SM_BASH]", parser.IntKey(5)},
+		{"[5]", parser.IntKey(5)},
+		{"[OTHER.X]", parser.ExprKey("OTHER.X")},
+	}
+	for _, tt := range tests {
+		if key, _, ok := lookup(table, tt.rule, parser.Lua51); !ok || key != tt.key {
+			t.Errorf("rule '%s' matches %s (found %v), want %s", tt.rule, key, ok, tt.key)
+		}
+	}
+}
+
+func TestFindTableDuplicates(t *testing.T) {
+	const source = "T = { a = 1 }\nX = 1\nT = { a = 2 }\nA, T = {}, { a = 3 }\n"
+
+	tests := []struct {
+		policy   string
+		want     string // the value of T.a, or the error
+		warnings []string
+	}{
+		{DuplicatesIgnore, "3", nil},
+		{"", "3", []string{"table 'T' is defined 3 times (test.lua:1:5, test.lua:3:5, test.lua:4:12); using the last definition"}},
+		{DuplicatesWarn, "3", []string{"table 'T' is defined 3 times (test.lua:1:5, test.lua:3:5, test.lua:4:12); using the last definition"}},
+		{DuplicatesError, "table 'T' is defined 3 times (test.lua:1:5, test.lua:3:5, test.lua:4:12)", nil},
+	}
+
+	file, err := parser.ParseFile("test.lua", source, parser.Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		var warnings []string
+		options := Options{Duplicates: tt.policy, Warn: func(message string) { warnings = append(warnings, message) }}
+
+		table, err := findTable(file, parser.Path{parser.StringKey("T")}, options)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else if value, ok := table.Get(parser.StringKey("a")); ok {
+			got = value.Raw()
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.policy, got, tt.want)
+		}
+		if strings.Join(warnings, "\n") != strings.Join(tt.warnings, "\n") {
+			t.Errorf("%q: got warnings %q, want %q", tt.policy, warnings, tt.warnings)
+		}
+	}
+
+	// A table defined once, in a multiple assignment, is found silently
+	var warnings []string
+	options := Options{Warn: func(message string) { warnings = append(warnings, message) }}
+	table, err := findTable(file, parser.Path{parser.StringKey("A")}, options)
+	if err != nil || table.Pos().String() != "test.lua:4:8" || len(warnings) > 0 {
+		t.Errorf("got table A at %v (%v, warnings %q), want it at test.lua:4:8", table.Pos(), err, warnings)
+	}
+}
+
+// writeFile writes a Lua file in a temporary directory and returns its path
+func writeFile(t *testing.T, name, source string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMergeErrorPositions(t *testing.T) {
+	basePath := writeFile(t, "base.lua", "AddItem{ id = 1 }\n  AddItem{ name = \"x\" }\nT = { a = { x = 1 } }\n")
+	sourcePath := writeFile(t, "source.lua", "AddItem{ id = 1 }\nT = {\n\ta = { x = { 2 } },\n}\n")
+
+	_, err := MergeCalls(basePath, sourcePath, map[string]CallTarget{"AddItem": {KeyField: "id"}}, Options{})
+	want := "failed to parse calls to 'AddItem' in base file: " + basePath + ":2:3: table argument has no field 'id'"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+
+	var warnings []string
+	options := Options{Warn: func(message string) { warnings = append(warnings, message) }}
+	rules := map[string]map[string]any{"T": {"*": map[string]any{"x": map[string]any{"1": true}}}}
+	if _, err := MergeTables(basePath, sourcePath, rules, options); err != nil {
+		t.Fatal(err)
+	}
+	if want := basePath + ":3:17: rule 'x' expects a table, found number"; len(warnings) != 1 || warnings[0] != want {
+		t.Errorf("got warnings %q, want %q", warnings, want)
+	}
+}
@@ -0,0 +1,141 @@
+package merger
+
+import (
+	"fmt"
+	"luamerge/internal/parser"
+)
+
+// Policies for tables that are defined more than once in an input file
+const (
+	DuplicatesWarn   = "warn"   // use the last definition and report the others
+	DuplicatesError  = "error"  // refuse to merge the table
+	DuplicatesIgnore = "ignore" // use the last definition silently
+)
+
+// Parse modes for the input files
+const (
+	ParseStrict  = "strict"  // a syntax error fails the merge
+	ParseRecover = "recover" // broken statements are skipped and reported
+	ParseEval    = "eval"    // the files are run and their globals merged
+)
+
+// Options configures how the input files of a merge are read.
+type Options struct {
+	// InputEncoding is the encoding of the source file and OutputEncoding the
+	// encoding of the base file. The source is converted to the encoding of
+	// the base when both are set and differ.
+	InputEncoding  string
+	OutputEncoding string
+
+	// Files caches the parsed input files across merges.
+	// When nil, every merge reads and parses its files again.
+	Files *FileCache
+
+	// Duplicates is the policy for tables defined more than once.
+	// The last definition wins, as in Lua; an empty policy warns.
+	Duplicates string
+
+	// ParseMode is how syntax errors in the input files are handled.
+	// An empty mode is strict.
+	ParseMode string
+
+	// LuaVersion is the grammar the input files are parsed with.
+	// The zero value is Lua 5.1.
+	LuaVersion parser.Version
+
+	// EvalLimits bounds the run of each input file in eval mode.
+	EvalLimits parser.EvalLimits
+
+	// IncludeRoot is the directory the dofile and require includes of the
+	// input files are resolved in. When empty, includes are not followed.
+	IncludeRoot string
+
+	// Constants are the paths of Lua files that define constants, such as
+	// the enums the game loads before the input files. They resolve the
+	// symbolic keys of the input files ([SKID.NV_BASIC]), which are then
+	// matched by value.
+	Constants []string
+
+	// Warn receives the warnings of the merge. When nil, they are discarded.
+	Warn func(message string)
+
+	// Removed receives the entries deleted from the base by the
+	// removeMissing strategy: their path (QuestInfoList[1004].Title, or
+	// AddItem[501].name for the call with key 501) and where the base set
+	// them. When nil, they are not reported.
+	Removed func(path parser.Path, pos parser.Position)
+}
+
+// warnf reports a warning through the Warn callback
+func (o Options) warnf(format string, args ...any) {
+	if o.Warn != nil {
+		o.Warn(fmt.Sprintf(format, args...))
+	}
+}
+
+// removed reports a deleted entry through the Removed callback
+func (o Options) removed(path parser.Path, pos parser.Position) {
+	if o.Removed != nil {
+		o.Removed(path, pos)
+	}
+}
+
+// LoadBase loads the base file of a merge (see FileCache.Load)
+func (o Options) LoadBase(path string) (*parser.File, error) {
+	return o.load(path, "", "")
+}
+
+// LoadSource loads the source file of a merge, converted to the encoding
+// of the base file
+func (o Options) LoadSource(path string) (*parser.File, error) {
+	return o.load(path, o.InputEncoding, o.OutputEncoding)
+}
+
+// load loads a file in the parse mode of the options, with its includes
+// when they are followed and its constant files. The syntax errors
+// recovered in the file are reported as warnings the first time it is used.
+func (o Options) load(path, fromEncoding, toEncoding string) (*parser.File, error) {
+	file, err := o.loadIncluded(path, fromEncoding, toEncoding, make(map[string]bool))
+	if err != nil || len(o.Constants) == 0 {
+		return file, err
+	}
+
+	// Constant files are read like the file, but do not get constants
+	constants := o
+	constants.Constants = nil
+
+	files := make([]*parser.File, len(o.Constants))
+	for i, constantsPath := range o.Constants {
+		if files[i], err = constants.load(constantsPath, fromEncoding, toEncoding); err != nil {
+			return nil, fmt.Errorf("failed to read constants file '%s': %w", constantsPath, err)
+		}
+	}
+	file.UseConstants(files)
+	return file, nil
+}
+
+// loadIncluded implements load. active holds the paths of the files whose
+// includes are being resolved, to stop include cycles.
+func (o Options) loadIncluded(path, fromEncoding, toEncoding string, active map[string]bool) (*parser.File, error) {
+	file, err := o.Files.Load(path, fromEncoding, toEncoding, Syntax{
+		Version:     o.LuaVersion,
+		Mode:        o.ParseMode,
+		Limits:      o.EvalLimits,
+		IncludeRoot: o.IncludeRoot,
+		Constants:   o.Constants,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(file.Errors) > 0 && o.Files.report(file) {
+		for _, err := range file.Errors {
+			o.warnf("%s (statement skipped)", err)
+		}
+	}
+
+	if o.IncludeRoot != "" && !file.IncludesResolved() {
+		o.resolveIncludes(file, path, fromEncoding, toEncoding, active)
+	}
+	return file, nil
+}
@@ -4,7 +4,16 @@ import "luamerge/internal/parser"
 
 // Result represents the result of a merge operation.
 // Contains the table name and the table data after merging.
+// Path is the table name parsed as a path (see parser.ParsePath).
+// Local is set when the base file declares the table as local, and
+// Return when the table is the value returned by a module-style file.
+// Results of call statements (see MergeCalls) hold the base calls in Calls
+// instead of a Table, and TableName is the name of the function.
 type Result struct {
 	TableName string
+	Path      parser.Path
 	Table     *parser.Table
+	Local     bool
+	Return    bool
+	Calls     []*parser.Call
 }
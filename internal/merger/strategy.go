@@ -0,0 +1,155 @@
+package merger
+
+import (
+	"fmt"
+	"luamerge/internal/parser"
+	"strings"
+)
+
+// Strategies are set in a rules map with keys that start with '$', next to
+// the rules they apply to. Such keys are never taken as rule keys.
+const (
+	// StrategyAddMissing inserts the source entries selected by the rules
+	// that the base lacks. Its value is true or the position of the new
+	// entries.
+	StrategyAddMissing = "$addMissing"
+
+	// StrategyRemoveMissing deletes the base entries selected by the rules
+	// that the source lacks. Its value is a boolean.
+	StrategyRemoveMissing = "$removeMissing"
+)
+
+// Positions of the entries inserted by the addMissing strategy
+const (
+	PositionSource = "source" // after the entry that precedes them in the source
+	PositionStart  = "start"  // before the first entry, in source order
+	PositionEnd    = "end"    // after the last entry, in source order
+)
+
+// strategies are the strategies set in a rules map
+type strategies struct {
+	addMissing    string // position of the inserted entries, empty when off
+	removeMissing bool
+}
+
+// splitStrategies separates the strategies of a rules map from its rules.
+// The rules map is returned as is when it sets no strategy.
+func splitStrategies(rules map[string]any) (strategies, map[string]any) {
+	var s strategies
+	var plain map[string]any
+
+	for key, value := range rules {
+		if !strings.HasPrefix(key, "$") {
+			continue
+		}
+		if plain == nil {
+			plain = make(map[string]any, len(rules))
+			for k, v := range rules {
+				if !strings.HasPrefix(k, "$") {
+					plain[k] = v
+				}
+			}
+		}
+
+		switch key {
+		case StrategyAddMissing:
+			s.addMissing, _ = addPosition(value)
+		case StrategyRemoveMissing:
+			s.removeMissing, _ = value.(bool)
+		}
+	}
+
+	if plain == nil {
+		return s, rules
+	}
+	return s, plain
+}
+
+// addPosition returns the position set by an addMissing value: true is the
+// source position and false turns the strategy off
+func addPosition(value any) (string, error) {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return PositionSource, nil
+		}
+		return "", nil
+	case string:
+		switch v {
+		case PositionSource, PositionStart, PositionEnd:
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("invalid '%s' %v (expected true, false, '%s', '%s' or '%s')", StrategyAddMissing, value, PositionSource, PositionStart, PositionEnd)
+}
+
+// CheckRules reports the first strategy of a rules map, or of its nested
+// rules, that is unknown or has an invalid value
+func CheckRules(rules map[string]any) error {
+	for key, value := range rules {
+		switch {
+		case key == StrategyAddMissing:
+			if _, err := addPosition(value); err != nil {
+				return err
+			}
+		case key == StrategyRemoveMissing:
+			if _, ok := value.(bool); !ok {
+				return fmt.Errorf("invalid '%s' %v (expected true or false)", StrategyRemoveMissing, value)
+			}
+		case strings.HasPrefix(key, "$"):
+			return fmt.Errorf("unknown strategy '%s'", key)
+		default:
+			if nested, ok := value.(map[string]any); ok {
+				if err := CheckRules(nested); err != nil {
+					return fmt.Errorf("rule '%s': %w", key, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addMissing inserts the source entries accepted by selected that the base
+// lacks, at the given position. Entries inserted together keep their
+// source order.
+func addMissing(base, source *parser.Table, selected func(parser.Key) bool, position string) {
+	start, next := 0, 0
+	for entry := range source.Range() {
+		if index, ok := base.IndexOf(entry.Key); ok {
+			// In the source position, new entries follow this one
+			next = index + 1
+			continue
+		}
+		if !selected(entry.Key) {
+			continue
+		}
+
+		switch position {
+		case PositionStart:
+			base.InsertEntry(start, entry)
+			start++
+		case PositionEnd:
+			base.AddOrReplaceEntry(entry)
+		default:
+			base.InsertEntry(next, entry)
+			next++
+		}
+	}
+}
+
+// removeMissing deletes the base entries accepted by selected that the
+// source lacks, and reports them under path
+func removeMissing(base, source *parser.Table, selected func(parser.Key) bool, path parser.Path, options Options) {
+	var stale []parser.Key
+	for entry := range base.Range() {
+		if _, ok := source.Get(entry.Key); !ok && selected(entry.Key) {
+			stale = append(stale, entry.Key)
+		}
+	}
+
+	for _, key := range stale {
+		if entry, ok := base.Delete(key); ok {
+			options.removed(append(path[:len(path):len(path)], key), entry.Pos())
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package merger
+
+import (
+	"testing"
+
+	"luamerge/internal/parser"
+)
+
+// mergeText merges table T of source into base with the given rules, and
+// returns the base text with the edits of the merge applied
+func mergeText(t *testing.T, base, source string, rules map[string]any, options Options) string {
+	t.Helper()
+
+	path := parser.Path{parser.StringKey("T")}
+	tables := make([]*parser.Table, 2)
+	files := make([]*parser.File, 2)
+	for i, src := range []string{base, source} {
+		file, err := parser.ParseFile("test.lua", src, parser.Lua51)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tables[i], err = file.FindTable(path); err != nil {
+			t.Fatal(err)
+		}
+		files[i] = file
+	}
+
+	mergeInternal(tables[0], tables[1], rules, path, options)
+
+	edits, err := tables[0].Edits(func(*parser.Value) (string, error) { return "?", nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := parser.ApplyEdits(files[0].Source, edits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return text
+}
+
+func TestAddMissing(t *testing.T) {
+	const base = "T = {\n\tb = 2,\n\td = 4,\n}\n"
+	const source = "T = { a = 1, b = 2, c = 3, d = 4, e = 5 }"
+
+	tests := []struct {
+		position any
+		want     string
+	}{
+		{true, "T = {\n\ta = 1,\n\tb = 2,\n\tc = 3,\n\td = 4,\n\te = 5,\n}\n"},
+		{PositionSource, "T = {\n\ta = 1,\n\tb = 2,\n\tc = 3,\n\td = 4,\n\te = 5,\n}\n"},
+		{PositionStart, "T = {\n\ta = 1,\n\tc = 3,\n\te = 5,\n\tb = 2,\n\td = 4,\n}\n"},
+		{PositionEnd, "T = {\n\tb = 2,\n\td = 4,\n\ta = 1,\n\tc = 3,\n\te = 5,\n}\n"},
+		{false, base},
+	}
+
+	for _, tt := range tests {
+		rules := map[string]any{StrategyAddMissing: tt.position, "*": map[string]any{}}
+		if got := mergeText(t, base, source, rules, Options{}); got != tt.want {
+			t.Errorf("%v: got\n%q\nwant\n%q", tt.position, got, tt.want)
+		}
+	}
+}
+
+func TestAddMissingRepeatedKey(t *testing.T) {
+	const base = "T = { a = 1, b = 2, a = 3 }"
+	const source = "T = { a = 1, x = 9, b = 2 }"
+
+	rules := map[string]any{StrategyAddMissing: true, "*": map[string]any{}}
+	want := "T = { a = 1, b = 2, a = 3, x = 9, }"
+	if got := mergeText(t, base, source, rules, Options{}); got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestAddMissingStatements(t *testing.T) {
+	const base = "T = {}\nT[1] = { name = \"a\" }\nT[3] = { name = \"c\" }\n"
+	const source = "T = { [1] = { name = \"a\" }, [2] = { name = \"b\" }, [3] = { name = \"c\" } }"
+
+	rules := map[string]any{StrategyAddMissing: PositionStart, "*": map[string]any{}}
+	want := base + "T[2] = { name = \"b\" }\n"
+	if got := mergeText(t, base, source, rules, Options{}); got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestRemoveMissing(t *testing.T) {
+	const base = "T = {\n\ta = 1,\n\tb = 2, -- stale\n\tc = 3,\n}\nT.d = 4\n"
+	const source = "T = { a = 1, c = 3 }"
+
+	var removed []string
+	options := Options{Removed: func(path parser.Path, pos parser.Position) {
+		removed = append(removed, path.String()+" "+pos.String())
+	}}
+
+	rules := map[string]any{StrategyRemoveMissing: true, "*": map[string]any{}}
+	want := "T = {\n\ta = 1,\n\tc = 3,\n}\n"
+	if got := mergeText(t, base, source, rules, options); got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+	if len(removed) != 2 || removed[0] != "T.b test.lua:3:2" || removed[1] != "T.d test.lua:6:1" {
+		t.Errorf("removed %q", removed)
+	}
+}
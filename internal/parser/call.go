@@ -0,0 +1,77 @@
+package parser
+
+import "fmt"
+
+// Call is a function call statement that passes a table constructor, as in
+// data files written as a sequence of calls: AddItem{ id = 501, ... } or
+// Register("name", { ... }). Table is the first constructor argument; it
+// keeps references to the syntax tree like any other parsed table.
+type Call struct {
+	Args  []*Value
+	Table *Table
+	file  *File
+	stmt  *CallStmt
+}
+
+// FindCalls returns the call statements of the main chunk that call the
+// function at the given path with a table constructor, in file order.
+// Method calls (obj:fn{ ... }) are not matched.
+func (f *File) FindCalls(name Path) ([]*Call, error) {
+	var calls []*Call
+	f.scope = f
+
+	for _, stmt := range f.Chunk {
+		callStmt, ok := stmt.(*CallStmt)
+		if !ok || callStmt.Call.Method != "" {
+			continue
+		}
+
+		function, ok := f.exprPath(callStmt.Call.Func)
+		if !ok || !function.HasPrefix(name) || len(function) != len(name) {
+			continue
+		}
+
+		call := &Call{file: f, stmt: callStmt}
+		for _, arg := range callStmt.Call.Args {
+			value, err := parseValue(f, arg)
+			if err != nil {
+				return nil, err
+			}
+			call.Args = append(call.Args, value)
+
+			if table, err := value.Table(); err == nil && call.Table == nil {
+				call.Table = table
+			}
+		}
+
+		if call.Table != nil {
+			calls = append(calls, call)
+		}
+	}
+
+	if len(calls) == 0 {
+		return nil, fmt.Errorf("parser.FindCalls: no calls to '%s' with a table argument were found in %s", name, f.Name)
+	}
+	return calls, nil
+}
+
+// Pos returns the position of the call statement
+func (c *Call) Pos() Position {
+	return c.file.Pos(c.stmt)
+}
+
+// Text returns the source text of the call statement with the edits of its
+// table applied
+func (c *Call) Text(render Renderer) (string, error) {
+	text, err := c.Table.Text(render)
+	if err != nil {
+		return "", err
+	}
+
+	node := c.Table.node
+	return ApplyEdits(c.file.Text(c.stmt), []Edit{{
+		Start: node.Start() - c.stmt.Start(),
+		End:   node.End() - c.stmt.Start(),
+		Text:  text,
+	}})
+}
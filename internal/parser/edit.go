@@ -0,0 +1,574 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Edit replaces the bytes [Start, End) of a source file with Text.
+// Start == End describes an insertion.
+type Edit struct {
+	Start int
+	End   int
+	Text  string
+}
+
+// Renderer produces Lua source for a value that was not parsed from a file
+type Renderer func(*Value) (string, error)
+
+// Edits returns the edits that bring the table's source text in line with
+// its current entries. Only replaced or added entries produce edits;
+// everything else in the constructor (comments, blank lines, formatting,
+// untouched fields) is left byte-for-byte identical. Entries assigned by
+// statements after the constructor are rewritten in their statement, and
+// new entries follow the last such statement in the same style. New entries
+// placed before existing ones (see InsertEntry) are inserted in front of
+// them in the constructor.
+func (t *Table) Edits(render Renderer) ([]Edit, error) {
+	return t.edits(render, false)
+}
+
+// edits implements Edits. With inline set, entries assigned by statements
+// are written into the constructor instead, so that the constructor alone
+// holds the whole table (see Text).
+func (t *Table) edits(render Renderer, inline bool) ([]Edit, error) {
+	if t.node == nil {
+		return nil, errors.New("table was not parsed from a file")
+	}
+
+	var edits []Edit
+	var added []*NamedValue
+	var dropped []Stmt
+
+	// New entries go in front of the constructor field that follows them,
+	// unless the table is extended by statements: they follow the last one
+	placed := t.tail == nil || inline
+	var previous *Field
+
+	for _, entry := range t.values {
+		// Entries are rewritten where their current value was assigned,
+		// or in the constructor when the whole table goes into it
+		field := entry.field
+		if entry.assigned != nil && !inline {
+			field = entry.assigned
+		}
+
+		if placed && field != nil {
+			if len(added) > 0 {
+				insertions, err := t.insertionsBefore(field, previous, added, render)
+				if err != nil {
+					return nil, err
+				}
+				edits = append(edits, insertions...)
+				added = nil
+			}
+			previous = field
+		}
+
+		switch {
+		case field == nil:
+			added = append(added, entry)
+
+		case entry.replaced || field != entry.assigned && entry.assigned != nil:
+			text, err := valueText(entry.Value, render)
+			if err != nil {
+				return nil, entryError(entry, err)
+			}
+			value := field.Value
+			edits = append(edits, Edit{Start: value.Start(), End: value.End(), Text: text})
+			dropped = append(dropped, entry.dropped...)
+
+		default:
+			// Untouched entries may still contain changes in nested tables
+			sub, err := entry.Value.Table()
+			if err != nil || sub.file != t.file || sub.node == nil {
+				continue
+			}
+			subEdits, err := sub.edits(render, inline)
+			if err != nil {
+				return nil, fmt.Errorf("entry '%s': %w", entry.Key, err)
+			}
+			edits = append(edits, subEdits...)
+		}
+	}
+
+	// Removed entries take their field and the statements that set them
+	// along. Removals go last, after any insertion at the same offset.
+	removed := make(map[*Field]bool)
+	for _, entry := range t.removed {
+		if entry.field != nil {
+			removed[entry.field] = true
+		}
+		if entry.stmt != nil {
+			dropped = append(dropped, entry.stmt)
+		}
+		dropped = append(dropped, entry.dropped...)
+		if sub, err := entry.Value.Table(); err == nil && sub.file == t.file {
+			dropped = append(dropped, sub.statements()...)
+		}
+	}
+
+	if len(added) > 0 {
+		var insertions []Edit
+		var err error
+		if t.tail != nil && !inline {
+			insertions, err = t.assignments(added, render)
+		} else {
+			insertions, err = t.insertions(added, removed, render)
+		}
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, insertions...)
+	}
+
+	appended := len(added) > 0 && (t.tail == nil || inline)
+	edits = append(edits, t.removals(removed, appended)...)
+	if !inline {
+		deletions, err := t.deletions(dropped)
+		if err != nil {
+			return nil, err
+		}
+		edits = append(edits, deletions...)
+	}
+
+	return edits, nil
+}
+
+// Text returns the source text of the table constructor with its edits
+// applied. Entries assigned by statements after the constructor are
+// written into it.
+func (t *Table) Text(render Renderer) (string, error) {
+	edits, err := t.edits(render, true)
+	if err != nil {
+		return "", err
+	}
+
+	start := t.node.Start()
+	for i := range edits {
+		edits[i].Start -= start
+		edits[i].End -= start
+	}
+
+	return ApplyEdits(t.file.Text(t.node), edits)
+}
+
+// HasSource reports whether the table was parsed from a file
+func (t *Table) HasSource() bool {
+	return t.node != nil
+}
+
+// insertions builds the edits that append new entries to the constructor,
+// following the layout of the existing fields (inline or one per line).
+// The fields in removed do not count.
+func (t *Table) insertions(added []*NamedValue, removed map[*Field]bool, render Renderer) ([]Edit, error) {
+	src := t.file.Source
+	br := lineBreak(src)
+	node := t.node
+
+	// Entries that continue the array part are written as positional items,
+	// unless their key is written with a constant. The array part ends with
+	// the last positional item that is not removed.
+	var fields []*Field
+	count, length := 0, 0
+	for _, field := range node.Fields {
+		if field.Key == nil {
+			count++
+		}
+		if removed[field] {
+			continue
+		}
+		fields = append(fields, field)
+		if field.Key == nil {
+			length = count
+		}
+	}
+	next := IntKey(int64(length + 1))
+
+	entries := make([]string, len(added))
+	for i, entry := range added {
+		text, err := valueText(entry.Value, render)
+		if err != nil {
+			return nil, entryError(entry, err)
+		}
+
+		if entry.Key == next && entry.spelling == "" {
+			entries[i] = text
+			next = IntKey(next.Int() + 1)
+			continue
+		}
+		entries[i] = fmt.Sprintf("%s = %s", entry.Name(), text)
+	}
+
+	// Empty constructor: {} or a multi-line { }
+	if len(fields) == 0 {
+		inner := src[node.Open.End:node.Close.Start]
+		if !strings.Contains(inner, "\n") {
+			if len(node.Fields) > 0 {
+				// Every field is removed along with the blanks that follow
+				// it, so the new ones take the place of the first field
+				at := node.Fields[0].Start()
+				text := strings.Join(entries, ", ") + src[node.Open.End:at]
+				return []Edit{{Start: at, End: at, Text: text}}, nil
+			}
+			text := " " + strings.Join(entries, ", ") + " "
+			return []Edit{{Start: node.Open.End, End: node.Open.End, Text: text}}, nil
+		}
+
+		indent := lineIndent(src, node.Open.Start) + "\t"
+		var sb strings.Builder
+		for _, entry := range entries {
+			sb.WriteString(br + indent + entry + ",")
+		}
+		return []Edit{{Start: node.Open.End, End: node.Open.End, Text: sb.String()}}, nil
+	}
+
+	last := fields[len(fields)-1]
+	at := last.End()
+	sep := ","
+	if last.Sep != nil {
+		at = last.Sep.End
+		sep = last.Sep.Text
+	}
+
+	var edits []Edit
+	var sb strings.Builder
+	trailing := src[at:node.Close.Start]
+
+	if !strings.Contains(trailing, "\n") {
+		// Inline constructor: { a = 1, b = 2 }
+		for _, entry := range entries {
+			if last.Sep != nil {
+				sb.WriteString(" " + entry + sep)
+			} else {
+				sb.WriteString(sep + " " + entry)
+			}
+		}
+		return append(edits, Edit{Start: at, End: at, Text: sb.String()}), nil
+	}
+
+	// One entry per line: insert before the line break that follows the last
+	// field, so trailing comments on that line stay where they are
+	if last.Sep == nil {
+		edits = append(edits, Edit{Start: at, End: at, Text: sep})
+	}
+	indent := lineIndent(src, last.Start())
+	for i, entry := range entries {
+		if last.Sep == nil && i > 0 {
+			sb.WriteString(sep)
+		}
+		sb.WriteString(br + indent + entry)
+		if last.Sep != nil {
+			sb.WriteString(sep)
+		}
+	}
+	lineEnd := at + strings.Index(trailing, "\n")
+	if lineEnd > at && src[lineEnd-1] == '\r' {
+		lineEnd--
+	}
+	return append(edits, Edit{Start: lineEnd, End: lineEnd, Text: sb.String()}), nil
+}
+
+// insertionsBefore builds the edit that inserts new entries in front of a
+// constructor field, after the field that precedes it (nil for the first
+// field), following the layout of the constructor. The entries are always
+// written with their key, so the positional items keep their index.
+func (t *Table) insertionsBefore(next, previous *Field, added []*NamedValue, render Renderer) ([]Edit, error) {
+	src := t.file.Source
+	br := lineBreak(src)
+
+	entries := make([]string, len(added))
+	for i, entry := range added {
+		text, err := valueText(entry.Value, render)
+		if err != nil {
+			return nil, entryError(entry, err)
+		}
+		entries[i] = fmt.Sprintf("%s = %s", entry.Name(), text)
+	}
+
+	sep := ","
+	if next.Sep != nil {
+		sep = next.Sep.Text
+	}
+	var edits []Edit
+	start := t.node.Open.End
+	switch {
+	case previous == nil:
+	case previous.Sep != nil:
+		sep = previous.Sep.Text
+		start = previous.Sep.End
+	default:
+		// The previous field ends the constructor, as when its key is
+		// defined again or when it is an item after keyed fields
+		start = previous.End()
+		edits = append(edits, Edit{Start: start, End: start, Text: sep})
+	}
+	// A repeated key can put the previous field after the next one
+	multiline := strings.Contains(src[min(start, next.Start()):max(start, next.Start())], "\n")
+	indent := lineIndent(src, next.Start())
+
+	var sb strings.Builder
+	switch {
+	case previous == nil:
+		// In front of the first field, on its line
+		for _, entry := range entries {
+			sb.WriteString(entry + sep)
+			if multiline {
+				sb.WriteString(br + indent)
+			} else {
+				sb.WriteString(" ")
+			}
+		}
+		return []Edit{{Start: next.Start(), End: next.Start(), Text: sb.String()}}, nil
+
+	case multiline:
+		// After the line of the previous field, so trailing comments on
+		// that line stay where they are
+		for _, entry := range entries {
+			sb.WriteString(br + indent + entry + sep)
+		}
+		at := lineEnd(src, start)
+		return append(edits, Edit{Start: at, End: at, Text: sb.String()}), nil
+
+	default:
+		for _, entry := range entries {
+			sb.WriteString(" " + entry + sep)
+		}
+		return append(edits, Edit{Start: start, End: start, Text: sb.String()}), nil
+	}
+}
+
+// assignments builds the edit that adds new entries as assignment
+// statements after the last statement that extended the table, written
+// the same way (T[502] = ... or T.key = ...)
+func (t *Table) assignments(added []*NamedValue, render Renderer) ([]Edit, error) {
+	src := t.file.Source
+	br := lineBreak(src)
+	object := t.file.Text(t.tail.Object)
+	indent := lineIndent(src, t.tailStmt.Start())
+
+	var sb strings.Builder
+	for _, entry := range added {
+		text, err := valueText(entry.Value, render)
+		if err != nil {
+			return nil, entryError(entry, err)
+		}
+
+		sb.WriteString(br + indent + object + entry.index() + " = " + text)
+	}
+
+	// Insert at the end of the line, after any separator or trailing comment
+	at := lineEnd(src, t.tailStmt.End())
+	return []Edit{{Start: at, End: at, Text: sb.String()}}, nil
+}
+
+// deletions builds the edits that remove statements from the file.
+// A statement alone on its line is removed with the whole line.
+func (t *Table) deletions(stmts []Stmt) ([]Edit, error) {
+	src := t.file.Source
+	seen := make(map[Stmt]bool)
+
+	var edits []Edit
+	for _, stmt := range stmts {
+		if seen[stmt] {
+			continue
+		}
+		seen[stmt] = true
+
+		if s, ok := stmt.(*AssignStmt); ok && len(s.Targets) > 1 {
+			return nil, t.file.errorf(stmt, "cannot remove an assignment with several targets")
+		}
+
+		start, end := stmt.Start(), stmt.End()
+		if end < len(src) && src[end] == ';' {
+			end++
+		}
+		if lineStart, lineEnd, ok := wholeLine(src, start, end); ok {
+			start, end = lineStart, lineEnd
+		}
+		edits = append(edits, Edit{Start: start, End: end})
+	}
+	return edits, nil
+}
+
+// removals builds the edits that remove the given constructor fields with
+// their separator. A field alone on its line is removed with the whole line.
+// A positional field followed by other positional items becomes nil
+// instead, so that they keep their index. Unless entries are appended
+// after them, removing the last fields of an inline constructor takes the
+// separator of the field that is then last ({ a, b, c } loses ", c").
+func (t *Table) removals(removed map[*Field]bool, appended bool) []Edit {
+	src := t.file.Source
+	fields := t.node.Fields
+
+	var edits []Edit
+	previous := 0 // end of the last removal
+	for i, field := range fields {
+		if !removed[field] {
+			continue
+		}
+
+		if field.Key == nil && slices.ContainsFunc(fields[i+1:], func(f *Field) bool { return f.Key == nil && !removed[f] }) {
+			edits = append(edits, Edit{Start: field.Value.Start(), End: field.Value.End(), Text: "nil"})
+			continue
+		}
+
+		start, end := field.Start(), field.End()
+		if field.Sep != nil {
+			end = field.Sep.End
+		}
+
+		if lineStart, lineEnd, ok := wholeLine(src, start, end); ok {
+			start, end = lineStart, lineEnd
+		} else {
+			// The blanks after the field go with it ({ a = 1, b = 2, c = 3 }
+			// loses "b = 2, "), or those before it at the end of a line
+			after := end
+			for after < len(src) && (src[after] == ' ' || src[after] == '\t') {
+				after++
+			}
+			if field.Sep == nil && !appended {
+				for j := i - 1; j >= 0; j-- {
+					if kept := fields[j]; !removed[kept] {
+						if kept.Sep != nil {
+							edits = append(edits, Edit{Start: kept.Sep.Start, End: kept.Sep.End})
+						}
+						break
+					}
+				}
+			}
+			if after < len(src) && src[after] != '\r' && src[after] != '\n' {
+				end = after
+			} else {
+				for start > previous && (src[start-1] == ' ' || src[start-1] == '\t') {
+					start--
+				}
+			}
+		}
+		previous = end
+		edits = append(edits, Edit{Start: start, End: end})
+	}
+	return edits
+}
+
+// wholeLine reports whether the text from start to end is alone on its
+// line, apart from a line comment after it that goes with it, and returns
+// the span that removes the line. The span starts at the line break before
+// the line (it takes the one after the line on the first line, and none on
+// a last line without one), so that text inserted at the end of the
+// previous line stays clear of it.
+func wholeLine(src string, start, end int) (int, int, bool) {
+	lineStart := strings.LastIndexByte(src[:start], '\n') + 1
+	after := lineEnd(src, end)
+	rest := strings.TrimSpace(src[end:after])
+	if strings.TrimSpace(src[lineStart:start]) != "" || (rest != "" && !isLineComment(rest)) {
+		return 0, 0, false
+	}
+
+	if lineStart > 0 && after < len(src) {
+		start = lineStart - 1
+		if start > 0 && src[start-1] == '\r' {
+			start--
+		}
+		return start, after, true
+	}
+
+	end = after
+	if end < len(src) && src[end] == '\r' {
+		end++
+	}
+	if end < len(src) && src[end] == '\n' {
+		end++
+	}
+	return lineStart, end, true
+}
+
+// entryError wraps an error about an entry, with its position when the
+// entry was parsed from a file
+func entryError(entry *NamedValue, err error) error {
+	if pos := entry.Pos(); pos.IsValid() {
+		return fmt.Errorf("%s: entry '%s': %w", pos, entry.Key, err)
+	}
+	return fmt.Errorf("entry '%s': %w", entry.Key, err)
+}
+
+// isLineComment reports whether text is a single comment that ends with its line
+func isLineComment(text string) bool {
+	if !strings.HasPrefix(text, "--") {
+		return false
+	}
+	tokens, err := Tokenize(text)
+	return err == nil && len(tokens) == 1
+}
+
+// valueText returns the source text of a value, rendering it when it
+// was not parsed from a file. Tables parsed from a file are written with
+// their own edits applied and the statements that extended them folded in.
+func valueText(value *Value, render Renderer) (string, error) {
+	if table, err := value.Table(); err == nil && table.node != nil {
+		return table.Text(render)
+	}
+	if raw := value.Raw(); raw != "" {
+		return raw, nil
+	}
+	return render(value)
+}
+
+// lineEnd returns the offset of the line break that ends the line
+// containing offset, before any carriage return
+func lineEnd(src string, offset int) int {
+	end := len(src)
+	if i := strings.IndexByte(src[offset:], '\n'); i >= 0 {
+		end = offset + i
+	}
+	if end > offset && src[end-1] == '\r' {
+		end--
+	}
+	return end
+}
+
+// lineBreak returns the line break of a source file: \r\n when its first
+// line ends with one, otherwise \n
+func lineBreak(src string) string {
+	if i := strings.IndexByte(src, '\n'); i > 0 && src[i-1] == '\r' {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// lineIndent returns the leading whitespace of the line containing offset
+func lineIndent(src string, offset int) string {
+	start := strings.LastIndexByte(src[:offset], '\n') + 1
+	end := start
+	for end < len(src) && (src[end] == ' ' || src[end] == '\t') {
+		end++
+	}
+	return src[start:end]
+}
+
+// ApplyEdits applies non-overlapping edits to src.
+// Insertions at the same offset are applied in the order given.
+func ApplyEdits(src string, edits []Edit) (string, error) {
+	sorted := make([]Edit, len(edits))
+	copy(sorted, edits)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+
+	var sb strings.Builder
+	pos := 0
+	for _, edit := range sorted {
+		if edit.Start < pos || edit.End < edit.Start || edit.End > len(src) {
+			return "", fmt.Errorf("overlapping or invalid edit at offset %d", edit.Start)
+		}
+		sb.WriteString(src[pos:edit.Start])
+		sb.WriteString(edit.Text)
+		pos = edit.End
+	}
+	sb.WriteString(src[pos:])
+
+	return sb.String(), nil
+}
@@ -0,0 +1,305 @@
+package parser
+
+import (
+	"errors"
+	"testing"
+)
+
+// findT parses src and returns the file and its table T
+func findT(t *testing.T, src string) (*File, *Table) {
+	t.Helper()
+
+	file, err := ParseFile("test.lua", src, Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := file.FindTable(Path{StringKey("T")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file, table
+}
+
+// checkIndex reports entries of the table whose index does not match
+// their position
+func checkIndex(t *testing.T, name string, table *Table) {
+	t.Helper()
+
+	if len(table.index) != len(table.values) {
+		t.Errorf("%s: %d keys in the index for %d entries", name, len(table.index), len(table.values))
+	}
+	for i, entry := range table.values {
+		if index, ok := table.IndexOf(entry.Key); !ok || index != i {
+			t.Errorf("%s: entry %s at %d has index %d (%v)", name, entry.Key, i, index, ok)
+		}
+	}
+}
+
+func TestTableEdits(t *testing.T) {
+	type op func(base, source *Table)
+
+	// Operations take their entries from the source table
+	del := func(key Key) op {
+		return func(base, _ *Table) { base.Delete(key) }
+	}
+	add := func(key Key) op {
+		return func(base, source *Table) {
+			entry, _ := source.entry(key)
+			base.AddOrReplaceEntry(entry)
+		}
+	}
+	insert := func(at int, key Key) op {
+		return func(base, source *Table) {
+			entry, _ := source.entry(key)
+			base.InsertEntry(at, entry)
+		}
+	}
+	replace := func(key Key) op {
+		return func(base, source *Table) {
+			value, _ := source.Get(key)
+			base.AddOrReplace(key, value)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		base   string
+		source string
+		ops    []op
+		want   string
+		keys   []Key
+	}{
+		{
+			name: "delete inline",
+			base: "T = { a = 1, b = 2, c = 3 }",
+			ops:  []op{del(StringKey("b"))},
+			want: "T = { a = 1, c = 3 }",
+			keys: []Key{StringKey("a"), StringKey("c")},
+		},
+		{
+			name: "delete line",
+			base: "T = {\n\ta = 1,\n\tb = 2, -- two\n\tc = 3,\n}\n",
+			ops:  []op{del(StringKey("b"))},
+			want: "T = {\n\ta = 1,\n\tc = 3,\n}\n",
+			keys: []Key{StringKey("a"), StringKey("c")},
+		},
+		{
+			name: "delete positional",
+			base: `T = { "x", "y", "z" }`,
+			ops:  []op{del(IntKey(1)), del(IntKey(2))},
+			want: `T = { nil, nil, "z" }`,
+			keys: []Key{IntKey(3)},
+		},
+		{
+			name: "delete last positional",
+			base: `T = { "x", "y", n = 1 }`,
+			ops:  []op{del(IntKey(2))},
+			want: `T = { "x", n = 1 }`,
+			keys: []Key{IntKey(1), StringKey("n")},
+		},
+		{
+			name: "delete last item",
+			base: `T = { "a", "b", "c" }`,
+			ops:  []op{del(IntKey(3))},
+			want: `T = { "a", "b" }`,
+			keys: []Key{IntKey(1), IntKey(2)},
+		},
+		{
+			name: "delete last items with separator",
+			base: `T = { "a", "b", "c", }`,
+			ops:  []op{del(IntKey(2)), del(IntKey(3))},
+			want: `T = { "a", }`,
+			keys: []Key{IntKey(1)},
+		},
+		{
+			name: "delete last items",
+			base: `T = { "a", "b", "c" }`,
+			ops:  []op{del(IntKey(2)), del(IntKey(3))},
+			want: `T = { "a" }`,
+			keys: []Key{IntKey(1)},
+		},
+		{
+			name:   "delete all and add",
+			base:   "T = { a = 1, c = 3 }",
+			source: "T = { b = 2 }",
+			ops:    []op{del(StringKey("a")), del(StringKey("c")), add(StringKey("b"))},
+			want:   "T = { b = 2 }",
+			keys:   []Key{StringKey("b")},
+		},
+		{
+			name:   "delete all and add multi-line",
+			base:   "T = {\n\ta = 1,\n}\n",
+			source: "T = { b = 2 }",
+			ops:    []op{del(StringKey("a")), add(StringKey("b"))},
+			want:   "T = {\n\tb = 2,\n}\n",
+			keys:   []Key{StringKey("b")},
+		},
+		{
+			name:   "delete then add",
+			base:   "T = {\n\ta = 1,\n\tb = 2,\n}\n",
+			source: "T = { c = 3 }",
+			ops:    []op{del(StringKey("b")), add(StringKey("c"))},
+			want:   "T = {\n\ta = 1,\n\tc = 3,\n}\n",
+			keys:   []Key{StringKey("a"), StringKey("c")},
+		},
+		{
+			name:   "add positional",
+			base:   `T = { "x", "y" }`,
+			source: `T = { "x", "y", "z" }`,
+			ops:    []op{add(IntKey(3))},
+			want:   `T = { "x", "y", "z" }`,
+			keys:   []Key{IntKey(1), IntKey(2), IntKey(3)},
+		},
+		{
+			name:   "add after deleted positional",
+			base:   `T = { "x", "y" }`,
+			source: `T = { "x", "y", "w" }`,
+			ops:    []op{del(IntKey(2)), add(IntKey(3))},
+			want:   `T = { "x", [3] = "w", }`,
+			keys:   []Key{IntKey(1), IntKey(3)},
+		},
+		{
+			name:   "insert inline",
+			base:   "T = { a = 1, b = 2 }",
+			source: "T = { z = 0, n = 5 }",
+			ops:    []op{insert(0, StringKey("z")), insert(2, StringKey("n"))},
+			want:   "T = { z = 0, a = 1, n = 5, b = 2 }",
+			keys:   []Key{StringKey("z"), StringKey("a"), StringKey("n"), StringKey("b")},
+		},
+		{
+			name:   "insert and delete multi-line",
+			base:   "T = {\n\ta = 1, -- one\n\tb = 2,\n\tc = 3,\n}\n",
+			source: "T = { z = 0, n = 5 }",
+			ops:    []op{insert(0, StringKey("z")), insert(2, StringKey("n")), del(StringKey("b"))},
+			want:   "T = {\n\tz = 0,\n\ta = 1, -- one\n\tn = 5,\n\tc = 3,\n}\n",
+			keys:   []Key{StringKey("z"), StringKey("a"), StringKey("n"), StringKey("c")},
+		},
+		{
+			name:   "insert after repeated key",
+			base:   "T = { a = 1, b = 2, a = 3 }",
+			source: "T = { x = 9 }",
+			ops:    []op{insert(1, StringKey("x"))},
+			want:   "T = { a = 1, b = 2, a = 3, x = 9, }",
+			keys:   []Key{StringKey("a"), StringKey("x"), StringKey("b")},
+		},
+		{
+			name:   "insert after repeated key with separator",
+			base:   "T = { a = 1, b = 2, a = 3, c = 4 }",
+			source: "T = { x = 9 }",
+			ops:    []op{insert(1, StringKey("x"))},
+			want:   "T = { a = 1, b = 2, a = 3, x = 9, c = 4 }",
+			keys:   []Key{StringKey("a"), StringKey("x"), StringKey("b"), StringKey("c")},
+		},
+		{
+			name:   "insert after repeated key multi-line",
+			base:   "T = {\n\ta = 1,\n\tb = 2,\n\ta = 3\n}\n",
+			source: "T = { x = 9 }",
+			ops:    []op{insert(1, StringKey("x"))},
+			want:   "T = {\n\ta = 1,\n\tb = 2,\n\ta = 3,\n\tx = 9,\n}\n",
+			keys:   []Key{StringKey("a"), StringKey("x"), StringKey("b")},
+		},
+		{
+			name:   "insert existing",
+			base:   "T = { a = 1, b = 2 }",
+			source: "T = { b = 3 }",
+			ops:    []op{insert(0, StringKey("b"))},
+			want:   "T = { a = 1, b = 3 }",
+			keys:   []Key{StringKey("a"), StringKey("b")},
+		},
+		{
+			name:   "insert positional",
+			base:   `T = { "x", n = 1 }`,
+			source: `T = { "w", "v" }`,
+			ops:    []op{insert(0, IntKey(2))},
+			want:   `T = { [2] = "v", "x", n = 1 }`,
+			keys:   []Key{IntKey(2), IntKey(1), StringKey("n")},
+		},
+		{
+			name:   "statements",
+			base:   "T = {}\nT[1] = { a = 1 }\nT[1].b = 2\nT[2] = 5\n",
+			source: "T = { [1] = 7, [3] = 8 }",
+			ops:    []op{replace(IntKey(1)), del(IntKey(2)), insert(0, IntKey(3))},
+			want:   "T = {}\nT[1] = 7\nT[3] = 8\n",
+			keys:   []Key{IntKey(3), IntKey(1)},
+		},
+		{
+			name:   "statements after constructor",
+			base:   "T = { a = 1 }\nT.b = 2\n",
+			source: "T = { c = 3 }",
+			ops:    []op{del(StringKey("a")), add(StringKey("c"))},
+			want:   "T = { }\nT.b = 2\nT.c = 3\n",
+			keys:   []Key{StringKey("b"), StringKey("c")},
+		},
+		{
+			name:   "replace extended value",
+			base:   "T = { x = { a = 1 } }\nT.x.b = 2\nT.y = 3\n",
+			source: "T = { x = 9 }",
+			ops:    []op{replace(StringKey("x"))},
+			want:   "T = { x = 9 }\nT.y = 3\n",
+			keys:   []Key{StringKey("x"), StringKey("y")},
+		},
+	}
+
+	render := func(value *Value) (string, error) {
+		return "", errors.New("unexpected value to render")
+	}
+
+	for _, tt := range tests {
+		file, base := findT(t, tt.base)
+		source := base
+		if tt.source != "" {
+			_, source = findT(t, tt.source)
+		}
+		for _, op := range tt.ops {
+			op(base, source)
+		}
+
+		edits, err := base.Edits(render)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got, err := ApplyEdits(file.Source, edits)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+
+		checkIndex(t, tt.name, base)
+		var keys []Key
+		for entry := range base.Range() {
+			keys = append(keys, entry.Key)
+		}
+		if len(keys) != len(tt.keys) {
+			t.Errorf("%s: keys %v, want %v", tt.name, keys, tt.keys)
+			continue
+		}
+		for i := range keys {
+			if keys[i] != tt.keys[i] {
+				t.Errorf("%s: keys %v, want %v", tt.name, keys, tt.keys)
+				break
+			}
+		}
+	}
+}
+
+func TestTableDelete(t *testing.T) {
+	_, table := findT(t, "T = { a = 1, b = 2, c = 3 }")
+
+	entry, ok := table.Delete(StringKey("b"))
+	if !ok || entry.Key != StringKey("b") {
+		t.Fatalf("Delete(b) = %v, %v", entry, ok)
+	}
+	if _, ok := table.Get(StringKey("b")); ok {
+		t.Error("b is still in the table")
+	}
+	if _, ok := table.Delete(StringKey("b")); ok {
+		t.Error("b was deleted twice")
+	}
+	checkIndex(t, "delete", table)
+
+	if c, ok := table.Get(StringKey("c")); !ok || c.Raw() != "3" {
+		t.Errorf("c = %v, %v after deleting b", c, ok)
+	}
+}
@@ -0,0 +1,401 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// EvalLimits bounds the run of a file by EvalFile.
+// A zero field means no limit.
+type EvalLimits struct {
+	Instructions int           // Lua VM instructions
+	Timeout      time.Duration // wall-clock time
+	Memory       int64         // bytes of heap allocated by the run
+}
+
+// environment is the state left by running a file: its global table and
+// the first value returned by its main chunk
+type environment struct {
+	globals  *lua.LTable
+	returned lua.LValue
+}
+
+// sandboxLibs are the standard libraries available to an evaluated file.
+// io, os, package, debug and coroutine are left out.
+var sandboxLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// sandboxRemoved are the functions of the base library that reach the
+// file system or the package loader, or that compile code the sandbox
+// has not seen
+var sandboxRemoved = []string{"dofile", "loadfile", "load", "loadstring", "require", "module", "print"}
+
+// maxEvalString is the length of the longest string that string.rep and
+// table.concat may build in an evaluated file. The instruction budget only
+// counts the instructions of the VM, not the work of a library function, so
+// a single call to one of them could otherwise take any amount of memory
+// before the memory limit is checked again.
+const maxEvalString = 64 << 20
+
+// memoryPoll is how often the heap is measured against the memory limit
+const memoryPoll = 2 * time.Millisecond
+
+// sandboxLimited are the library functions whose result can be far longer
+// than their arguments, with the length of the string a call would build
+var sandboxLimited = []struct {
+	lib, name string
+	length    func(L *lua.LState) int64
+}{
+	{lua.StringLibName, "rep", repLength},
+	{lua.TabLibName, "concat", concatLength},
+}
+
+// EvalFile runs Lua 5.1 source in a sandboxed VM instead of parsing it, for
+// data files that build their tables with loops, helper functions or string
+// concatenation. The file can only use the base, table, string and math
+// libraries, and its run is bounded by limits. The memory limit counts the
+// heap the process allocates while the file runs; it is checked every few
+// milliseconds, so a run can go past it by its last allocations.
+// The tables of the returned File are the global variables set by the run
+// (and the value it returns), so only global and returned tables can be
+// found. They have no source text: FindTable converts them into tables with
+// no syntax tree, which can be merged but not edited in place.
+func EvalFile(name string, source string, limits EvalLimits) (*File, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+
+	for _, lib := range sandboxLibs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range sandboxRemoved {
+		L.SetGlobal(name, lua.LNil)
+	}
+	for _, f := range sandboxLimited {
+		limitLength(L, f.lib, f.name, f.length)
+	}
+
+	if limits.Instructions > 0 || limits.Timeout > 0 || limits.Memory > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if limits.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+			defer cancel()
+		}
+		b := &budget{Context: ctx, limits: limits, left: limits.Instructions}
+		if limits.Memory > 0 {
+			go b.watchMemory(cancel)
+		}
+		L.SetContext(b)
+	}
+
+	chunk, err := L.Load(strings.NewReader(source), name)
+	if err != nil {
+		return nil, evalError(err)
+	}
+	L.Push(chunk)
+	if err := L.PCall(0, 1, nil); err != nil {
+		return nil, evalError(err)
+	}
+
+	env := &environment{globals: L.G.Global, returned: L.Get(-1)}
+	return &File{Name: name, Source: source, env: env}, nil
+}
+
+// limitLength replaces a library function with one that fails instead of
+// building a string longer than maxEvalString. The string library is also
+// the metatable of strings, so s:rep(n) is checked as well.
+func limitLength(L *lua.LState, lib, name string, length func(L *lua.LState) int64) {
+	table := L.GetGlobal(lib).(*lua.LTable)
+	original := L.GetField(table, name).(*lua.LFunction).GFunction
+	L.SetField(table, name, L.NewFunction(func(L *lua.LState) int {
+		if n := length(L); n > maxEvalString {
+			L.RaiseError("%s.%s: result of %d bytes exceeds the limit of %d bytes", lib, name, n, maxEvalString)
+		}
+		return original(L)
+	}))
+}
+
+// repLength is the length of the result of string.rep(s, n)
+func repLength(L *lua.LState) int64 {
+	s, n := int64(len(L.CheckString(1))), int64(L.CheckInt(2))
+	if s == 0 || n <= 0 {
+		return 0
+	}
+	if n > maxEvalString/s {
+		return math.MaxInt64
+	}
+	return s * n
+}
+
+// concatLength is the length of the result of table.concat(t, sep, i, j),
+// for the range of the table that tableConcat of gopher-lua joins
+func concatLength(L *lua.LState) int64 {
+	t := L.CheckTable(1)
+	sep := int64(len(L.OptString(2, "")))
+	i, j := max(L.OptInt(3, 1), 1), min(L.OptInt(4, t.Len()), t.Len())
+
+	var length int64
+	for k := i; k <= j; k++ {
+		if v := t.RawGetInt(k); lua.LVCanConvToString(v) {
+			length += int64(len(lua.LVAsString(v)))
+		}
+		if k < j {
+			length += sep
+		}
+		if length > maxEvalString {
+			break
+		}
+	}
+	return length
+}
+
+// evalError reports an error raised by the VM without its stack traceback
+func evalError(err error) error {
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) && apiErr.Object != nil {
+		return fmt.Errorf("parser.EvalFile: %s", apiErr.Object)
+	}
+	return fmt.Errorf("parser.EvalFile: %w", err)
+}
+
+// budget is a context that also ends after a number of VM instructions:
+// the gopher-lua VM checks Done before every instruction it runs.
+// When Instructions is zero, only the deadline applies. With a memory
+// limit, watchMemory cancels the context once the heap has grown past it.
+type budget struct {
+	context.Context
+	limits EvalLimits
+	left   int
+	memory atomic.Bool // the memory limit was exceeded
+}
+
+// heapBytes returns the bytes held by the objects of the heap, including
+// those not collected yet
+func heapBytes() int64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return int64(sample[0].Value.Uint64())
+}
+
+// watchMemory measures the heap until the run ends, and cancels it when
+// the heap has grown past the memory limit since it started, even once
+// the garbage is collected
+func (b *budget) watchMemory(cancel context.CancelFunc) {
+	start := heapBytes()
+	ticker := time.NewTicker(memoryPoll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.Context.Done():
+			return
+		case <-ticker.C:
+		}
+		// The garbage of earlier runs can be collected while this one runs
+		heap := heapBytes()
+		start = min(start, heap)
+		if heap-start <= b.limits.Memory {
+			continue
+		}
+		runtime.GC()
+		if heapBytes()-start > b.limits.Memory {
+			b.memory.Store(true)
+			cancel()
+			return
+		}
+	}
+}
+
+// spent is the Done channel of an exhausted budget
+var spent = func() chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}()
+
+func (b *budget) Done() <-chan struct{} {
+	if b.limits.Instructions > 0 {
+		if b.left--; b.left < 0 {
+			return spent
+		}
+	}
+	return b.Context.Done()
+}
+
+func (b *budget) Err() error {
+	if b.memory.Load() {
+		return fmt.Errorf("memory limit of %d MiB exceeded", b.limits.Memory>>20)
+	}
+	if b.limits.Instructions > 0 && b.left < 0 {
+		return fmt.Errorf("instruction limit of %d exceeded", b.limits.Instructions)
+	}
+	if errors.Is(b.Context.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("time limit of %s exceeded", b.limits.Timeout)
+	}
+	return b.Context.Err()
+}
+
+// evalDefinitions resolves the table at the given path among the globals
+// (or the returned value) of an evaluated file
+func (f *File) evalDefinitions(path Path) ([]*Table, error) {
+	value := lua.LValue(f.env.globals)
+	if path.IsReturn() {
+		value = f.env.returned
+	} else {
+		for _, key := range path {
+			table, ok := value.(*lua.LTable)
+			if !ok {
+				value = lua.LNil
+				break
+			}
+			value = table.RawGet(luaKey(key))
+		}
+	}
+
+	table, ok := value.(*lua.LTable)
+	if !ok {
+		if path.IsReturn() {
+			return nil, fmt.Errorf("parser.evalDefinitions: no returned table was found in %s", f.Name)
+		}
+		return nil, fmt.Errorf("parser.evalDefinitions: table '%s' was not found in %s", path, f.Name)
+	}
+
+	converted, err := f.evalTable(table, path, make(map[*lua.LTable]bool))
+	if err != nil {
+		return nil, err
+	}
+	return []*Table{converted}, nil
+}
+
+// evalTable converts a table of the VM into a Table, in the order the VM
+// iterates it: the array part first, then the other keys as they were set.
+// visiting holds the tables being converted, to detect cycles.
+func (f *File) evalTable(lt *lua.LTable, path Path, visiting map[*lua.LTable]bool) (*Table, error) {
+	if visiting[lt] {
+		return nil, fmt.Errorf("%s: table '%s' contains itself", f.Name, path)
+	}
+	visiting[lt] = true
+	defer delete(visiting, lt)
+
+	table := NewTable()
+	table.file = f
+
+	for k, v := lt.Next(lua.LNil); k != lua.LNil; k, v = lt.Next(k) {
+		key, err := evalKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("%s: table '%s': %w", f.Name, path, err)
+		}
+
+		// Functions (and the other values that are not data) are left out
+		entryPath := append(path[:len(path):len(path)], key)
+		if !isData(v) {
+			table.skipped = append(table.skipped, fmt.Sprintf("%s: '%s' is a %s, which cannot be extracted from an evaluated file", f.Name, entryPath, v.Type()))
+			continue
+		}
+
+		value, err := f.evalValue(v, entryPath, visiting)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := table.add(key, value, nil)
+		if key == IntKey(int64(table.currentIndex+1)) {
+			table.currentIndex++
+			entry.positional = true
+		}
+	}
+	return table, nil
+}
+
+// isData reports whether a value of the VM can be converted into a Value
+func isData(lv lua.LValue) bool {
+	switch lv.(type) {
+	case lua.LBool, lua.LNumber, lua.LString, *lua.LTable:
+		return true
+	}
+	return false
+}
+
+// Skipped returns the entries of an evaluated table, and of the tables in
+// it, that were left out because their value is not data (a function), as
+// messages with their path
+func (t *Table) Skipped() []string {
+	skipped := t.skipped
+	for _, entry := range t.values {
+		if sub, err := entry.Value.Table(); err == nil {
+			skipped = append(skipped[:len(skipped):len(skipped)], sub.Skipped()...)
+		}
+	}
+	return skipped
+}
+
+// evalValue converts a value of the VM into a Value
+func (f *File) evalValue(lv lua.LValue, path Path, visiting map[*lua.LTable]bool) (*Value, error) {
+	value := &Value{file: f}
+
+	switch v := lv.(type) {
+	case lua.LBool:
+		value.Type, value.value = TypeBoolean, bool(v)
+	case lua.LNumber:
+		value.Type, value.value = TypeNumber, FloatNumber(float64(v))
+	case lua.LString:
+		value.Type, value.value = TypeString, string(v)
+	case *lua.LTable:
+		table, err := f.evalTable(v, path, visiting)
+		if err != nil {
+			return nil, err
+		}
+		value.Type, value.value = TypeTable, table
+	default:
+		return nil, fmt.Errorf("%s: '%s' is a %s, which cannot be extracted from an evaluated file", f.Name, path, lv.Type())
+	}
+	return value, nil
+}
+
+// evalKey converts a key of the VM into a Key
+func evalKey(lv lua.LValue) (Key, error) {
+	switch v := lv.(type) {
+	case lua.LBool:
+		return BoolKey(bool(v)), nil
+	case lua.LNumber:
+		return NumberKey(FloatNumber(float64(v))), nil
+	case lua.LString:
+		return StringKey(string(v)), nil
+	default:
+		return Key{}, fmt.Errorf("unsupported %s key", lv.Type())
+	}
+}
+
+// luaKey converts a Key into a key of the VM. Expression keys match nothing.
+func luaKey(key Key) lua.LValue {
+	switch key.kind {
+	case KeyString:
+		return lua.LString(key.str)
+	case KeyInteger:
+		return lua.LNumber(key.i)
+	case KeyFloat:
+		return lua.LNumber(key.f)
+	case KeyBoolean:
+		return lua.LBool(key.i != 0)
+	default:
+		return lua.LNil
+	}
+}
@@ -0,0 +1,88 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvalStringLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		source  string
+		wantErr bool
+	}{
+		{"rep", `T = { s = string.rep("ab", 1000) }`, false},
+		{"rep too long", `T = { s = string.rep("ab", 1e9) }`, true},
+		{"rep method", `T = { s = ("ab"):rep(1e9) }`, true},
+		{"rep overflow", `T = { s = string.rep(string.rep("x", 1e6), 2^62) }`, true},
+		{"rep negative", `T = { s = string.rep("ab", -1) }`, false},
+		{"concat", `T = { s = table.concat({ "a", 1, "b" }, ", ") }`, false},
+		{"concat too long", `local big = string.rep("x", 2^25) T = { s = table.concat({ big, big, big }) }`, true},
+		{"concat separator", `local big = string.rep("x", 2^25) T = { s = table.concat({ 1, 2, 3 }, big) }`, true},
+		{"concat range", `local big = string.rep("x", 2^25) T = { s = table.concat({ big, big, big }, "", 2, 2) }`, false},
+	}
+
+	for _, tt := range tests {
+		_, err := EvalFile("test.lua", tt.source, EvalLimits{Instructions: 1000})
+		if tt.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+				t.Errorf("%s: got error %v, want the length limit", tt.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestEvalMemoryLimit(t *testing.T) {
+	source := `local s = "x" for i = 1, 40 do s = s .. s end T = { s = s }`
+	_, err := EvalFile("test.lua", source, EvalLimits{Memory: 16 << 20, Timeout: 10 * time.Second})
+	if err == nil || !strings.Contains(err.Error(), "memory limit of 16 MiB exceeded") {
+		t.Errorf("got error %v, want the memory limit", err)
+	}
+}
+
+func TestEvalSandbox(t *testing.T) {
+	for _, name := range []string{"load", "loadstring", "dofile", "require"} {
+		file, err := EvalFile("test.lua", "T = { removed = "+name+" == nil }", EvalLimits{Instructions: 1000})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		table, err := file.FindTable(Path{StringKey("T")})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		value, _ := table.Get(StringKey("removed"))
+		if removed, err := value.Boolean(); err != nil || !removed {
+			t.Errorf("%s: got %v, want it removed from the sandbox", name, value.Value())
+		}
+	}
+}
+
+func TestEvalSkipped(t *testing.T) {
+	source := "T = { a = 1, f = string.len, sub = { g = function() end, b = 2 } }"
+	file, err := EvalFile("test.lua", source, EvalLimits{Instructions: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := file.FindTable(Path{StringKey("T")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := table.Get(StringKey("a")); !ok {
+		t.Error("entry a is missing")
+	}
+	if _, ok := table.Get(StringKey("f")); ok {
+		t.Error("entry f was kept")
+	}
+	want := []string{
+		"test.lua: 'T.f' is a function, which cannot be extracted from an evaluated file",
+		"test.lua: 'T.sub.g' is a function, which cannot be extracted from an evaluated file",
+	}
+	got := table.Skipped()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got skipped %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,648 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SyntaxError is a lexical or grammatical error in a Lua source
+type SyntaxError struct {
+	File   string
+	Line   int
+	Column int
+	Offset int
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Msg)
+}
+
+// newSyntaxError creates a SyntaxError at the given offset of src
+func newSyntaxError(src string, offset int, format string, args ...any) *SyntaxError {
+	line, column := position(src, offset)
+	return &SyntaxError{
+		Line:   line,
+		Column: column,
+		Offset: offset,
+		Msg:    fmt.Sprintf(format, args...),
+	}
+}
+
+// position converts a byte offset into a 1-based line and column
+func position(src string, offset int) (int, int) {
+	offset = min(offset, len(src))
+	line := 1 + strings.Count(src[:offset], "\n")
+	column := offset - strings.LastIndexByte(src[:offset], '\n')
+	return line, column
+}
+
+// ParseFile parses Lua source into a lossless syntax tree, with the grammar
+// of the given Lua version
+func ParseFile(name string, source string, version Version) (file *File, err error) {
+	tokens, err := Tokenize(source)
+	if err != nil {
+		if syntaxErr, ok := err.(*SyntaxError); ok {
+			syntaxErr.File = name
+		}
+		return nil, err
+	}
+
+	p := &syntaxParser{src: source, tokens: tokens, version: version}
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxErr, ok := r.(*SyntaxError)
+			if !ok {
+				panic(r)
+			}
+			syntaxErr.File = name
+			file, err = nil, syntaxErr
+		}
+	}()
+
+	chunk := p.block()
+	if p.peek().Kind != TokenEOF {
+		p.fail("'<eof>' expected")
+	}
+
+	return &File{Name: name, Source: source, Chunk: chunk, version: version}, nil
+}
+
+// ParseFileRecover parses Lua source like ParseFile, but does not stop at
+// syntax errors. A top-level statement that fails to parse is kept as a
+// BadStmt running up to the next line that starts, at its first column,
+// with a statement (a name or a statement keyword); its error is added to
+// File.Errors. Tables defined outside the broken regions can still be found.
+func ParseFileRecover(name string, source string, version Version) *File {
+	tokens, lexical := tokenize(source, true)
+
+	p := &syntaxParser{src: source, tokens: tokens, version: version, lexical: make(map[int]*SyntaxError)}
+	for _, token := range tokens {
+		if token.Kind == TokenError {
+			p.lexical[token.Start], lexical = lexical[0], lexical[1:]
+		}
+	}
+
+	file := &File{Name: name, Source: source, version: version}
+	for p.peek().Kind != TokenEOF {
+		if p.accept(";") {
+			continue
+		}
+
+		start := p.pos
+		stmt, err := p.tryStatement()
+		if err == nil {
+			file.Chunk = append(file.Chunk, stmt)
+			continue
+		}
+
+		err.File = name
+		file.Errors = append(file.Errors, err)
+
+		p.pos = p.resync(start + 1)
+		last := p.tokens[p.pos-1]
+		file.Chunk = append(file.Chunk, &BadStmt{span: span{p.tokens[start].Start, last.End}})
+		p.prevEnd = last.End
+	}
+
+	return file
+}
+
+// tryStatement parses a top-level statement, recovering its syntax error.
+// A return statement must end the chunk.
+func (p *syntaxParser) tryStatement() (stmt Stmt, err *SyntaxError) {
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxErr, ok := r.(*SyntaxError)
+			if !ok {
+				panic(r)
+			}
+			stmt, err = nil, syntaxErr
+		}
+	}()
+
+	if p.peek().Is("return") {
+		stmt = p.returnStmt()
+		p.accept(";")
+		if p.peek().Kind != TokenEOF {
+			p.fail("'<eof>' expected")
+		}
+		return stmt, nil
+	}
+	return p.statement(), nil
+}
+
+// resync returns the index of the first token from i on that starts a line
+// and can start a statement, or of the EOF token
+func (p *syntaxParser) resync(i int) int {
+	for ; p.tokens[i].Kind != TokenEOF; i++ {
+		token := p.tokens[i]
+		if token.Start > 0 && p.src[token.Start-1] != '\n' {
+			continue
+		}
+
+		switch {
+		case token.Kind == TokenName,
+			token.Is("local"), token.Is("function"), token.Is("return"),
+			token.Is("if"), token.Is("for"), token.Is("while"),
+			token.Is("do"), token.Is("repeat"):
+			return i
+		}
+	}
+	return i
+}
+
+// syntaxParser is a recursive descent parser for the Lua 5.1 grammar and,
+// depending on version, the additions of Lua 5.3 and 5.4.
+// Errors are raised as *SyntaxError panics and recovered by ParseFile.
+// In recover mode, lexical holds the lexical errors by the offset of their
+// TokenError token, and the parser raises them when it reaches the token.
+type syntaxParser struct {
+	src     string
+	tokens  []Token
+	pos     int
+	prevEnd int
+	version Version
+	lexical map[int]*SyntaxError
+}
+
+func (p *syntaxParser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *syntaxParser) peekAt(n int) Token {
+	if p.pos+n >= len(p.tokens) {
+		return p.tokens[len(p.tokens)-1]
+	}
+	return p.tokens[p.pos+n]
+}
+
+func (p *syntaxParser) next() Token {
+	token := p.tokens[p.pos]
+	if token.Kind != TokenEOF {
+		p.pos++
+	}
+	p.prevEnd = token.End
+	return token
+}
+
+func (p *syntaxParser) accept(text string) bool {
+	if p.peek().Is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *syntaxParser) expect(text string) Token {
+	if !p.peek().Is(text) {
+		p.fail("'%s' expected", text)
+	}
+	return p.next()
+}
+
+func (p *syntaxParser) expectName() Token {
+	if p.peek().Kind != TokenName {
+		p.fail("<name> expected")
+	}
+	return p.next()
+}
+
+// fail raises a syntax error at the current token
+func (p *syntaxParser) fail(format string, args ...any) {
+	token := p.peek()
+	if err, ok := p.lexical[token.Start]; ok && token.Kind == TokenError {
+		panic(err)
+	}
+
+	near := token.Text
+	if token.Kind == TokenEOF {
+		near = "<eof>"
+	}
+	panic(newSyntaxError(p.src, token.Start, "%s near '%s'", fmt.Sprintf(format, args...), near))
+}
+
+// blockEnd reports whether the current token closes a block
+func (p *syntaxParser) blockEnd() bool {
+	token := p.peek()
+	return token.Kind == TokenEOF || token.Is("end") || token.Is("else") ||
+		token.Is("elseif") || token.Is("until")
+}
+
+// block parses a sequence of statements
+func (p *syntaxParser) block() []Stmt {
+	var stmts []Stmt
+	for !p.blockEnd() {
+		if p.peek().Is("return") {
+			stmts = append(stmts, p.returnStmt())
+			p.accept(";")
+			if !p.blockEnd() {
+				p.fail("'<eof>' expected")
+			}
+			break
+		}
+
+		if p.accept(";") {
+			continue
+		}
+		stmts = append(stmts, p.statement())
+	}
+	return stmts
+}
+
+func (p *syntaxParser) returnStmt() Stmt {
+	start := p.next().Start
+	var values []Expr
+	if !p.blockEnd() && !p.peek().Is(";") {
+		values = p.exprList()
+	}
+	return &ReturnStmt{span: span{start, p.prevEnd}, Values: values}
+}
+
+func (p *syntaxParser) statement() Stmt {
+	token := p.peek()
+	start := token.Start
+
+	switch {
+	case token.Is("if"):
+		p.next()
+		p.expr()
+		p.expect("then")
+		p.block()
+		for p.accept("elseif") {
+			p.expr()
+			p.expect("then")
+			p.block()
+		}
+		if p.accept("else") {
+			p.block()
+		}
+		p.expect("end")
+
+	case token.Is("while"):
+		p.next()
+		p.expr()
+		p.expect("do")
+		p.block()
+		p.expect("end")
+
+	case token.Is("do"):
+		p.next()
+		p.block()
+		p.expect("end")
+
+	case token.Is("for"):
+		p.next()
+		p.expectName()
+		if p.accept("=") {
+			p.expr()
+			p.expect(",")
+			p.expr()
+			if p.accept(",") {
+				p.expr()
+			}
+		} else {
+			for p.accept(",") {
+				p.expectName()
+			}
+			p.expect("in")
+			p.exprList()
+		}
+		p.expect("do")
+		p.block()
+		p.expect("end")
+
+	case token.Is("repeat"):
+		p.next()
+		p.block()
+		p.expect("until")
+		p.expr()
+
+	case token.Is("function"):
+		p.next()
+		p.expectName()
+		for p.accept(".") {
+			p.expectName()
+		}
+		if p.accept(":") {
+			p.expectName()
+		}
+		p.funcBody()
+
+	case token.Is("local"):
+		p.next()
+		if p.accept("function") {
+			p.expectName()
+			p.funcBody()
+			return &BlockStmt{span: span{start, p.prevEnd}, Keyword: "local function"}
+		}
+		return p.localStmt(start)
+
+	case token.Is("break"):
+		p.next()
+
+	case token.Is("::") && p.version >= Lua53:
+		p.next()
+		p.expectName()
+		p.expect("::")
+
+	case token.Kind == TokenName && token.Text == "goto" && p.version >= Lua53:
+		p.next()
+		p.expectName()
+
+	default:
+		return p.exprStmt()
+	}
+
+	return &BlockStmt{span: span{start, p.prevEnd}, Keyword: token.Text}
+}
+
+func (p *syntaxParser) localStmt(start int) Stmt {
+	names := []Token{p.localName()}
+	for p.accept(",") {
+		names = append(names, p.localName())
+	}
+
+	var values []Expr
+	if p.accept("=") {
+		values = p.exprList()
+	}
+	return &LocalStmt{span: span{start, p.prevEnd}, Names: names, Values: values}
+}
+
+// localName parses the name of a local declaration, followed in Lua 5.4 by
+// an optional attribute (<const> or <close>)
+func (p *syntaxParser) localName() Token {
+	name := p.expectName()
+	if p.version >= Lua54 && p.accept("<") {
+		if attrib := p.expectName(); attrib.Text != "const" && attrib.Text != "close" {
+			p.fail("unknown attribute '%s'", attrib.Text)
+		}
+		p.expect(">")
+	}
+	return name
+}
+
+func (p *syntaxParser) exprStmt() Stmt {
+	first := p.suffixedExpr()
+
+	if p.peek().Is("=") || p.peek().Is(",") {
+		targets := []Expr{first}
+		for p.accept(",") {
+			targets = append(targets, p.suffixedExpr())
+		}
+		for _, target := range targets {
+			switch target.(type) {
+			case *NameExpr, *IndexExpr:
+			default:
+				p.fail("syntax error")
+			}
+		}
+		p.expect("=")
+		values := p.exprList()
+		return &AssignStmt{span: span{first.Start(), p.prevEnd}, Targets: targets, Values: values}
+	}
+
+	call, ok := first.(*CallExpr)
+	if !ok {
+		p.fail("syntax error")
+	}
+	return &CallStmt{span: call.span, Call: call}
+}
+
+func (p *syntaxParser) exprList() []Expr {
+	exprs := []Expr{p.expr()}
+	for p.accept(",") {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+// Operator priorities (left, right) as defined by the Lua 5.3 reference
+// parser. The operators of Lua 5.1 keep the same relative priorities.
+var binaryPriority = map[string][2]int{
+	"or":  {1, 1},
+	"and": {2, 2},
+	"<":   {3, 3},
+	">":   {3, 3},
+	"<=":  {3, 3},
+	">=":  {3, 3},
+	"~=":  {3, 3},
+	"==":  {3, 3},
+	"|":   {4, 4},
+	"~":   {5, 5},
+	"&":   {6, 6},
+	"<<":  {7, 7},
+	">>":  {7, 7},
+	"..":  {9, 8},
+	"+":   {10, 10},
+	"-":   {10, 10},
+	"*":   {11, 11},
+	"/":   {11, 11},
+	"//":  {11, 11},
+	"%":   {11, 11},
+	"^":   {14, 13},
+}
+
+// lua53Operators are the operators added by Lua 5.3: integer division and
+// the bitwise operators (~ is also the unary bitwise not)
+var lua53Operators = map[string]bool{
+	"//": true, "&": true, "|": true, "~": true, "<<": true, ">>": true,
+}
+
+const unaryPriority = 12
+
+func (p *syntaxParser) expr() Expr {
+	return p.subExpr(0)
+}
+
+// subExpr parses an expression whose binary operators bind tighter than limit
+func (p *syntaxParser) subExpr(limit int) Expr {
+	var left Expr
+
+	token := p.peek()
+	if token.Is("not") || token.Is("-") || token.Is("#") || (token.Is("~") && p.version >= Lua53) {
+		p.next()
+		operand := p.subExpr(unaryPriority)
+		left = &UnaryExpr{span: span{token.Start, p.prevEnd}, Op: token.Text, Operand: operand}
+	} else {
+		left = p.simpleExpr()
+	}
+
+	for {
+		op := p.peek()
+		priority, ok := binaryPriority[op.Text]
+		if !ok || (op.Kind != TokenSymbol && op.Kind != TokenKeyword) || priority[0] <= limit {
+			return left
+		}
+		if lua53Operators[op.Text] && p.version < Lua53 {
+			return left
+		}
+		p.next()
+		right := p.subExpr(priority[1])
+		left = &BinaryExpr{span: span{left.Start(), p.prevEnd}, Left: left, Op: op.Text, Right: right}
+	}
+}
+
+func (p *syntaxParser) simpleExpr() Expr {
+	token := p.peek()
+
+	switch {
+	case token.Kind == TokenNumber:
+		p.next()
+		return &NumberExpr{span: tokenSpan(token), Token: token}
+	case token.Kind == TokenString:
+		p.next()
+		return &StringExpr{span: tokenSpan(token), Token: token}
+	case token.Is("nil"):
+		p.next()
+		return &NilExpr{tokenSpan(token)}
+	case token.Is("true"):
+		p.next()
+		return &TrueExpr{tokenSpan(token)}
+	case token.Is("false"):
+		p.next()
+		return &FalseExpr{tokenSpan(token)}
+	case token.Is("..."):
+		p.next()
+		return &VarargExpr{tokenSpan(token)}
+	case token.Is("{"):
+		return p.tableExpr()
+	case token.Is("function"):
+		p.next()
+		p.funcBody()
+		return &FunctionExpr{span{token.Start, p.prevEnd}}
+	default:
+		return p.suffixedExpr()
+	}
+}
+
+func (p *syntaxParser) primaryExpr() Expr {
+	token := p.peek()
+
+	switch {
+	case token.Kind == TokenName:
+		p.next()
+		return &NameExpr{span: tokenSpan(token), Name: token.Text}
+	case token.Is("("):
+		p.next()
+		inner := p.expr()
+		p.expect(")")
+		return &ParenExpr{span: span{token.Start, p.prevEnd}, Inner: inner}
+	default:
+		p.fail("unexpected symbol")
+		return nil
+	}
+}
+
+func (p *syntaxParser) suffixedExpr() Expr {
+	expr := p.primaryExpr()
+
+	for {
+		token := p.peek()
+		switch {
+		case token.Is("."):
+			p.next()
+			name := p.expectName()
+			key := &NameExpr{span: tokenSpan(name), Name: name.Text}
+			expr = &IndexExpr{span: span{expr.Start(), p.prevEnd}, Object: expr, Key: key, Dot: true}
+		case token.Is("["):
+			p.next()
+			key := p.expr()
+			p.expect("]")
+			expr = &IndexExpr{span: span{expr.Start(), p.prevEnd}, Object: expr, Key: key}
+		case token.Is(":"):
+			p.next()
+			method := p.expectName()
+			args := p.callArgs()
+			expr = &CallExpr{span: span{expr.Start(), p.prevEnd}, Func: expr, Method: method.Text, Args: args}
+		case token.Is("(") || token.Is("{") || token.Kind == TokenString:
+			args := p.callArgs()
+			expr = &CallExpr{span: span{expr.Start(), p.prevEnd}, Func: expr, Args: args}
+		default:
+			return expr
+		}
+	}
+}
+
+func (p *syntaxParser) callArgs() []Expr {
+	token := p.peek()
+
+	switch {
+	case token.Kind == TokenString:
+		p.next()
+		return []Expr{&StringExpr{span: tokenSpan(token), Token: token}}
+	case token.Is("{"):
+		return []Expr{p.tableExpr()}
+	case token.Is("("):
+		p.next()
+		var args []Expr
+		if !p.peek().Is(")") {
+			args = p.exprList()
+		}
+		p.expect(")")
+		return args
+	default:
+		p.fail("function arguments expected")
+		return nil
+	}
+}
+
+// funcBody parses a parameter list and a function body up to its end keyword
+func (p *syntaxParser) funcBody() {
+	p.expect("(")
+	if !p.peek().Is(")") {
+		for {
+			if p.accept("...") {
+				break
+			}
+			p.expectName()
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+	p.block()
+	p.expect("end")
+}
+
+func (p *syntaxParser) tableExpr() *TableExpr {
+	open := p.expect("{")
+	table := &TableExpr{Open: open}
+
+	for !p.peek().Is("}") {
+		field := &Field{span: span{start: p.peek().Start}}
+
+		switch {
+		case p.peek().Is("["):
+			p.next()
+			field.Key = p.expr()
+			p.expect("]")
+			p.expect("=")
+		case p.peek().Kind == TokenName && p.peekAt(1).Is("="):
+			name := p.next()
+			field.Key = &NameExpr{span: tokenSpan(name), Name: name.Text}
+			field.Named = true
+			p.next()
+		}
+
+		field.Value = p.expr()
+		field.end = p.prevEnd
+		table.Fields = append(table.Fields, field)
+
+		if sep := p.peek(); sep.Is(",") || sep.Is(";") {
+			p.next()
+			field.Sep = &sep
+		} else {
+			break
+		}
+	}
+
+	table.Close = p.expect("}")
+	table.span = span{open.Start, table.Close.End}
+	return table
+}
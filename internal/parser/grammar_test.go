@@ -0,0 +1,120 @@
+package parser
+
+import "testing"
+
+func TestParseFileRecover(t *testing.T) {
+	source := "A = { x = 1 }\nB = { y = = 2,\n  z = 3 }\nC = { z = 3 }\n"
+
+	file := ParseFileRecover("test.lua", source, Lua51)
+	if len(file.Chunk) != 3 {
+		t.Fatalf("got %d statements, want 3", len(file.Chunk))
+	}
+	bad, ok := file.Chunk[1].(*BadStmt)
+	if !ok {
+		t.Fatalf("statement 2 is a %T, want a BadStmt", file.Chunk[1])
+	}
+	if got, want := source[bad.Start():bad.End()], "B = { y = = 2,\n  z = 3 }"; got != want {
+		t.Errorf("got BadStmt %q, want %q", got, want)
+	}
+	if len(file.Errors) != 1 || file.Errors[0].Error() != "test.lua:2:11: unexpected symbol near '='" {
+		t.Errorf("got errors %v, want one at test.lua:2:11", file.Errors)
+	}
+
+	table, err := file.FindTable(Path{StringKey("C")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := table.Get(StringKey("z")); !ok || value.Raw() != "3" {
+		t.Errorf("C.z is %v, want 3", value)
+	}
+
+	// Without recover mode, the same source fails at the same position
+	if _, err := ParseFile("test.lua", source, Lua51); err == nil || err.Error() != "test.lua:2:11: unexpected symbol near '='" {
+		t.Errorf("got error %v, want it at test.lua:2:11", err)
+	}
+}
+
+func TestParseVersions(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		since  Version
+		err    string // the error of the versions before since
+	}{
+		{"floor division", "T = { a = 7 // 2 }", Lua53, "test.lua:1:13: '}' expected near '//'"},
+		{"bitwise operators", "A = 1 & 2 | 3 ~ 4 << 1 >> 2", Lua53, "test.lua:1:7: unexpected symbol near '&'"},
+		{"bitwise not", "A = ~5", Lua53, "test.lua:1:5: unexpected symbol near '~'"},
+		{"goto", "do goto skip A = 1 ::skip:: end", Lua53, "test.lua:1:9: syntax error near 'skip'"},
+		{"label", "::top:: A = 1", Lua53, "test.lua:1:1: unexpected symbol near '::'"},
+		{"const", "local x <const> = 1\nT = { x }", Lua54, "test.lua:1:9: unexpected symbol near '<'"},
+		{"close", "local x <const>, f <close> = 1, nil", Lua54, "test.lua:1:9: unexpected symbol near '<'"},
+	}
+
+	for _, tt := range tests {
+		for _, version := range []Version{Lua51, Lua53, Lua54} {
+			_, err := ParseFile("test.lua", tt.source, version)
+			switch {
+			case version >= tt.since && err != nil:
+				t.Errorf("%s: %s: %v", tt.name, version, err)
+			case version < tt.since && (err == nil || err.Error() != tt.err):
+				t.Errorf("%s: %s: got error %v, want %q", tt.name, version, err, tt.err)
+			}
+		}
+	}
+
+	if _, err := ParseFile("test.lua", "local x <other> = 1", Lua54); err == nil || err.Error() != "test.lua:1:15: unknown attribute 'other' near '>'" {
+		t.Errorf("got error %v, want an unknown attribute", err)
+	}
+}
+
+func TestParseIntegerLiterals(t *testing.T) {
+	source := "T = { i = 3, f = 3.0, h = 0xff, e = 1e2, d = 7 // 2 }"
+	want := map[string]bool{"i": true, "f": false, "h": true, "e": false}
+
+	file, err := ParseFile("test.lua", source, Lua53)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := file.FindTable(Path{StringKey("T")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, isInt := range want {
+		value, _ := table.Get(StringKey(key))
+		n, err := value.Number()
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+		} else if n.IsInt != isInt {
+			t.Errorf("%s: got integer %v, want %v", key, n.IsInt, isInt)
+		}
+	}
+
+	// An expression is kept as its source text
+	value, _ := table.Get(StringKey("d"))
+	if got, err := value.Expression(); err != nil || got != "7 // 2" {
+		t.Errorf("d: got expression %q (%v), want %q", got, err, "7 // 2")
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		path   Path
+		want   string
+	}{
+		{"syntax", "A = 1\nT = {\n\tx = 1\n\ty = 2,\n}", nil, "test.lua:4:2: '}' expected near 'y'"},
+		{"nil key", "A = 1\nT = {\n\tx = 1,\n\t[nil] = 2,\n}", Path{StringKey("T")}, "test.lua:4:3: table index is nil"},
+		{"returned value", "A = 1\n  return f()", Path{StringKey(ReturnTable)}, "test.lua:2:10: unsupported returned value: f()"},
+	}
+
+	for _, tt := range tests {
+		file, err := ParseFile("test.lua", tt.source, Lua51)
+		if err == nil {
+			_, err = file.FindTable(tt.path)
+		}
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package parser
+
+// Include is a dofile or require call of the main chunk whose argument is a
+// string literal: dofile("skillid.lua"), require "skillinfo.skillid".
+// Name is the argument, a path for dofile and a module name for require.
+type Include struct {
+	Name    string
+	Require bool
+	Stmt    *CallStmt
+	file    *File
+}
+
+// Pos returns the position of the call
+func (i Include) Pos() Position {
+	return i.file.Pos(i.Stmt)
+}
+
+// unit is a top-level statement together with the file it belongs to
+type unit struct {
+	file *File
+	stmt Stmt
+}
+
+// Includes returns the dofile and require calls of the main chunk, in file
+// order. The loader of the file resolves them (see ResolveIncludes).
+func (f *File) Includes() []Include {
+	var includes []Include
+
+	for _, stmt := range f.Chunk {
+		call, ok := stmt.(*CallStmt)
+		if !ok || call.Call.Method != "" || len(call.Call.Args) != 1 {
+			continue
+		}
+
+		function, ok := call.Call.Func.(*NameExpr)
+		if !ok || (function.Name != "dofile" && function.Name != "require") {
+			continue
+		}
+
+		arg, ok := call.Call.Args[0].(*StringExpr)
+		if !ok {
+			continue
+		}
+		name, err := UnquoteString(arg.Token.Text, f.version)
+		if err != nil {
+			continue
+		}
+
+		includes = append(includes, Include{Name: name, Require: function.Name == "require", Stmt: call, file: f})
+	}
+	return includes
+}
+
+// ResolveIncludes attaches the files loaded by the includes of the file,
+// by call statement; includes that are left out are ignored.
+// From then on, the statements of each included file take the place of its
+// call when tables are looked up (see FindDefinitions), and the constants
+// defined across the included files resolve symbolic keys such as
+// [SKID.NV_BASIC] (see parseKey).
+func (f *File) ResolveIncludes(files map[*CallStmt]*File) {
+	f.included = files
+	f.constants = nil
+}
+
+// UseConstants adds files whose constants resolve the symbolic keys of the
+// file, such as enum files that are loaded by the game rather than by the
+// file itself. Their globals and locals are constants for the file, ahead
+// of the definitions of the file and of its included files.
+func (f *File) UseConstants(files []*File) {
+	f.constantFiles = files
+	f.constants = nil
+}
+
+// IncludesResolved reports whether ResolveIncludes was called on the file
+func (f *File) IncludesResolved() bool {
+	return f.included != nil
+}
+
+// units returns the statements of the main chunk, with the statements of
+// the included files in place of their calls
+func (f *File) units() []unit {
+	return f.appendUnits(nil, make(map[*File]bool))
+}
+
+// appendUnits appends the units of the file to units. active holds the
+// files being expanded, so an include cycle is only followed once.
+func (f *File) appendUnits(units []unit, active map[*File]bool) []unit {
+	active[f] = true
+	defer delete(active, f)
+
+	for _, stmt := range f.Chunk {
+		if call, ok := stmt.(*CallStmt); ok {
+			if included := f.included[call]; included != nil && !active[included] {
+				units = included.appendUnits(units, active)
+				continue
+			}
+		}
+		units = append(units, unit{file: f, stmt: stmt})
+	}
+	return units
+}
+
+// constant resolves a key expression (a name or a field of a table, as in
+// [SKID.NV_BASIC]) to the literal key of the constant it refers to.
+func (f *File) constant(exp Expr) (Key, bool) {
+	scope := f.constantScope()
+	if scope == nil {
+		return Key{}, false
+	}
+
+	path, ok := f.exprPath(exp)
+	if !ok {
+		return Key{}, false
+	}
+	return scope.constantAt(path)
+}
+
+// constantScope returns the file whose constants resolve the keys of the
+// file, or nil when there are none. Only files with resolved includes or
+// constant files have constants; the lookup uses those of the file the
+// current lookup started from (see FindDefinitions).
+func (f *File) constantScope() *File {
+	scope := f
+	if f.scope != nil {
+		scope = f.scope
+	}
+	if scope.included == nil && scope.constantFiles == nil {
+		return nil
+	}
+	return scope
+}
+
+// constantAt resolves the path of a constant to its literal key, among the
+// constants defined by the file and its included and constant files
+func (f *File) constantAt(path Path) (Key, bool) {
+	if f.constants == nil {
+		f.constants = make(map[string]Key)
+
+		// Locals are only visible in their file, but those of the constant
+		// files are the constants they define
+		visible := map[*File]bool{f: true}
+		var units []unit
+		for _, file := range f.constantFiles {
+			visible[file] = true
+			units = append(units, file.units()...)
+		}
+
+		for _, u := range append(units, f.units()...) {
+			for _, a := range u.file.assignments(u.stmt) {
+				if a.target != nil && (!a.local || visible[u.file]) {
+					u.file.collectConstants(a.target, a.value, f.constants)
+				}
+			}
+		}
+	}
+
+	key, ok := f.constants[path.String()]
+	return key, ok
+}
+
+// collectConstants records the literal value assigned to path, or, for a
+// table constructor, the literal values of its fields under their paths.
+// A name that refers to a constant recorded before (B = A) is a constant too.
+func (f *File) collectConstants(path Path, exp Expr, constants map[string]Key) {
+	switch v := exp.(type) {
+	case *TableExpr:
+		index := 0
+		for _, field := range v.Fields {
+			var key Key
+			switch {
+			case field.Key == nil:
+				index++
+				key = IntKey(int64(index))
+			case field.Named:
+				key = StringKey(field.Key.(*NameExpr).Name)
+			default:
+				value, err := parseValue(f, field.Key)
+				if err != nil {
+					continue
+				}
+				if key, err = value.Key(); err != nil {
+					continue
+				}
+			}
+			f.collectConstants(append(path[:len(path):len(path)], key), field.Value, constants)
+		}
+	case *NameExpr, *IndexExpr:
+		if target, ok := f.exprPath(v); ok {
+			if key, ok := constants[target.String()]; ok {
+				constants[path.String()] = key
+			}
+		}
+	default:
+		value, err := parseValue(f, exp)
+		if err != nil {
+			return
+		}
+		if key, err := value.Key(); err == nil {
+			constants[path.String()] = key
+		}
+	}
+}
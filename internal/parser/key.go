@@ -0,0 +1,216 @@
+package parser
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// KeyKind is the kind of a table key
+type KeyKind int
+
+const (
+	KeyString KeyKind = iota
+	KeyInteger
+	KeyFloat
+	KeyBoolean
+	KeyExpression
+)
+
+// Key is a table key. Keys compare equal (with ==) exactly when Lua would
+// consider them the same key: 1 and 1.0 are one key, "1" and 1 are two.
+// Keys that are not literals ([A.B], [f()]) are opaque expressions and
+// compare by their source text.
+type Key struct {
+	kind KeyKind
+	str  string
+	i    int64
+	f    float64
+}
+
+// StringKey returns the key for a string
+func StringKey(s string) Key {
+	return Key{kind: KeyString, str: s}
+}
+
+// IntKey returns the key for an integer
+func IntKey(i int64) Key {
+	return Key{kind: KeyInteger, i: i}
+}
+
+// NumberKey returns the key for a number; numbers with an integral value
+// become integer keys, as in Lua
+func NumberKey(n Number) Key {
+	if n.IsInt {
+		return IntKey(n.Int)
+	}
+	if n := FloatNumber(n.Float); n.IsInt {
+		return IntKey(n.Int)
+	}
+	return Key{kind: KeyFloat, f: n.Float}
+}
+
+// BoolKey returns the key for a boolean
+func BoolKey(b bool) Key {
+	if b {
+		return Key{kind: KeyBoolean, i: 1}
+	}
+	return Key{kind: KeyBoolean}
+}
+
+// ExprKey returns the key for an expression that is not a literal,
+// identified by its source text
+func ExprKey(text string) Key {
+	return Key{kind: KeyExpression, str: text}
+}
+
+// Kind returns the kind of the key
+func (k Key) Kind() KeyKind {
+	return k.kind
+}
+
+// Str returns the string of a string key, or the source text of an
+// expression key
+func (k Key) Str() string {
+	return k.str
+}
+
+// Int returns the value of an integer key
+func (k Key) Int() int64 {
+	return k.i
+}
+
+// IsName reports whether the key is a string that can be written as a
+// plain identifier (name = value, T.name)
+func (k Key) IsName() bool {
+	return k.kind == KeyString && IsName(k.str)
+}
+
+// Source returns the key as written in a table constructor field:
+// name for identifiers, otherwise a bracketed literal ([12], ["my key"])
+func (k Key) Source() string {
+	if k.IsName() {
+		return k.str
+	}
+	return "[" + k.literal() + "]"
+}
+
+// Index returns the key as written after an expression to index it:
+// .name for identifiers, otherwise a bracketed literal
+func (k Key) Index() string {
+	if k.IsName() {
+		return "." + k.str
+	}
+	return "[" + k.literal() + "]"
+}
+
+// String returns the key in Lua notation, as used in paths and messages
+func (k Key) String() string {
+	return k.Source()
+}
+
+// literal returns the key as a Lua expression
+func (k Key) literal() string {
+	switch k.kind {
+	case KeyString:
+		return QuoteString(k.str, '"')
+	case KeyInteger:
+		return strconv.FormatInt(k.i, 10)
+	case KeyFloat:
+		switch {
+		case math.IsInf(k.f, 1):
+			return "math.huge"
+		case math.IsInf(k.f, -1):
+			return "-math.huge"
+		}
+		return strconv.FormatFloat(k.f, 'g', -1, 64)
+	case KeyBoolean:
+		return strconv.FormatBool(k.i != 0)
+	default:
+		return k.str
+	}
+}
+
+// ParseKey parses a single key in Lua notation, as used in paths and in the
+// rules of settings.json: name, [12], [1.5], ["my key"], [true].
+// Strings and numbers are read as in the given Lua version.
+// A bracketed expression that is not a literal ([SKID.SM_BASH]) is an
+// expression key, as in a parsed table. Anything else is taken as a plain
+// string key.
+func ParseKey(s string, version Version) Key {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return StringKey(s)
+	}
+
+	inner := s[1 : len(s)-1]
+	tokens, err := Tokenize(inner)
+	if err != nil || tokens[0].Kind == TokenEOF {
+		return StringKey(s)
+	}
+
+	key, n, err := literalKey(tokens, version)
+	if err != nil || tokens[n].Kind != TokenEOF {
+		return ExprKey(strings.TrimSpace(inner))
+	}
+	return key
+}
+
+// literalKey converts the literal at the start of tokens (a string, a
+// number with an optional minus sign, true or false) into a key.
+// It also returns the number of tokens used.
+func literalKey(tokens []Token, version Version) (Key, int, error) {
+	token := tokens[0]
+	switch {
+	case token.Kind == TokenString:
+		value, err := UnquoteString(token.Text, version)
+		if err != nil {
+			return Key{}, 0, err
+		}
+		return StringKey(value), 1, nil
+	case token.Kind == TokenNumber:
+		number, err := ParseNumber(token.Text, version)
+		if err != nil {
+			return Key{}, 0, err
+		}
+		return NumberKey(number), 1, nil
+	case token.Is("-") && tokens[1].Kind == TokenNumber:
+		number, err := ParseNumber(tokens[1].Text, version)
+		if err != nil {
+			return Key{}, 0, err
+		}
+		return NumberKey(number.Negate()), 2, nil
+	case token.Is("true"):
+		return BoolKey(true), 1, nil
+	case token.Is("false"):
+		return BoolKey(false), 1, nil
+	default:
+		return Key{}, 0, fmt.Errorf("unsupported key '%s'", token.Text)
+	}
+}
+
+// Key returns the key a literal value stands for when used as a table index
+func (v *Value) Key() (Key, error) {
+	switch v.Type {
+	case TypeString:
+		s, err := v.String()
+		if err != nil {
+			return Key{}, err
+		}
+		return StringKey(s), nil
+	case TypeNumber:
+		n, err := v.Number()
+		if err != nil {
+			return Key{}, err
+		}
+		return NumberKey(n), nil
+	case TypeBoolean:
+		b, err := v.Boolean()
+		if err != nil {
+			return Key{}, err
+		}
+		return BoolKey(b), nil
+	default:
+		return Key{}, fmt.Errorf("'%s' is not a string, number or boolean literal", v.Raw())
+	}
+}
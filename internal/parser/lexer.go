@@ -0,0 +1,259 @@
+package parser
+
+import (
+	"strings"
+)
+
+// TokenKind represents the lexical class of a Lua token
+type TokenKind int
+
+const (
+	TokenEOF TokenKind = iota
+	TokenName
+	TokenKeyword
+	TokenNumber
+	TokenString
+	TokenSymbol
+	TokenError
+)
+
+// Token is a lexical token with its byte offsets in the source.
+// Text is the exact source slice, so src[Start:End] == Text.
+type Token struct {
+	Kind  TokenKind
+	Text  string
+	Start int
+	End   int
+}
+
+// Is reports whether the token is the given symbol or keyword
+func (t Token) Is(text string) bool {
+	return (t.Kind == TokenSymbol || t.Kind == TokenKeyword) && t.Text == text
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+// symbols lists the Lua operators and punctuation, longest first.
+// The operators of later versions (//, bitwise operators, ::) are always
+// scanned; the grammar only accepts them for the version being parsed.
+var symbols = []string{
+	"...", "..", "==", "~=", "<=", ">=", "//", "<<", ">>", "::",
+	"+", "-", "*", "/", "%", "^", "#", "<", ">", "=", "&", "|", "~",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+// Tokenize splits Lua source into tokens, skipping whitespace and comments.
+// The returned slice always ends with a TokenEOF token.
+func Tokenize(src string) ([]Token, error) {
+	tokens, errs := tokenize(src, false)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return tokens, nil
+}
+
+// tokenize implements Tokenize. With tolerant set, a lexical error does not
+// stop the scan: the rest of the line becomes a TokenError token and the
+// error is returned along with the tokens.
+func tokenize(src string, tolerant bool) ([]Token, []*SyntaxError) {
+	var tokens []Token
+	var errs []*SyntaxError
+	pos := 0
+
+	for {
+		pos = skipTrivia(src, pos)
+		if pos >= len(src) {
+			tokens = append(tokens, Token{Kind: TokenEOF, Start: len(src), End: len(src)})
+			return tokens, errs
+		}
+
+		end, kind, err := scanToken(src, pos)
+		if err != nil {
+			errs = append(errs, err.(*SyntaxError))
+			if !tolerant {
+				return nil, errs
+			}
+
+			end = pos + 1
+			for end < len(src) && src[end] != '\n' {
+				end++
+			}
+			kind = TokenError
+		}
+
+		tokens = append(tokens, Token{Kind: kind, Text: src[pos:end], Start: pos, End: end})
+		pos = end
+	}
+}
+
+// skipTrivia advances past whitespace and comments
+func skipTrivia(src string, pos int) int {
+	for pos < len(src) {
+		c := src[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f':
+			pos++
+		case strings.HasPrefix(src[pos:], "--"):
+			pos += 2
+			if level, ok := longBracketLevel(src, pos); ok {
+				end := strings.Index(src[pos:], "]"+strings.Repeat("=", level)+"]")
+				if end == -1 {
+					return len(src)
+				}
+				pos += end + level + 2
+				continue
+			}
+			for pos < len(src) && src[pos] != '\n' {
+				pos++
+			}
+		case pos == 0 && strings.HasPrefix(src, "#"):
+			// Shebang line
+			for pos < len(src) && src[pos] != '\n' {
+				pos++
+			}
+		default:
+			return pos
+		}
+	}
+	return pos
+}
+
+// scanToken scans the token starting at pos and returns its end offset
+func scanToken(src string, pos int) (int, TokenKind, error) {
+	c := src[pos]
+
+	switch {
+	case isNameStart(c):
+		end := pos + 1
+		for end < len(src) && isNameChar(src[end]) {
+			end++
+		}
+		if keywords[src[pos:end]] {
+			return end, TokenKeyword, nil
+		}
+		return end, TokenName, nil
+
+	case isDigit(c) || (c == '.' && pos+1 < len(src) && isDigit(src[pos+1])):
+		return scanNumber(src, pos), TokenNumber, nil
+
+	case c == '"' || c == '\'':
+		end := pos + 1
+		for end < len(src) && src[end] != c {
+			if src[end] == '\\' {
+				end++
+				// An escaped \r\n or \n\r is one line break
+				if end+1 < len(src) && (src[end] == '\r' || src[end] == '\n') && (src[end+1] == '\r' || src[end+1] == '\n') && src[end+1] != src[end] {
+					end++
+				}
+			} else if src[end] == '\n' {
+				return 0, 0, newSyntaxError(src, pos, "unfinished string")
+			}
+			end++
+		}
+		if end >= len(src) {
+			return 0, 0, newSyntaxError(src, pos, "unfinished string")
+		}
+		return end + 1, TokenString, nil
+
+	case c == '[':
+		if level, ok := longBracketLevel(src, pos); ok {
+			close := "]" + strings.Repeat("=", level) + "]"
+			end := strings.Index(src[pos:], close)
+			if end == -1 {
+				return 0, 0, newSyntaxError(src, pos, "unfinished long string")
+			}
+			return pos + end + len(close), TokenString, nil
+		}
+	}
+
+	for _, sym := range symbols {
+		if strings.HasPrefix(src[pos:], sym) {
+			return pos + len(sym), TokenSymbol, nil
+		}
+	}
+
+	return 0, 0, newSyntaxError(src, pos, "unexpected symbol near '%c'", c)
+}
+
+// scanNumber returns the end offset of the numeric literal starting at pos.
+// Hexadecimal literals may have a fraction and a binary exponent (0x1.8p3).
+func scanNumber(src string, pos int) int {
+	end := pos
+	digit, exponent := isDigit, "eE"
+	if strings.HasPrefix(src[pos:], "0x") || strings.HasPrefix(src[pos:], "0X") {
+		end += 2
+		digit, exponent = isHexDigit, "pP"
+	}
+
+	for end < len(src) {
+		c := src[end]
+		if strings.IndexByte(exponent, c) >= 0 && end+1 < len(src) {
+			end++
+			if src[end] == '+' || src[end] == '-' {
+				end++
+			}
+		} else if digit(c) || c == '.' {
+			end++
+		} else {
+			break
+		}
+	}
+	return end
+}
+
+// longBracketLevel reports whether a long bracket ([[, [=[, ...) opens at pos
+// and returns its level (the number of '=' signs)
+func longBracketLevel(src string, pos int) (int, bool) {
+	if pos >= len(src) || src[pos] != '[' {
+		return 0, false
+	}
+	level := 0
+	for i := pos + 1; i < len(src); i++ {
+		switch src[i] {
+		case '=':
+			level++
+		case '[':
+			return level, true
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// IsName reports whether s is a valid Lua identifier that is not a keyword.
+// goto, a keyword from Lua 5.2 on, is not taken as a name either, so keys
+// written with IsName stay valid in every version.
+func IsName(s string) bool {
+	if s == "" || !isNameStart(s[0]) || keywords[s] || s == "goto" {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isNameStart(c) || isDigit(c)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
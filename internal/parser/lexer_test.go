@@ -0,0 +1,50 @@
+package parser
+
+import "testing"
+
+func TestTokenizeStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   string // the text of the string token, or the error
+	}{
+		{"escaped LF", "\"a\\\nb\" x", "\"a\\\nb\""},
+		{"escaped CRLF", "\"a\\\r\nb\" x", "\"a\\\r\nb\""},
+		{"escaped LFCR", "'a\\\n\rb' x", "'a\\\n\rb'"},
+		{"escaped CR", "\"a\\\rb\" x", "\"a\\\rb\""},
+		{"escaped CRLF at the end", "\"a\\\r\n\" x", "\"a\\\r\n\""},
+		{"two escaped LF", "\"a\\\n\\\nb\" x", "\"a\\\n\\\nb\""},
+		{"escaped LF then LF", "\"a\\\n\nb\" x", "1:1: unfinished string"},
+		{"CRLF", "\"a\r\nb\" x", "1:1: unfinished string"},
+	}
+
+	for _, tt := range tests {
+		tokens, errs := tokenize(tt.source, false)
+		got := ""
+		if len(errs) > 0 {
+			got = errs[0].Error()
+		} else if len(tokens) > 0 && tokens[0].Kind == TokenString {
+			got = tokens[0].Text
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseEscapedLineBreaks(t *testing.T) {
+	file, err := ParseFile("test.lua", "T = {\r\n\ta = \"x\\\r\ny\",\r\n\tb = 'x\\\n\ry',\r\n}\r\n", Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := file.FindTable(Path{StringKey("T")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		value, _ := table.Get(StringKey(key))
+		if got, err := value.String(); err != nil || got != "x\ny" {
+			t.Errorf("%s: got %q (%v), want %q", key, got, err, "x\ny")
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package parser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// UnquoteString decodes a Lua string literal in any quoting style
+// ('...', "..." or [==[ ... ]==]) into its raw bytes.
+// All escape sequences of Lua 5.1 are supported; \x, \z and \u{...} are
+// decoded from Lua 5.3. Lua 5.1 keeps the letter of these escapes, like
+// that of any unknown escape ("\x41" is "x41").
+func UnquoteString(literal string, version Version) (string, error) {
+	if level, ok := longBracketLevel(literal, 0); ok {
+		close := "]" + strings.Repeat("=", level) + "]"
+		if len(literal) < 2*len(close) || !strings.HasSuffix(literal, close) {
+			return "", fmt.Errorf("invalid long string literal: %s", literal)
+		}
+		body := literal[len(close) : len(literal)-len(close)]
+		return normalizeNewlines(skipFirstNewline(body)), nil
+	}
+
+	if len(literal) < 2 || (literal[0] != '"' && literal[0] != '\'') || literal[len(literal)-1] != literal[0] {
+		return "", fmt.Errorf("invalid string literal: %s", literal)
+	}
+
+	body := literal[1 : len(literal)-1]
+	var sb strings.Builder
+	sb.Grow(len(body))
+
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '\\' {
+			sb.WriteByte(c)
+			continue
+		}
+
+		i++
+		if i >= len(body) {
+			return "", fmt.Errorf("unfinished escape sequence in %s", literal)
+		}
+
+		e := body[i]
+		if (e == 'x' || e == 'z' || e == 'u') && version < Lua53 {
+			sb.WriteByte(e)
+			continue
+		}
+
+		switch e {
+		case 'a':
+			sb.WriteByte('\a')
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'v':
+			sb.WriteByte('\v')
+		case '\\', '"', '\'':
+			sb.WriteByte(e)
+		case '\n', '\r':
+			// Escaped line break: \<newline>, with \r\n and \n\r counting as one
+			sb.WriteByte('\n')
+			if i+1 < len(body) && (body[i+1] == '\n' || body[i+1] == '\r') && body[i+1] != e {
+				i++
+			}
+		case 'x':
+			if i+2 >= len(body) || !isHexDigit(body[i+1]) || !isHexDigit(body[i+2]) {
+				return "", fmt.Errorf("hexadecimal digit expected in %s", literal)
+			}
+			n, _ := strconv.ParseUint(body[i+1:i+3], 16, 8)
+			sb.WriteByte(byte(n))
+			i += 2
+		case 'z':
+			// Skip the following whitespace, including line breaks
+			for i+1 < len(body) && strings.IndexByte(" \t\r\n\v\f", body[i+1]) >= 0 {
+				i++
+			}
+		case 'u':
+			end := strings.IndexByte(body[i:], '}')
+			if i+1 >= len(body) || body[i+1] != '{' || end == -1 {
+				return "", fmt.Errorf("invalid unicode escape in %s", literal)
+			}
+			r, err := strconv.ParseUint(body[i+2:i+end], 16, 32)
+			if err != nil || r > utf8.MaxRune {
+				return "", fmt.Errorf("invalid unicode escape in %s", literal)
+			}
+			sb.WriteRune(rune(r))
+			i += end
+		default:
+			if !isDigit(e) {
+				// Lua 5.1 keeps the character of an unknown escape
+				sb.WriteByte(e)
+				continue
+			}
+			n := 0
+			j := i
+			for ; j < len(body) && j < i+3 && isDigit(body[j]); j++ {
+				n = n*10 + int(body[j]-'0')
+			}
+			if n > 255 {
+				return "", fmt.Errorf("decimal escape too large in %s", literal)
+			}
+			sb.WriteByte(byte(n))
+			i = j - 1
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// skipFirstNewline drops a line break right after an opening long bracket
+func skipFirstNewline(body string) string {
+	for _, prefix := range []string{"\r\n", "\n\r", "\n", "\r"} {
+		if strings.HasPrefix(body, prefix) {
+			return body[len(prefix):]
+		}
+	}
+	return body
+}
+
+// normalizeNewlines converts every line break sequence (\r\n, \n\r, \r)
+// to \n, as Lua does inside long strings
+func normalizeNewlines(body string) string {
+	if !strings.ContainsRune(body, '\r') {
+		return body
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c != '\n' && c != '\r' {
+			sb.WriteByte(c)
+			continue
+		}
+		sb.WriteByte('\n')
+		if i+1 < len(body) && (body[i+1] == '\n' || body[i+1] == '\r') && body[i+1] != c {
+			i++
+		}
+	}
+	return sb.String()
+}
+
+// QuoteString encodes raw bytes as a Lua string literal delimited by quote
+// (' or "). Backslashes, the delimiter and control bytes are escaped; bytes
+// from 0x80 up are written unchanged, so UTF-8 and legacy multi-byte
+// encodings pass through untouched.
+func QuoteString(value string, quote byte) string {
+	var sb strings.Builder
+	sb.Grow(len(value) + 2)
+	sb.WriteByte(quote)
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == quote || c == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == '\n':
+			sb.WriteString(`\n`)
+		case c == '\r':
+			sb.WriteString(`\r`)
+		case c == '\t':
+			sb.WriteString(`\t`)
+		case c < 0x20 || c == 0x7f:
+			// Always three digits, so a following digit cannot extend the escape
+			fmt.Fprintf(&sb, `\%03d`, c)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+
+	sb.WriteByte(quote)
+	return sb.String()
+}
+
+// QuoteLongString encodes a value as a long bracket string ([[...]]),
+// choosing the lowest level whose closing bracket does not occur in the value.
+// A leading line break is doubled because Lua drops the first one.
+func QuoteLongString(value string, minLevel int) string {
+	level := minLevel
+	for strings.Contains(value+"]", "]"+strings.Repeat("=", level)+"]") {
+		level++
+	}
+
+	eq := strings.Repeat("=", level)
+	if strings.HasPrefix(value, "\n") || strings.HasPrefix(value, "\r") {
+		value = "\n" + value
+	}
+	return "[" + eq + "[" + value + "]" + eq + "]"
+}
+
+// RequoteString encodes a value in the same style as an existing literal:
+// long strings stay long strings (when the value allows it) and quoted strings
+// keep their delimiter
+func RequoteString(value string, literal string) string {
+	if level, ok := longBracketLevel(literal, 0); ok && !strings.ContainsRune(value, '\r') {
+		return QuoteLongString(value, level)
+	}
+	if strings.HasPrefix(literal, "'") {
+		return QuoteString(value, '\'')
+	}
+	return QuoteString(value, '"')
+}
@@ -0,0 +1,152 @@
+package parser
+
+import "testing"
+
+func TestUnquoteString(t *testing.T) {
+	tests := []struct {
+		literal string
+		version Version
+		want    string
+		wantErr bool
+	}{
+		{literal: `"plain"`, want: "plain"},
+		{literal: `'single'`, want: "single"},
+		{literal: `"a\rb\nc\td"`, want: "a\rb\nc\td"},
+		{literal: `"\a\b\f\v"`, want: "\a\b\f\v"},
+		{literal: `"\0"`, want: "\x00"},
+		{literal: `"\0001"`, want: "\x001"},
+		{literal: `"\65\066\0677"`, want: "ABC7"},
+		{literal: `"\255"`, want: "\xff"},
+		{literal: `"\256"`, wantErr: true},
+		{literal: `"say \"hi\""`, want: `say "hi"`},
+		{literal: `'it\'s'`, want: "it's"},
+		{literal: `"it's"`, want: "it's"},
+		{literal: `"back\\slash"`, want: `back\slash`},
+		{literal: "\"line\\\nbreak\"", want: "line\nbreak"},
+		{literal: "\"line\\\r\nbreak\"", want: "line\nbreak"},
+		{literal: `"\q"`, want: "q"},
+		{literal: `"\x41"`, version: Lua53, want: "A"},
+		{literal: `"\x41"`, version: Lua51, want: "x41"},
+		{literal: `"\x41"`, version: Lua54, want: "A"},
+		{literal: `"\x4"`, version: Lua51, want: "x4"},
+		{literal: `"\x4"`, version: Lua53, wantErr: true},
+		{literal: "\"a\\z  \n  b\"", version: Lua54, want: "ab"},
+		{literal: "\"a\\z  \n  b\"", version: Lua53, want: "ab"},
+		{literal: "\"a\\z  b\"", version: Lua51, want: "az  b"},
+		{literal: `"\u{48}\u{e9}"`, version: Lua53, want: "Hé"},
+		{literal: `"\u{48}\u{e9}"`, version: Lua54, want: "Hé"},
+		{literal: `"\u{48}"`, version: Lua51, want: "u{48}"},
+		{literal: `"\u{110000}"`, version: Lua53, wantErr: true},
+		{literal: `"unfinished\"`, wantErr: true},
+		{literal: `"mismatched'`, wantErr: true},
+		{literal: `[[long]]`, want: "long"},
+		{literal: "[[\nfirst line dropped]]", want: "first line dropped"},
+		{literal: "[[\r\nfirst line dropped]]", want: "first line dropped"},
+		{literal: "[[a\r\nb\rc]]", want: "a\nb\nc"},
+		{literal: `[[no \n escapes]]`, want: `no \n escapes`},
+		{literal: `[=[a]]b]=]`, want: "a]]b"},
+		{literal: `[==[a]=]b]==]`, want: "a]=]b"},
+		{literal: `[==[a]=]`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := UnquoteString(tt.literal, tt.version)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("UnquoteString(%s, %s) = %q, want error", tt.literal, tt.version, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("UnquoteString(%s, %s): %v", tt.literal, tt.version, err)
+		} else if got != tt.want {
+			t.Errorf("UnquoteString(%s, %s) = %q, want %q", tt.literal, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteString(t *testing.T) {
+	tests := []struct {
+		value string
+		quote byte
+		want  string
+	}{
+		{"plain", '"', `"plain"`},
+		{"a\rb\nc\td", '"', `"a\rb\nc\td"`},
+		{"\x00", '"', `"\000"`},
+		{"\x001", '"', `"\0001"`},
+		{"\x01\x1f\x7f", '"', `"\001\031\127"`},
+		{`say "hi"`, '"', `"say \"hi\""`},
+		{`say "hi"`, '\'', `'say "hi"'`},
+		{"it's", '\'', `'it\'s'`},
+		{`back\slash`, '"', `"back\\slash"`},
+		{"\xb0\xa1 é", '"', "\"\xb0\xa1 é\""},
+	}
+
+	for _, tt := range tests {
+		got := QuoteString(tt.value, tt.quote)
+		if got != tt.want {
+			t.Errorf("QuoteString(%q, %c) = %s, want %s", tt.value, tt.quote, got, tt.want)
+		}
+		for _, version := range []Version{Lua51, Lua53} {
+			if back, err := UnquoteString(got, version); err != nil || back != tt.value {
+				t.Errorf("UnquoteString(%s, %s) = %q, %v, want %q", got, version, back, err, tt.value)
+			}
+		}
+	}
+}
+
+func TestQuoteLongString(t *testing.T) {
+	tests := []struct {
+		value    string
+		minLevel int
+		want     string
+	}{
+		{"long", 0, "[[long]]"},
+		{"", 0, "[[]]"},
+		{"long", 2, "[==[long]==]"},
+		{"a]]b", 0, "[=[a]]b]=]"},
+		{"a]", 0, "[=[a]]=]"},
+		{"]=]", 0, "[==[]=]]==]"},
+		{"a]]b]=]c", 0, "[==[a]]b]=]c]==]"},
+		{"a]]b", 1, "[=[a]]b]=]"},
+		{"a]=]b", 1, "[==[a]=]b]==]"},
+		{"\nleading", 0, "[[\n\nleading]]"},
+		{"multi\nline", 0, "[[multi\nline]]"},
+	}
+
+	for _, tt := range tests {
+		got := QuoteLongString(tt.value, tt.minLevel)
+		if got != tt.want {
+			t.Errorf("QuoteLongString(%q, %d) = %q, want %q", tt.value, tt.minLevel, got, tt.want)
+		}
+		if back, err := UnquoteString(got, Lua51); err != nil || back != tt.value {
+			t.Errorf("UnquoteString(%q) = %q, %v, want %q", got, back, err, tt.value)
+		}
+	}
+}
+
+func TestRequoteString(t *testing.T) {
+	tests := []struct {
+		value   string
+		literal string
+		want    string
+	}{
+		{"new", `"old"`, `"new"`},
+		{"it's", `'old'`, `'it\'s'`},
+		{"new", `[[old]]`, `[[new]]`},
+		{"new", `[==[old]==]`, `[==[new]==]`},
+		{"a]]b", `[[old]]`, `[=[a]]b]=]`},
+		{"a\rb", `[[old]]`, `"a\rb"`},
+	}
+
+	for _, tt := range tests {
+		got := RequoteString(tt.value, tt.literal)
+		if got != tt.want {
+			t.Errorf("RequoteString(%q, %s) = %s, want %s", tt.value, tt.literal, got, tt.want)
+		}
+		if back, err := UnquoteString(got, Lua51); err != nil || back != tt.value {
+			t.Errorf("UnquoteString(%s) = %q, %v, want %q", got, back, err, tt.value)
+		}
+	}
+}
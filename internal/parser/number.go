@@ -0,0 +1,128 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Number is a Lua number that remembers the literal it was written as.
+// Integers (decimal or hexadecimal literals without a fraction or exponent)
+// are kept exactly in Int, even beyond 2^53; everything else is a float.
+type Number struct {
+	Literal string
+	IsInt   bool
+	Int     int64
+	Float   float64
+}
+
+// ParseNumber parses a Lua numeric literal, optionally preceded by a minus
+// sign, as the given Lua version reads it
+func ParseNumber(literal string, version Version) (Number, error) {
+	text := strings.TrimSpace(literal)
+	negative := strings.HasPrefix(text, "-")
+	text = strings.TrimSpace(strings.TrimPrefix(text, "-"))
+
+	number := Number{Literal: literal}
+
+	hex := strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X")
+	if hex && strings.ContainsAny(text, ".pP") {
+		// Hexadecimal floats (0x1.8p3) need an exponent to be parsed
+		if !strings.ContainsAny(text, "pP") {
+			text += "p0"
+		}
+	} else if hex {
+		// From Lua 5.3, hexadecimal integers wrap around to their low 64
+		// bits. Lua 5.1 only has doubles, so the literals beyond the range
+		// of an int64 are floats.
+		u, err := strconv.ParseUint(text[2:], 16, 64)
+		if errors.Is(err, strconv.ErrRange) && version >= Lua53 {
+			u, err = strconv.ParseUint(text[len(text)-16:], 16, 64)
+		}
+		switch {
+		case err != nil && !errors.Is(err, strconv.ErrRange):
+			return Number{}, fmt.Errorf("invalid number '%s': %w", literal, err)
+		case err == nil && (u <= math.MaxInt64 || version >= Lua53):
+			number.IsInt = true
+			number.Int = int64(u)
+		default:
+			text += "p0"
+		}
+	} else if !strings.ContainsAny(text, ".eE") {
+		i, err := strconv.ParseInt(text, 10, 64)
+		if err == nil {
+			number.IsInt = true
+			number.Int = i
+		}
+	}
+
+	if number.IsInt {
+		if negative {
+			number.Int = -number.Int
+		}
+		number.Float = float64(number.Int)
+		return number, nil
+	}
+
+	// Out of range literals become ±Inf, as in Lua
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return Number{}, fmt.Errorf("invalid number '%s': %w", literal, err)
+	}
+	if negative {
+		f = -f
+	}
+	number.Float = f
+	return number, nil
+}
+
+// Negate returns the number with its sign flipped and no literal
+func (n Number) Negate() Number {
+	return Number{IsInt: n.IsInt, Int: -n.Int, Float: -n.Float}
+}
+
+// IntNumber returns the Number for an integer
+func IntNumber(i int64) Number {
+	return Number{IsInt: true, Int: i, Float: float64(i)}
+}
+
+// FloatNumber returns the Number for a float, stored as an integer when it
+// has no fractional part and fits in an int64
+func FloatNumber(f float64) Number {
+	if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+		return Number{IsInt: true, Int: int64(f), Float: f}
+	}
+	return Number{Float: f}
+}
+
+// String returns the original literal when there is one, otherwise the
+// shortest literal that reads back as the same number
+func (n Number) String() string {
+	if n.Literal != "" {
+		return n.Literal
+	}
+	if n.IsInt {
+		return strconv.FormatInt(n.Int, 10)
+	}
+
+	switch {
+	case math.IsInf(n.Float, 1):
+		return "math.huge"
+	case math.IsInf(n.Float, -1):
+		return "-math.huge"
+	case math.IsNaN(n.Float):
+		return "(0/0)"
+	}
+	return strconv.FormatFloat(n.Float, 'g', -1, 64)
+}
+
+// Equal reports whether two numbers have the same value, regardless of
+// how they were written
+func (n Number) Equal(other Number) bool {
+	if n.IsInt && other.IsInt {
+		return n.Int == other.Int
+	}
+	return n.Float == other.Float
+}
@@ -0,0 +1,65 @@
+package parser
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseNumber(t *testing.T) {
+	tests := []struct {
+		literal string
+		version Version
+		isInt   bool
+		i       int64
+		f       float64
+	}{
+		{literal: "42", isInt: true, i: 42},
+		{literal: "-42", isInt: true, i: -42},
+		{literal: "1.5", f: 1.5},
+		{literal: "1e3", f: 1000},
+		{literal: "9223372036854775808", f: 9223372036854775808},
+		{literal: "0x10", isInt: true, i: 16},
+		{literal: "0x1.8p3", f: 12},
+		{literal: "0x7FFFFFFFFFFFFFFF", isInt: true, i: math.MaxInt64},
+		{literal: "0xFFFFFFFFFFFFFFFF", version: Lua51, f: 18446744073709551615},
+		{literal: "0xFFFFFFFFFFFFFFFF", version: Lua53, isInt: true, i: -1},
+		{literal: "0x8000000000000000", version: Lua51, f: 9223372036854775808},
+		{literal: "0x8000000000000000", version: Lua54, isInt: true, i: math.MinInt64},
+		{literal: "0x10000000000000001", version: Lua51, f: 18446744073709551616},
+		{literal: "0x10000000000000001", version: Lua53, isInt: true, i: 1},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseNumber(tt.literal, tt.version)
+		if err != nil {
+			t.Errorf("ParseNumber(%s, %s): %v", tt.literal, tt.version, err)
+			continue
+		}
+		if got.IsInt != tt.isInt || (tt.isInt && got.Int != tt.i) || (!tt.isInt && got.Float != tt.f) {
+			t.Errorf("ParseNumber(%s, %s) = %+v, want int %v %d, float %g", tt.literal, tt.version, got, tt.isInt, tt.i, tt.f)
+		}
+		if got.Literal != tt.literal {
+			t.Errorf("ParseNumber(%s, %s) keeps literal %q", tt.literal, tt.version, got.Literal)
+		}
+	}
+
+	if _, err := ParseNumber("0xZZ", Lua51); err == nil {
+		t.Error("ParseNumber(0xZZ) succeeded")
+	}
+}
+
+func TestNumberStringRoundTrip(t *testing.T) {
+	floats := []float64{1.0 / 3, 0.1 + 0.2, -2.5, 1e300, 5e-324, 1 << 63, 123456789.123456789}
+
+	for _, f := range floats {
+		n := FloatNumber(f)
+		got, err := ParseNumber(n.String(), Lua51)
+		if err != nil {
+			t.Errorf("ParseNumber(%s): %v", n, err)
+			continue
+		}
+		if got.Float != f {
+			t.Errorf("%v is written as %s, which reads back as %v", f, n, got.Float)
+		}
+	}
+}
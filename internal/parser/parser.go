@@ -3,152 +3,442 @@ package parser
 import (
 	"fmt"
 	"io"
-	"strconv"
-	"strings"
-
-	"github.com/yuin/gopher-lua/ast"
-	"github.com/yuin/gopher-lua/parse"
 )
 
 // Parse parses a Lua file and extracts a specific table by name.
+// The name can be a dotted/bracketed path (see ParsePath) that points
+// either to an assignment target or to a sub-table inside a constructor.
 // Returns the parsed Table structure or an error if parsing fails.
 func Parse(
 	reader io.Reader,
 	sourceName string,
 	tableName string,
 ) (*Table, error) {
-	chunk, err := parse.Parse(reader, sourceName)
+	path, err := ParsePath(tableName, Lua51)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := io.ReadAll(reader)
 	if err != nil {
 		return nil, fmt.Errorf("parser.Parse: %w", err)
 	}
 
-	tableNode, err := findTable(chunk, tableName)
+	file, err := ParseFile(sourceName, string(data), Lua51)
+	if err != nil {
+		return nil, fmt.Errorf("parser.Parse: %w", err)
+	}
+
+	return file.FindTable(path)
+}
+
+// FindTable extracts the table at the given path from the file.
+// When the table is defined more than once, the last definition wins, as it
+// does when the file runs (see FindDefinitions).
+// The returned table keeps references to the syntax tree, so its changes
+// can later be written back with Table.Edits.
+func (f *File) FindTable(path Path) (*Table, error) {
+	definitions, err := f.FindDefinitions(path)
 	if err != nil {
 		return nil, err
 	}
+	return definitions[len(definitions)-1], nil
+}
 
-	return parseTable(tableNode)
+// FindDefinitions returns every definition of the table at the given path,
+// in the order they appear in the file. A definition is a table constructor
+// assigned to the path or to one of its parents; assignments of any other
+// value are not definitions. At least one definition is always returned.
+// An evaluated file (see EvalFile) has a single definition: the table found
+// at the path when the file has run. When the includes of the file are
+// resolved, the definitions in the included files count as well.
+func (f *File) FindDefinitions(path Path) ([]*Table, error) {
+	if f.env != nil {
+		return f.evalDefinitions(path)
+	}
+
+	units := f.units()
+	for _, u := range units {
+		u.file.scope = f
+	}
+
+	if path.IsReturn() {
+		return f.findReturnedTable(units)
+	}
+	return f.findTable(units, path)
+}
+
+// FinalReturn returns the return statement that ends the main chunk
+func (f *File) FinalReturn() (*ReturnStmt, bool) {
+	if len(f.Chunk) == 0 {
+		return nil, false
+	}
+	stmt, ok := f.Chunk[len(f.Chunk)-1].(*ReturnStmt)
+	return stmt, ok
+}
+
+// findReturnedTable resolves the table returned by the main chunk, either
+// as a constructor (return { ... }) or as a name (local t = { ... } return t)
+func (f *File) findReturnedTable(units []unit) ([]*Table, error) {
+	for i := len(units) - 1; i >= 0; i-- {
+		returnStmt, ok := units[i].stmt.(*ReturnStmt)
+		if !ok || units[i].file != f || len(returnStmt.Values) == 0 {
+			continue
+		}
+
+		switch v := returnStmt.Values[0].(type) {
+		case *TableExpr:
+			table, err := parseTable(f, v)
+			if err != nil {
+				return nil, err
+			}
+			return []*Table{table}, nil
+		case *NameExpr:
+			return f.findTable(units[:i], Path{StringKey(v.Name)})
+		default:
+			return nil, f.errorf(v, "unsupported returned value: %s", f.Text(v))
+		}
+	}
+	return nil, fmt.Errorf("parser.findReturnedTable: no returned table was found in %s", f.Name)
+}
+
+// assignment is a single target = value pair of a statement.
+// index is the target expression when it is a field (T.key or T[key]).
+type assignment struct {
+	target Path
+	index  *IndexExpr
+	value  Expr
+	local  bool
+}
+
+// assignments splits an assignment or local declaration into its
+// target = value pairs. Targets without a value, and values without a
+// target, are left out.
+func (f *File) assignments(stmt Stmt) []assignment {
+	var pairs []assignment
+
+	switch s := stmt.(type) {
+	case *AssignStmt:
+		for i, target := range s.Targets[:min(len(s.Targets), len(s.Values))] {
+			path, _ := f.exprPath(target)
+			index, _ := target.(*IndexExpr)
+			pairs = append(pairs, assignment{target: path, index: index, value: s.Values[i]})
+		}
+	case *LocalStmt:
+		for i, name := range s.Names[:min(len(s.Names), len(s.Values))] {
+			pairs = append(pairs, assignment{target: Path{StringKey(name.Text)}, value: s.Values[i], local: true})
+		}
+	}
+	return pairs
+}
+
+// findTable searches the statements for the definitions of the table at the
+// given path. Both global assignments (Name = {...}, A.B = {...}, A, B = ...)
+// and local declarations (local Name = {...}) are recognized. When a
+// statement assigns a prefix of the path, the remaining keys are looked up
+// inside its table constructor. The statements that follow a definition,
+// up to the next one, are folded into it (see fold).
+// The local declarations of included files are not visible to the file.
+func (f *File) findTable(units []unit, path Path) ([]*Table, error) {
+	var definitions []*Table
+	var starts []int
+	local := false
+
+	for i, u := range units {
+		for _, a := range u.file.assignments(u.stmt) {
+			if a.local && u.file != f {
+				continue
+			}
+			if a.local && a.target[0] == path[0] {
+				local = true
+			}
+
+			tableNode, ok := a.value.(*TableExpr)
+			if a.target == nil || !ok || !path.HasPrefix(a.target) {
+				continue
+			}
+
+			table, err := parseTable(u.file, tableNode)
+			if err != nil {
+				return nil, err
+			}
+
+			table, ok = descend(table, path[len(a.target):])
+			if !ok {
+				continue
+			}
+
+			// Only the declared table itself carries the local keyword; a
+			// later assignment to a local name keeps it local
+			table.local = local && len(a.target) == len(path)
+			definitions = append(definitions, table)
+			starts = append(starts, i+1)
+		}
+	}
+
+	if len(definitions) == 0 {
+		return nil, fmt.Errorf("parser.findTable: table '%s' was not found in %s", path, f.Name)
+	}
+
+	for i, table := range definitions {
+		end := len(units)
+		if i+1 < len(definitions) {
+			end = max(starts[i+1]-1, starts[i])
+		}
+		if err := fold(table, path, units[starts[i]:end]); err != nil {
+			return nil, err
+		}
+	}
+	return definitions, nil
 }
 
-// findTable searches for a table assignment in the AST by name
-func findTable(chunk []ast.Stmt, tableName string) (*ast.TableExpr, error) {
-	for _, stmt := range chunk {
-		if assignStmt, ok := stmt.(*ast.AssignStmt); ok {
-			ident, ok := assignStmt.Lhs[0].(*ast.IdentExpr)
-			if ok && ident.Value == tableName {
-				if tableNode, ok := assignStmt.Rhs[0].(*ast.TableExpr); ok {
-					return tableNode, nil
-				}
+// fold applies the field assignments that follow a table definition to the
+// table, the way they would change it at run time: T.key = value and
+// T[key] = value set an entry, and longer targets (T[501].name = value) set
+// an entry of a nested table. Assignments into entries that do not hold a
+// table are left out.
+func fold(table *Table, path Path, units []unit) error {
+	for _, u := range units {
+		for _, a := range u.file.assignments(u.stmt) {
+			if a.index == nil || len(a.target) <= len(path) || !a.target.HasPrefix(path) {
+				continue
+			}
+
+			parent, ok := descend(table, a.target[len(path):len(a.target)-1])
+			if !ok {
+				continue
+			}
+
+			value, err := parseValue(u.file, a.value)
+			if err != nil {
+				return err
+			}
+			parent.assign(a.target[len(a.target)-1], value, u.stmt, a.index)
+			if u.file != table.file {
+				table.spread = true
 			}
 		}
 	}
-	return nil, fmt.Errorf("parser.findTable: table '%s' was not found", tableName)
+	return nil
 }
 
-// parseTable converts an AST table expression into our Table structure
-func parseTable(node *ast.TableExpr) (*Table, error) {
+// descend follows the keys through nested tables
+func descend(table *Table, keys []Key) (*Table, bool) {
+	for _, key := range keys {
+		value, ok := table.Get(key)
+		if !ok {
+			return nil, false
+		}
+
+		sub, err := value.Table()
+		if err != nil {
+			return nil, false
+		}
+		table = sub
+	}
+	return table, true
+}
+
+// exprPath converts an assignment target (Name, A.B, A["b"], A[1]) into a Path
+func (f *File) exprPath(exp Expr) (Path, bool) {
+	switch v := exp.(type) {
+	case *NameExpr:
+		return Path{StringKey(v.Name)}, true
+	case *IndexExpr:
+		object, ok := f.exprPath(v.Object)
+		if !ok {
+			return nil, false
+		}
+
+		key, err := f.parseKey(v.Key, v.Dot)
+		if err != nil {
+			return nil, false
+		}
+		return append(object, key), true
+	default:
+		return nil, false
+	}
+}
+
+// parseTable converts a table constructor into our Table structure.
+// Entries keep the order of their first field. When a key is set by
+// several fields, the entry takes the value Lua stores last (see storeOrder),
+// so in { [1] = "a", "b" } the positional "b" wins, as it does in Lua.
+func parseTable(file *File, node *TableExpr) (*Table, error) {
 	table := NewTable()
-	for _, field := range node.Fields {
-		value, err := parseValue(field.Value)
+	table.file = file
+	table.node = node
+
+	order := storeOrder(node.Fields)
+	stored := make(map[Key]int, len(node.Fields))
+
+	for i, field := range node.Fields {
+		value, err := parseValue(file, field.Value)
 		if err != nil {
 			return nil, err
 		}
 
+		var key Key
 		if field.Key == nil {
-			table.AddOrReplace("", value)
+			table.currentIndex++
+			key = IntKey(int64(table.currentIndex))
 		} else {
-			key, err := parseKey(field.Key)
+			key, err = file.parseKey(field.Key, field.Named)
 			if err != nil {
-				return nil, fmt.Errorf("failed to convert AST key: %w", err)
+				return nil, err
 			}
-			table.AddOrReplace(key, value)
 		}
+
+		if previous, ok := stored[key]; ok && previous > order[i] {
+			continue
+		}
+		stored[key] = order[i]
+
+		entry := table.add(key, value, field)
+		entry.positional = field.Key == nil
+		entry.spelling = file.keySpelling(field.Key, field.Named)
 	}
 	return table, nil
 }
 
-// valueOf extracts the string value from an AST expression
-func valueOf(exp ast.Expr) (string, error) {
-	switch v := exp.(type) {
-	case *ast.IdentExpr:
-		return v.Value, nil
-	case *ast.StringExpr:
-		return v.Value, nil
-	case *ast.NumberExpr:
-		return v.Value, nil
-	default:
-		return "", fmt.Errorf("parser.valueOf: unsupported AST key type: %T", exp)
+// listFlush is the number of positional items a Lua 5.1 constructor
+// collects before storing them (LFIELDS_PER_FLUSH)
+const listFlush = 50
+
+// storeOrder returns, for each constructor field, when Lua stores its value.
+// Keyed fields are stored as they are evaluated, but positional items are
+// stored in batches: when a field starts after listFlush pending items, and
+// at the end of the constructor. A larger number means a later store.
+func storeOrder(fields []*Field) []int {
+	order := make([]int, len(fields))
+	var pending []int
+
+	flush := func(at int) {
+		for _, i := range pending {
+			order[i] = 2 * at
+		}
+		pending = pending[:0]
+	}
+
+	for i, field := range fields {
+		if len(pending) == listFlush {
+			flush(i)
+		}
+		if field.Key == nil {
+			pending = append(pending, i)
+		} else {
+			order[i] = 2*i + 1
+		}
 	}
+	flush(len(fields))
+
+	return order
 }
 
-// parseValue converts an AST value expression into our Value structure
-func parseValue(exp ast.Expr) (*Value, error) {
+// parseValue converts a value expression into our Value structure
+func parseValue(file *File, exp Expr) (*Value, error) {
+	value := &Value{file: file, expr: exp}
+
 	switch v := exp.(type) {
-	case *ast.NilExpr:
-		return &Value{Type: TypeNil, value: nil}, nil
-	case *ast.TrueExpr:
-		return &Value{Type: TypeBoolean, value: true}, nil
-	case *ast.FalseExpr:
-		return &Value{Type: TypeBoolean, value: false}, nil
-	case *ast.StringExpr:
-		return &Value{Type: TypeString, value: v.Value}, nil
-	case *ast.NumberExpr:
-		num, err := strconv.ParseFloat(v.Value, 64)
+	case *NilExpr:
+		value.Type = TypeNil
+	case *TrueExpr:
+		value.Type, value.value = TypeBoolean, true
+	case *FalseExpr:
+		value.Type, value.value = TypeBoolean, false
+	case *StringExpr:
+		str, err := UnquoteString(v.Token.Text, file.version)
 		if err != nil {
-			return nil, fmt.Errorf("failed to convert AST number '%s': %w", v.Value, err)
+			return nil, file.errorf(v, "%w", err)
 		}
-		return &Value{Type: TypeNumber, value: num}, nil
-	case *ast.TableExpr:
-		table, err := parseTable(v)
+		value.Type, value.value = TypeString, str
+	case *NumberExpr:
+		num, err := ParseNumber(v.Token.Text, file.version)
 		if err != nil {
-			return nil, err
+			return nil, file.errorf(v, "failed to convert AST number '%s': %w", v.Token.Text, err)
 		}
-		return &Value{Type: TypeTable, value: table}, nil
-	case *ast.FunctionExpr:
-		return &Value{Type: TypeFunction, value: "<function>"}, nil
-	case *ast.AttrGetExpr:
-		obj, err := valueOf(v.Object)
+		value.Type, value.value = TypeNumber, num
+	case *TableExpr:
+		table, err := parseTable(file, v)
 		if err != nil {
 			return nil, err
 		}
-		key, err := valueOf(v.Key)
-		if err != nil {
-			return nil, err
+		value.Type, value.value = TypeTable, table
+	case *FunctionExpr:
+		// The whole function, from the keyword to its end, is kept verbatim
+		value.Type, value.value = TypeFunction, file.Text(v)
+	case *IndexExpr:
+		// Variable references (A.B, A.B.C, A["b"]) are kept as written
+		value.Type, value.value = TypeVariable, file.Text(v)
+	case *NameExpr:
+		value.Type, value.value = TypeVariable, v.Name
+	case *UnaryExpr:
+		// Negative number literals are still numbers
+		if number, ok := v.Operand.(*NumberExpr); ok && v.Op == "-" {
+			num, err := ParseNumber(number.Token.Text, file.version)
+			if err != nil {
+				return nil, file.errorf(v, "failed to convert AST number '%s': %w", file.Text(v), err)
+			}
+			num = num.Negate()
+			num.Literal = file.Text(v)
+			value.Type, value.value = TypeNumber, num
+			break
 		}
-
-		str := fmt.Sprintf("%s.%s", obj, key)
-		return &Value{Type: TypeVariable, value: str}, nil
-	case *ast.IdentExpr:
-		return &Value{Type: TypeVariable, value: v.Value}, nil
+		value.Type, value.value = TypeExpression, file.Text(v)
 	default:
-		return nil, fmt.Errorf("unsupported AST value type: %T", exp)
+		// Calls, arithmetic, concatenation, ... are carried as opaque source text
+		value.Type, value.value = TypeExpression, file.Text(v)
 	}
+
+	return value, nil
 }
 
-// parseKey converts an AST key expression into a string representation
-func parseKey(exp ast.Expr) (string, error) {
+// parseKey converts a key expression into a Key. name is set for the name
+// of a field (name = value, T.name), which is a string key.
+// Literals become typed keys, and so do the names of constants defined by
+// included files or constant files ([SKID.NV_BASIC], see ResolveIncludes
+// and UseConstants); anything else ([A.B], [f()]) is kept as an opaque
+// expression key.
+func (f *File) parseKey(exp Expr, name bool) (Key, error) {
 	switch v := exp.(type) {
-	case *ast.IdentExpr:
-		return v.Value, nil
-	case *ast.StringExpr:
-		if strings.Contains(v.Value, ".") {
-			return fmt.Sprintf("[\"%s\"]", v.Value), nil
-		}
-		return v.Value, nil
-	case *ast.NumberExpr:
-		return fmt.Sprintf("[%s]", v.Value), nil
-	case *ast.AttrGetExpr:
-		obj, err := valueOf(v.Object)
-		if err != nil {
-			return "", err
+	case *NameExpr:
+		if name {
+			return StringKey(v.Name), nil
+		}
+		if key, ok := f.constant(v); ok {
+			return key, nil
 		}
-		key, err := valueOf(v.Key)
+		return ExprKey(v.Name), nil
+	case *StringExpr, *NumberExpr, *TrueExpr, *FalseExpr, *UnaryExpr:
+		value, err := parseValue(f, exp)
 		if err != nil {
-			return "", err
+			return Key{}, err
 		}
-
-		return fmt.Sprintf("[%s.%s]", obj, key), nil
+		if key, err := value.Key(); err == nil {
+			return key, nil
+		}
+		return ExprKey(f.Text(exp)), nil
+	case *NilExpr:
+		return Key{}, f.errorf(v, "table index is nil")
+	case *IndexExpr:
+		if key, ok := f.constant(v); ok {
+			return key, nil
+		}
+		return ExprKey(f.Text(exp)), nil
 	default:
-		return "", fmt.Errorf("unsupported AST key type: %T", exp)
+		return ExprKey(f.Text(exp)), nil
+	}
+}
+
+// keySpelling returns the source text of a key that names a constant or a
+// variable ([SKID.NV_BASIC], [MAX]), so that it can be written back the same
+// way once resolved, or an empty string for any other key
+func (f *File) keySpelling(exp Expr, name bool) string {
+	switch exp.(type) {
+	case *NameExpr, *IndexExpr:
+		if !name {
+			return f.Text(exp)
+		}
 	}
+	return ""
 }
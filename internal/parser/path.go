@@ -0,0 +1,92 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ReturnTable is the reserved table name that refers to the table returned
+// by a module-style file (return { ... } or local t = { ... } return t).
+// Being a Lua keyword, it can never clash with a real table name.
+const ReturnTable = "return"
+
+// Path identifies a table by the chain of keys leading to it,
+// e.g. Client.Tables.Quest or tbl["sub.key"][3].
+type Path []Key
+
+// ParsePath parses a dotted/bracketed table path.
+// The first element must be an identifier; the following ones can be
+// .name, ["string"], [number] or [true]/[false], with strings and numbers
+// read as in the given Lua version. The reserved name ReturnTable is
+// accepted on its own.
+func ParsePath(s string, version Version) (Path, error) {
+	tokens, err := Tokenize(s)
+	if err != nil {
+		return nil, fmt.Errorf("parser.ParsePath: invalid path '%s': %w", s, err)
+	}
+
+	if tokens[0].Is(ReturnTable) {
+		if tokens[1].Kind != TokenEOF {
+			return nil, fmt.Errorf("parser.ParsePath: '%s' cannot be followed by keys", ReturnTable)
+		}
+		return Path{StringKey(ReturnTable)}, nil
+	}
+
+	if tokens[0].Kind != TokenName {
+		return nil, fmt.Errorf("parser.ParsePath: path '%s' must start with an identifier", s)
+	}
+
+	path := Path{StringKey(tokens[0].Text)}
+	for i := 1; tokens[i].Kind != TokenEOF; {
+		switch {
+		case tokens[i].Is(".") && tokens[i+1].Kind == TokenName:
+			path = append(path, StringKey(tokens[i+1].Text))
+			i += 2
+		case tokens[i].Is("["):
+			key, n, err := literalKey(tokens[i+1:], version)
+			if err != nil {
+				return nil, fmt.Errorf("parser.ParsePath: invalid path '%s': %w", s, err)
+			}
+			if !tokens[i+1+n].Is("]") {
+				return nil, fmt.Errorf("parser.ParsePath: unexpected '%s' in path '%s'", tokens[i+1+n].Text, s)
+			}
+			path = append(path, key)
+			i += n + 2
+		default:
+			return nil, fmt.Errorf("parser.ParsePath: unexpected '%s' in path '%s'", tokens[i].Text, s)
+		}
+	}
+
+	return path, nil
+}
+
+// IsReturn reports whether the path is the reserved ReturnTable name
+func (p Path) IsReturn() bool {
+	return len(p) == 1 && p[0] == StringKey(ReturnTable)
+}
+
+// HasPrefix reports whether the path starts with the given prefix
+func (p Path) HasPrefix(prefix Path) bool {
+	if len(prefix) > len(p) {
+		return false
+	}
+	for i := range prefix {
+		if p[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the path in Lua notation
+func (p Path) String() string {
+	var sb strings.Builder
+	for i, key := range p {
+		if i == 0 && key.IsName() {
+			sb.WriteString(key.Str())
+			continue
+		}
+		sb.WriteString(key.Index())
+	}
+	return sb.String()
+}
@@ -0,0 +1,280 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Node is a node of the concrete syntax tree.
+// Every node covers a contiguous byte range [Start, End) of its file, so the
+// tree together with File.Source reproduces the input byte-for-byte,
+// including comments and formatting.
+type Node interface {
+	Start() int
+	End() int
+}
+
+// Expr is an expression node
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// Stmt is a statement node
+type Stmt interface {
+	Node
+	stmtNode()
+}
+
+// span implements Node for the concrete node types
+type span struct {
+	start int
+	end   int
+}
+
+// Start returns the offset of the first byte of the node
+func (s span) Start() int { return s.start }
+
+// End returns the offset just past the last byte of the node
+func (s span) End() int { return s.end }
+
+func tokenSpan(token Token) span {
+	return span{token.Start, token.End}
+}
+
+// NilExpr is the nil literal
+type NilExpr struct{ span }
+
+// TrueExpr is the true literal
+type TrueExpr struct{ span }
+
+// FalseExpr is the false literal
+type FalseExpr struct{ span }
+
+// VarargExpr is the ... expression
+type VarargExpr struct{ span }
+
+// NumberExpr is a numeric literal
+type NumberExpr struct {
+	span
+	Token Token
+}
+
+// StringExpr is a string literal in any quoting style
+type StringExpr struct {
+	span
+	Token Token
+}
+
+// NameExpr is a reference to a variable
+type NameExpr struct {
+	span
+	Name string
+}
+
+// IndexExpr is a field access: Object.Key (Dot) or Object[Key]
+type IndexExpr struct {
+	span
+	Object Expr
+	Key    Expr
+	Dot    bool
+}
+
+// CallExpr is a function or method call
+type CallExpr struct {
+	span
+	Func   Expr
+	Method string
+	Args   []Expr
+}
+
+// FunctionExpr is an anonymous function; its body is kept as source text only
+type FunctionExpr struct{ span }
+
+// ParenExpr is a parenthesized expression
+type ParenExpr struct {
+	span
+	Inner Expr
+}
+
+// UnaryExpr is a unary operation (not, -, #)
+type UnaryExpr struct {
+	span
+	Op      string
+	Operand Expr
+}
+
+// BinaryExpr is a binary operation
+type BinaryExpr struct {
+	span
+	Left  Expr
+	Op    string
+	Right Expr
+}
+
+// TableExpr is a table constructor
+type TableExpr struct {
+	span
+	Open   Token
+	Close  Token
+	Fields []*Field
+}
+
+// Field is an entry of a table constructor.
+// Key is nil for positional entries; Named is set for name = value entries.
+// Sep is the trailing ',' or ';' separator, or nil when there is none.
+type Field struct {
+	span
+	Key   Expr
+	Named bool
+	Value Expr
+	Sep   *Token
+}
+
+// AssignStmt is an assignment: Targets = Values
+type AssignStmt struct {
+	span
+	Targets []Expr
+	Values  []Expr
+}
+
+// LocalStmt is a local declaration: local Names = Values
+type LocalStmt struct {
+	span
+	Names  []Token
+	Values []Expr
+}
+
+// ReturnStmt is a return statement
+type ReturnStmt struct {
+	span
+	Values []Expr
+}
+
+// CallStmt is a function call used as a statement
+type CallStmt struct {
+	span
+	Call *CallExpr
+}
+
+// BlockStmt is any other statement (function definitions, control flow, ...).
+// Its contents are validated but only kept as source text.
+type BlockStmt struct {
+	span
+	Keyword string
+}
+
+func (*NilExpr) exprNode()      {}
+func (*TrueExpr) exprNode()     {}
+func (*FalseExpr) exprNode()    {}
+func (*VarargExpr) exprNode()   {}
+func (*NumberExpr) exprNode()   {}
+func (*StringExpr) exprNode()   {}
+func (*NameExpr) exprNode()     {}
+func (*IndexExpr) exprNode()    {}
+func (*CallExpr) exprNode()     {}
+func (*FunctionExpr) exprNode() {}
+func (*ParenExpr) exprNode()    {}
+func (*UnaryExpr) exprNode()    {}
+func (*BinaryExpr) exprNode()   {}
+func (*TableExpr) exprNode()    {}
+
+// BadStmt is a region of the main chunk that could not be parsed in
+// recover mode (see ParseFileRecover). It is only kept as source text.
+type BadStmt struct{ span }
+
+func (*AssignStmt) stmtNode() {}
+func (*LocalStmt) stmtNode()  {}
+func (*ReturnStmt) stmtNode() {}
+func (*CallStmt) stmtNode()   {}
+func (*BlockStmt) stmtNode()  {}
+func (*BadStmt) stmtNode()    {}
+
+// File is a parsed Lua source file.
+// Errors lists the syntax errors of the BadStmt regions of a file parsed
+// in recover mode.
+type File struct {
+	Name   string
+	Source string
+	Chunk  []Stmt
+	Errors []error
+
+	// version is the grammar the file was parsed with
+	version Version
+
+	// lines holds the offset of the first byte of each line, built on demand
+	lines []int
+
+	// env holds the state left by running the file, for files read by
+	// EvalFile; such files have no Chunk
+	env *environment
+
+	// included maps the include calls of the file to the files they load,
+	// once resolved (see ResolveIncludes), and constantFiles are the files
+	// set by UseConstants. constants caches the constants of the file, its
+	// includes and its constant files, and scope is the file whose
+	// constants resolve the keys of this one during a lookup.
+	included      map[*CallStmt]*File
+	constantFiles []*File
+	constants     map[string]Key
+	scope         *File
+}
+
+// Text returns the exact source text of a node
+func (f *File) Text(n Node) string {
+	return f.Source[n.Start():n.End()]
+}
+
+// Position is the location of a node in its source file.
+// Line and Column are 1-based (columns count bytes); Start and End are the
+// byte span of the node.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+	Start  int
+	End    int
+}
+
+// IsValid reports whether the position refers to a source file
+func (p Position) IsValid() bool {
+	return p.Line > 0
+}
+
+// String returns the position as file:line:column, or only the file name
+// (possibly empty) for an invalid position
+func (p Position) String() string {
+	if !p.IsValid() {
+		return p.File
+	}
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// Pos returns the position of a node
+func (f *File) Pos(n Node) Position {
+	if f.lines == nil {
+		f.lines = append(f.lines, 0)
+		for i := 0; i < len(f.Source); i++ {
+			if f.Source[i] == '\n' {
+				f.lines = append(f.lines, i+1)
+			}
+		}
+	}
+
+	line := sort.SearchInts(f.lines, n.Start()+1)
+	return Position{
+		File:   f.Name,
+		Line:   line,
+		Column: n.Start() - f.lines[line-1] + 1,
+		Start:  n.Start(),
+		End:    n.End(),
+	}
+}
+
+// errorf returns an error prefixed with the position of a node
+func (f *File) errorf(n Node, format string, args ...any) error {
+	return fmt.Errorf("%s: "+format, append([]any{f.Pos(n)}, args...)...)
+}
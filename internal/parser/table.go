@@ -4,8 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"iter"
-	"strconv"
-	"strings"
+	"slices"
 )
 
 // Type represents the type of a Lua value
@@ -19,61 +18,257 @@ const (
 	TypeTable
 	TypeFunction
 	TypeVariable
+	TypeExpression
 )
 
-// Table represents a Lua table with named or indexed values
+// String returns the Lua name of the type
+func (t Type) String() string {
+	switch t {
+	case TypeNil:
+		return "nil"
+	case TypeBoolean:
+		return "boolean"
+	case TypeNumber:
+		return "number"
+	case TypeString:
+		return "string"
+	case TypeTable:
+		return "table"
+	case TypeFunction:
+		return "function"
+	case TypeVariable:
+		return "variable"
+	case TypeExpression:
+		return "expression"
+	default:
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+}
+
+// Table represents a Lua table with named or indexed values.
+// Tables parsed from a file keep a reference to their constructor so that
+// only the entries changed by a merge need to be rewritten (see Edits).
+// Entries assigned by statements after the constructor (T[501] = {...})
+// keep a reference to their statement; tail is the last such statement.
+// currentIndex is the number of positional fields in the constructor.
+// spread is set when statements of another file were folded into the table.
+// removed holds the entries deleted by a merge, whose source text goes.
+// skipped describes the entries of an evaluated table that were left out.
 type Table struct {
 	values       []*NamedValue
-	index        map[string]int
+	index        map[Key]int
 	currentIndex int
+	local        bool
+	file         *File
+	node         *TableExpr
+	tail         *IndexExpr
+	tailStmt     Stmt
+	spread       bool
+	removed      []*NamedValue
+	skipped      []string
 }
 
 // NewTable creates a new empty Table
 func NewTable() *Table {
 	return &Table{
-		index: make(map[string]int),
+		index: make(map[Key]int),
+	}
+}
+
+// Local reports whether the table was declared with the local keyword
+func (t *Table) Local() bool {
+	return t.local
+}
+
+// InFile reports whether the table, and every statement folded into it,
+// comes from the given file, so that its Edits apply to the file's source.
+// Tables found through included files may not.
+func (t *Table) InFile(f *File) bool {
+	return t.file == f && !t.spread
+}
+
+// Pos returns the position of the table constructor, or an invalid
+// Position for tables that were not parsed from a file. Tables of an
+// evaluated file get a Position with only the file name.
+func (t *Table) Pos() Position {
+	if t.node == nil {
+		if t.file != nil {
+			return Position{File: t.file.Name}
+		}
+		return Position{}
 	}
+	return t.file.Pos(t.node)
 }
 
 // AddOrReplace adds a new value to the table or replaces an existing one
-func (t *Table) AddOrReplace(name string, value *Value) {
-	if current, ok := t.Get(name); ok {
-		current.value = value
+func (t *Table) AddOrReplace(key Key, value *Value) {
+	if current, ok := t.entry(key); ok {
+		// Statements that extended the old value would still apply to
+		// the new one when the file runs, so they have to go
+		if old, err := current.Value.Table(); err == nil && old.file == t.file {
+			current.dropped = append(current.dropped, old.statements()...)
+		}
+		current.Value = value
+		current.replaced = true
 		return
 	}
 
-	if name == "" {
-		t.currentIndex++
-		name = fmt.Sprintf("[%d]", t.currentIndex)
+	t.add(key, value, nil)
+}
+
+// AddOrReplaceEntry adds the key and value of an entry of another table,
+// or replaces the value of the entry with the same key. An added entry
+// keeps the spelling of its key in the other table ([SKID.NV_BASIC]
+// rather than [5]).
+func (t *Table) AddOrReplaceEntry(entry *NamedValue) {
+	_, exists := t.entry(entry.Key)
+	t.AddOrReplace(entry.Key, entry.Value)
+	if !exists {
+		added, _ := t.entry(entry.Key)
+		added.spelling = entry.spelling
+	}
+}
+
+// InsertEntry adds the key and value of an entry of another table at the
+// given position among the entries (see Range), keeping the spelling of its
+// key like AddOrReplaceEntry. When the key is already present, its value is
+// replaced where it is.
+func (t *Table) InsertEntry(at int, entry *NamedValue) {
+	if _, exists := t.entry(entry.Key); exists {
+		t.AddOrReplace(entry.Key, entry.Value)
+		return
 	}
 
-	t.values = append(t.values, &NamedValue{name, value})
-	t.index[name] = len(t.values) - 1
+	at = max(0, min(at, len(t.values)))
+	added := &NamedValue{Key: entry.Key, Value: entry.Value, spelling: entry.spelling}
+	t.values = slices.Insert(t.values, at, added)
+	t.reindex(at)
 }
 
-// Get retrieves a value from the table by key
-func (t *Table) Get(key string) (*Value, bool) {
-	// First try to find by exact key match
+// Delete removes the entry with the given key and returns it. The entries
+// that follow it move up one position. Edits remove its field, or the
+// statements that set it, from the source.
+func (t *Table) Delete(key Key) (*NamedValue, bool) {
 	index, ok := t.index[key]
-	if ok && index < len(t.values) {
-		return t.values[index].Value, true
+	if !ok {
+		return nil, false
+	}
+
+	entry := t.values[index]
+	t.values = slices.Delete(t.values, index, index+1)
+	delete(t.index, key)
+	t.reindex(index)
+
+	t.removed = append(t.removed, entry)
+	return entry, true
+}
+
+// reindex updates the index of the entries from the given position on
+func (t *Table) reindex(from int) {
+	for i := from; i < len(t.values); i++ {
+		t.index[t.values[i].Key] = i
+	}
+}
+
+// add appends an entry parsed from the given constructor field.
+// A repeated key keeps its position but takes the later definition, as in Lua.
+func (t *Table) add(key Key, value *Value, field *Field) *NamedValue {
+	if current, ok := t.entry(key); ok {
+		current.Value = value
+		current.field = field
+		return current
+	}
+
+	entry := &NamedValue{Key: key, Value: value, field: field}
+	t.values = append(t.values, entry)
+	t.index[key] = len(t.values) - 1
+	return entry
+}
+
+// assign sets an entry from a statement that follows the table constructor
+// (T.key = value or T[key] = value). The statement is described as a field
+// spanning from target to value, so the entry can be rewritten in place.
+func (t *Table) assign(key Key, value *Value, stmt Stmt, target *IndexExpr) {
+	entry, ok := t.entry(key)
+	if !ok {
+		entry = t.add(key, value, nil)
+		entry.spelling = value.file.keySpelling(target.Key, target.Dot)
 	}
 
-	// If not found and the key looks numeric, try to access by index
-	// Remove brackets if present (e.g., "[123]" becomes "123")
-	trimmedKey := strings.TrimPrefix(strings.TrimSuffix(key, "]"), "[")
-	numIndex, err := strconv.Atoi(trimmedKey)
+	entry.Value = value
+	entry.positional = false
+	entry.stmt = stmt
+	entry.assigned = &Field{
+		span:  span{target.Start(), value.expr.End()},
+		Key:   target.Key,
+		Named: target.Dot,
+		Value: value.expr,
+	}
+	t.tail, t.tailStmt = target, stmt
+}
+
+// statements returns the statements that extended the table or its
+// nested tables after their constructors
+func (t *Table) statements() []Stmt {
+	var stmts []Stmt
+	for _, entry := range t.values {
+		if entry.stmt != nil {
+			stmts = append(stmts, entry.stmt)
+		}
+		stmts = append(stmts, entry.dropped...)
+		if sub, err := entry.Value.Table(); err == nil && sub.file == t.file {
+			stmts = append(stmts, sub.statements()...)
+		}
+	}
+	return stmts
+}
+
+// ResolveKey returns the literal key that an expression key stands for in
+// the table, when it names a constant of the table's file ([SKID.NV_BASIC]
+// is 5 once SKID.NV_BASIC = 5 is known, see UseConstants). Any other key is
+// returned as is.
+func (t *Table) ResolveKey(key Key) Key {
+	if key.kind != KeyExpression || t.file == nil {
+		return key
+	}
+
+	scope := t.file.constantScope()
+	if scope == nil {
+		return key
+	}
+	path, err := ParsePath(key.str, t.file.version)
 	if err != nil {
+		return key
+	}
+	if resolved, ok := scope.constantAt(path); ok {
+		return resolved
+	}
+	return key
+}
+
+// Get retrieves a value from the table by key
+func (t *Table) Get(key Key) (*Value, bool) {
+	entry, ok := t.entry(key)
+	if !ok {
 		return nil, false
 	}
+	return entry.Value, true
+}
 
-	// Search for the formatted index key
-	formattedKey := fmt.Sprintf("[%d]", numIndex)
-	if idx, ok := t.index[formattedKey]; ok && idx < len(t.values) {
-		return t.values[idx].Value, true
+// entry retrieves a table entry by key
+func (t *Table) entry(key Key) (*NamedValue, bool) {
+	index, ok := t.index[key]
+	if !ok {
+		return nil, false
 	}
+	return t.values[index], true
+}
 
-	return nil, false
+// IndexOf returns the position of the entry with the given key among the
+// entries of the table (see Range)
+func (t *Table) IndexOf(key Key) (int, bool) {
+	index, ok := t.index[key]
+	return index, ok
 }
 
 // Range returns an iterator over all named values in the table
@@ -87,16 +282,95 @@ func (t *Table) Range() iter.Seq[*NamedValue] {
 	}
 }
 
-// NamedValue represents a table entry with a name and value
-type NamedValue struct {
-	Name  string
+// Item is an entry of a table as it is written in a new constructor.
+// Key is empty for an entry written as a positional item.
+type Item struct {
+	Key   string
 	Value *Value
 }
 
-// Value represents a Lua value with its type
+// Items returns the entries of the table as they are written in a new
+// constructor. Positional entries that carry on the array part keep being
+// written without key, so { "a", "b", x = 1 } comes out as it went in.
+func (t *Table) Items() []Item {
+	items := make([]Item, len(t.values))
+	next := IntKey(1)
+	for i, entry := range t.values {
+		if entry.positional && entry.Key == next && entry.spelling == "" {
+			items[i] = Item{Value: entry.Value}
+			next = IntKey(next.Int() + 1)
+			continue
+		}
+		items[i] = Item{Key: entry.Name(), Value: entry.Value}
+	}
+	return items
+}
+
+// NamedValue represents a table entry with a name and value.
+// field is the constructor field the entry was parsed from (nil for entries
+// added by a merge) and replaced is set once a merge assigns a new value.
+// positional is set for entries whose value comes from a positional field
+// ({ "a", "b" }). stmt is the statement that assigned the entry after the
+// constructor and assigned describes it as a field; dropped lists the
+// statements that extended a value the merge replaced. spelling is the
+// source text of a key written with a constant ([SKID.NV_BASIC]).
+type NamedValue struct {
+	Key        Key
+	Value      *Value
+	field      *Field
+	replaced   bool
+	positional bool
+	stmt       Stmt
+	assigned   *Field
+	dropped    []Stmt
+	spelling   string
+}
+
+// Name returns the key of the entry as written in a table constructor
+// (name, [12], ["my key"]). Keys written with a constant keep their
+// spelling ([SKID.NV_BASIC]).
+func (n *NamedValue) Name() string {
+	if n.spelling != "" {
+		return "[" + n.spelling + "]"
+	}
+	return n.Key.Source()
+}
+
+// index returns the key of the entry as written after an expression to
+// index it (.name, [12], [SKID.NV_BASIC])
+func (n *NamedValue) index() string {
+	if n.spelling != "" {
+		return "[" + n.spelling + "]"
+	}
+	return n.Key.Index()
+}
+
+// Pos returns the position of the field or statement that set the entry
+// (key and value), or an invalid Position for entries added by a merge
+func (n *NamedValue) Pos() Position {
+	field := n.field
+	if n.assigned != nil {
+		field = n.assigned
+	}
+	if field == nil || n.Value.file == nil {
+		return Position{}
+	}
+	return n.Value.file.Pos(field)
+}
+
+// Positional reports whether the value of the entry comes from a
+// positional constructor field, without an explicit key
+func (n *NamedValue) Positional() bool {
+	return n.positional
+}
+
+// Value represents a Lua value with its type.
+// Values parsed from a file keep the expression they came from.
 type Value struct {
 	Type  Type
 	value any
+	file  *File
+	expr  Expr
 }
 
 // Value returns the underlying Go value
@@ -104,7 +378,29 @@ func (v *Value) Value() any {
 	return v.value
 }
 
-// String returns the string value if the type is TypeString
+// Pos returns the position of the expression the value was parsed from,
+// or an invalid Position for values that were not parsed from a file.
+// Values of an evaluated file get a Position with only the file name.
+func (v *Value) Pos() Position {
+	if v.expr == nil {
+		if v.file != nil {
+			return Position{File: v.file.Name}
+		}
+		return Position{}
+	}
+	return v.file.Pos(v.expr)
+}
+
+// Raw returns the exact source text the value was parsed from,
+// or an empty string for values that were not parsed from a file
+func (v *Value) Raw() string {
+	if v.expr == nil {
+		return ""
+	}
+	return v.file.Text(v.expr)
+}
+
+// String returns the decoded string value if the type is TypeString
 func (v *Value) String() (string, error) {
 	if v.Type != TypeString {
 		return "", errors.New("is not a string")
@@ -119,27 +415,37 @@ func (v *Value) String() (string, error) {
 		return "", fmt.Errorf("value is of type %T, not string", v.value)
 	}
 
-	value = strings.ReplaceAll(value, "\n", "\\n")
-	value = strings.ReplaceAll(value, "\t", "\\t")
-	value = strings.Trim(value, "\"")
-	value = strings.ReplaceAll(value, `\"`, "\"")
-	value = strings.ReplaceAll(value, `"`, `\"`)
 	return value, nil
 }
 
+// Quoted returns the string as a Lua literal if the type is TypeString.
+// Strings parsed from a file keep their original literal and quoting style;
+// other strings are encoded with double quotes.
+func (v *Value) Quoted() (string, error) {
+	value, err := v.String()
+	if err != nil {
+		return "", err
+	}
+
+	if raw := v.Raw(); raw != "" {
+		return raw, nil
+	}
+	return QuoteString(value, '"'), nil
+}
+
 // Number returns the numeric value if the type is TypeNumber
-func (v *Value) Number() (float64, error) {
+func (v *Value) Number() (Number, error) {
 	if v.Type != TypeNumber {
-		return 0, errors.New("is not a number")
+		return Number{}, errors.New("is not a number")
 	}
 
 	if value, ok := v.value.(*Value); ok {
 		return value.Number()
 	}
 
-	value, ok := v.value.(float64)
+	value, ok := v.value.(Number)
 	if !ok {
-		return 0, fmt.Errorf("value is of type %T, not float64", v.value)
+		return Number{}, fmt.Errorf("value is of type %T, not Number", v.value)
 	}
 
 	return value, nil
@@ -196,3 +502,30 @@ func (v *Value) Variable() (string, error) {
 	}
 	return value, nil
 }
+
+// Function returns the source text of the function if the type is TypeFunction
+func (v *Value) Function() (string, error) {
+	if v.Type != TypeFunction {
+		return "", errors.New("is not a function")
+	}
+
+	value, ok := v.value.(string)
+	if !ok {
+		return "", fmt.Errorf("value is of type %T, not string", v.value)
+	}
+	return value, nil
+}
+
+// Expression returns the source text of the expression if the type is TypeExpression.
+// Expressions are opaque to the merger and are written back unchanged.
+func (v *Value) Expression() (string, error) {
+	if v.Type != TypeExpression {
+		return "", errors.New("is not an expression")
+	}
+
+	value, ok := v.value.(string)
+	if !ok {
+		return "", fmt.Errorf("value is of type %T, not string", v.value)
+	}
+	return value, nil
+}
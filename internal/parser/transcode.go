@@ -0,0 +1,69 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Transcode converts Lua source text to another character encoding using convert.
+// String literals are decoded, converted and re-encoded in their original
+// quoting style, so the converted bytes can never form a bogus escape sequence
+// (e.g. a Big5 or CP949 trail byte equal to '\'). Literals whose bytes do not
+// change are kept exactly as written. Everything outside string literals
+// (comments, whitespace) is converted as plain text, and so are the lines
+// that contain lexical errors; they are reported when the result is parsed.
+func Transcode(name string, src string, version Version, convert func(string) (string, error)) (string, error) {
+	tokens, _ := tokenize(src, true)
+
+	var sb strings.Builder
+	sb.Grow(len(src))
+	pos := 0
+
+	for _, token := range tokens {
+		if token.Start > pos {
+			text, err := convert(src[pos:token.Start])
+			if err != nil {
+				return "", transcodeError(name, src, pos, err)
+			}
+			sb.WriteString(text)
+		}
+		pos = token.End
+
+		if token.Kind == TokenError {
+			text, err := convert(token.Text)
+			if err != nil {
+				return "", transcodeError(name, src, token.Start, err)
+			}
+			sb.WriteString(text)
+			continue
+		}
+
+		if token.Kind != TokenString {
+			sb.WriteString(token.Text)
+			continue
+		}
+
+		value, err := UnquoteString(token.Text, version)
+		if err != nil {
+			return "", transcodeError(name, src, token.Start, err)
+		}
+		converted, err := convert(value)
+		if err != nil {
+			return "", transcodeError(name, src, token.Start, err)
+		}
+
+		if converted == value {
+			sb.WriteString(token.Text)
+		} else {
+			sb.WriteString(RequoteString(converted, token.Text))
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// transcodeError reports a conversion failure with its position in the source
+func transcodeError(name string, src string, offset int, err error) error {
+	line, column := position(src, offset)
+	return fmt.Errorf("%s:%d:%d: %w", name, line, column, err)
+}
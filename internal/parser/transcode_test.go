@@ -0,0 +1,101 @@
+package parser
+
+import (
+	"strings"
+	"testing"
+
+	"luamerge/internal/charset"
+)
+
+// converter returns the conversion between two encodings, which must differ
+func converter(t *testing.T, from, to string) func(string) (string, error) {
+	t.Helper()
+
+	convert, err := charset.Converter(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if convert == nil {
+		t.Fatalf("no conversion from %s to %s", from, to)
+	}
+	return convert
+}
+
+func TestTranscode(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   string
+		to     string
+		source string
+		want   string
+	}{
+		{
+			name:   "utf-8",
+			from:   "utf-8",
+			to:     "cp949",
+			source: "-- ascii only\nT = { 'a\\tb', [[\\]], \"\\65\" }\n",
+			want:   "-- ascii only\nT = { 'a\\tb', [[\\]], \"\\65\" }\n",
+		},
+		{
+			// 許 is b3 5c in Big5: its trail byte must be escaped
+			name:   "big5 from utf-8",
+			from:   "utf-8",
+			to:     "big5",
+			source: "T = { \"許可\", '許', [[許]] }\n",
+			want:   "T = { \"\xb3\\\\\xa5\x69\", '\xb3\\\\', [[\xb3\x5c]] }\n",
+		},
+		{
+			name:   "big5 to utf-8",
+			from:   "big5",
+			to:     "utf-8",
+			source: "T = { \"\xb3\\\\\xa5\x69\", '\xb3\\\\', [[\xb3\x5c]] } -- \xb3\x5c\n",
+			want:   "T = { \"許可\", '許', [[許]] } -- 許\n",
+		},
+		{
+			// ソ is 83 5c in Shift-JIS
+			name:   "shift-jis from utf-8",
+			from:   "utf-8",
+			to:     "shift_jis",
+			source: "T = { \"ソ\", x = \"\\\"ソ\\\"\" }\n",
+			want:   "T = { \"\x83\\\\\", x = \"\\\"\x83\\\\\\\"\" }\n",
+		},
+		{
+			name:   "shift-jis to utf-8",
+			from:   "cp932",
+			to:     "utf-8",
+			source: "T = { \"\x83\\\\\", x = \"\\\"\x83\\\\\\\"\" }\n",
+			want:   "T = { \"ソ\", x = \"\\\"ソ\\\"\" }\n",
+		},
+	}
+
+	for _, tt := range tests {
+		got, err := Transcode("test.lua", tt.source, Lua51, converter(t, tt.from, tt.to))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+
+		// The strings of the result are those of the source, converted
+		back, err := Transcode("test.lua", got, Lua51, converter(t, tt.to, tt.from))
+		if err != nil {
+			t.Errorf("%s: converting back: %v", tt.name, err)
+		} else if back != tt.source {
+			t.Errorf("%s: converted back to %q, want %q", tt.name, back, tt.source)
+		}
+	}
+}
+
+func TestTranscodeError(t *testing.T) {
+	// CP949 has no emoji
+	_, err := Transcode("test.lua", "A = 1\nT = { \"x😀\" }\n", Lua51, converter(t, "utf-8", "cp949"))
+	if err == nil {
+		t.Fatal("got no error for a string CP949 cannot encode")
+	}
+	if want := "test.lua:2:7: "; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("got error %q, want it at %s", err, want)
+	}
+}
@@ -0,0 +1,36 @@
+package parser
+
+import "fmt"
+
+// Version is the Lua version whose grammar a file is parsed with.
+// The zero value parses like Lua51.
+type Version int
+
+const (
+	Lua51 Version = 51
+	Lua53 Version = 53 // adds //, bitwise operators, goto and labels
+	Lua54 Version = 54 // adds <const> and <close> local attributes
+)
+
+// ParseVersion parses a version as written in settings.json ("5.1", "5.3"
+// or "5.4")
+func ParseVersion(s string) (Version, error) {
+	switch s {
+	case "5.1":
+		return Lua51, nil
+	case "5.3":
+		return Lua53, nil
+	case "5.4":
+		return Lua54, nil
+	default:
+		return 0, fmt.Errorf("unsupported Lua version '%s' (expected '5.1', '5.3' or '5.4')", s)
+	}
+}
+
+// String returns the version as written in settings.json
+func (v Version) String() string {
+	if v < Lua53 {
+		return "5.1"
+	}
+	return fmt.Sprintf("%d.%d", v/10, v%10)
+}
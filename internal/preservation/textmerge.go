@@ -4,184 +4,330 @@ import (
 	"bytes"
 	"fmt"
 	"luamerge/internal/merger"
-	"os"
-	"regexp"
+	"luamerge/internal/parser"
+	tmpl "luamerge/internal/template"
+	"strings"
 	"text/template"
 )
 
-// TablePosition represents the position of a table in the file
-type TablePosition struct {
-	Name      string
-	StartLine int
-	EndLine   int
-	StartPos  int
-	EndPos    int
+// ValueRenderer returns a parser.Renderer that renders values which were not
+// parsed from a file using the "value" definition of the template
+func ValueRenderer(tpl *template.Template) parser.Renderer {
+	return func(value *parser.Value) (string, error) {
+		var buf bytes.Buffer
+		if err := tpl.ExecuteTemplate(&buf, "value", tmpl.ValueNode{Value: value}); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	}
 }
 
-// FindTablePositions finds the positions of all tables in the text
-func FindTablePositions(content string, tableNames []string) (map[string]*TablePosition, error) {
-	positions := make(map[string]*TablePosition)
-
-	for _, tableName := range tableNames {
-		// Pattern to find table declaration: TableName = {
-		pattern := fmt.Sprintf(`(?m)^%s\s*=\s*\{`, regexp.QuoteMeta(tableName))
-		re, err := regexp.Compile(pattern)
-		if err != nil {
-			return nil, fmt.Errorf("error compiling regex for table '%s': %w", tableName, err)
-		}
+// RenderResult renders a merged table as a standalone declaration.
+// Tables parsed from a file keep their original text, with only the merged
+// entries rewritten; other tables are rendered entirely by the template.
+// A table found by a longer path (ItemDB.Weapons) is declared inside
+// constructors of its parents (ItemDB = { Weapons = { ... } }), as they
+// are not part of the output.
+func RenderResult(result merger.Result, tpl *template.Template) (string, error) {
+	var buf bytes.Buffer
 
-		// Find the starting position of the table
-		matches := re.FindStringIndex(content)
-		if matches == nil {
-			continue // Table not found
+	// Calls are written back as statements, one per line
+	if result.Calls != nil {
+		render := ValueRenderer(tpl)
+		for i, call := range result.Calls {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			text, err := call.Text(render)
+			if err != nil {
+				return "", fmt.Errorf("error generating Lua for call to '%s' at %s: %w", result.TableName, call.Pos(), err)
+			}
+			buf.WriteString(text)
 		}
+		return buf.String(), nil
+	}
 
-		startPos := matches[0]
-
-		// Find the end of the table by balancing braces
-		endPos := findTableEndInContent(content, matches[1]-1) // -1 to start from {
+	if len(result.Path) > 1 {
+		tree := &pathNode{}
+		tree.add(&result)
+		return renderDeclaration(tree.children[0], tpl)
+	}
 
-		if endPos == -1 {
-			continue // Could not find end
+	if !result.Table.HasSource() {
+		if err := tpl.Execute(&buf, result); err != nil {
+			return "", fmt.Errorf("error generating Lua for table '%s': %w", result.TableName, err)
 		}
+		return buf.String(), nil
+	}
 
-		positions[tableName] = &TablePosition{
-			Name:      tableName,
-			StartLine: 0, // No longer used
-			EndLine:   0, // No longer used
-			StartPos:  startPos,
-			EndPos:    endPos,
-		}
+	if err := tpl.ExecuteTemplate(&buf, "declaration", result); err != nil {
+		return "", fmt.Errorf("error generating Lua for table '%s': %w", result.TableName, err)
+	}
+
+	text, err := result.Table.Text(ValueRenderer(tpl))
+	if err != nil {
+		return "", fmt.Errorf("error generating Lua for table '%s': %w", result.TableName, err)
 	}
+	buf.WriteString(text)
 
-	return positions, nil
+	return buf.String(), nil
 }
 
-// findTableEndInContent finds the end of a table in the content by balancing braces
-func findTableEndInContent(content string, startPos int) int {
-	depth := 0
-	inString := false
-	escapeNext := false
+// RenderResults renders merged tables and calls as standalone declarations,
+// one after the other. Tables found by paths that share their first name
+// are declared together, in a single constructor (see RenderResult).
+// Local tables can only be reached through the value the file returns, so
+// they are followed by the return statement that ends the base file or,
+// when it has none, by a return of the local tables.
+// A returned table is always written last, as return ends the chunk.
+func RenderResults(results []merger.Result, base *parser.File, tpl *template.Template) (string, error) {
+	var parts []string
+	var locals []string
+	var returned *merger.Result
 
-	for i := startPos; i < len(content); i++ {
-		char := content[i]
+	// Each top-level table takes the place of the first result in it
+	tree := &pathNode{}
+	slots := make(map[*pathNode]int)
 
-		// Handle escape sequences in strings
-		if escapeNext {
-			escapeNext = false
+	for i, result := range results {
+		switch {
+		case result.Return:
+			returned = &results[i]
+			continue
+		case result.Calls != nil:
+			text, err := RenderResult(result, tpl)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, text)
 			continue
+		case result.Local:
+			locals = append(locals, result.TableName)
 		}
 
-		if char == '\\' {
-			escapeNext = true
-			continue
+		top := tree.add(&results[i])
+		if _, ok := slots[top]; !ok {
+			slots[top] = len(parts)
+			parts = append(parts, "")
 		}
+	}
 
-		// Handle strings (ignore braces inside strings)
-		if char == '"' {
-			inString = !inString
-			continue
+	for _, top := range tree.children {
+		text, err := renderDeclaration(top, tpl)
+		if err != nil {
+			return "", err
 		}
+		parts[slots[top]] = text
+	}
 
-		if inString {
-			continue
+	switch {
+	case returned != nil:
+		text, err := RenderResult(*returned, tpl)
+		if err != nil {
+			return "", err
 		}
+		parts = append(parts, text)
+	case len(locals) > 0:
+		if stmt, ok := base.FinalReturn(); ok {
+			parts = append(parts, base.Text(stmt))
+		} else {
+			parts = append(parts, "return "+strings.Join(locals, ", "))
+		}
+	}
 
-		// Balance braces
-		switch char {
-		case '{':
-			depth++
-		case '}':
-			depth--
-			if depth == 0 {
-				// Found the end - include the line up to newline
-				for j := i + 1; j < len(content); j++ {
-					if content[j] == '\n' {
-						return j + 1
-					}
-				}
-				return i + 1
-			}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// pathNode is a table of the output of RenderResults: either a merged
+// table, or a parent of merged tables that is written as a constructor
+// holding them
+type pathNode struct {
+	key      parser.Key
+	result   *merger.Result
+	children []*pathNode
+}
+
+// add places a merged table in the tree under its path, and returns the
+// top-level node that holds it
+func (n *pathNode) add(result *merger.Result) *pathNode {
+	path := result.Path
+	if len(path) == 0 {
+		path = parser.Path{parser.StringKey(result.TableName)}
+	}
+
+	node := n
+	for _, key := range path {
+		node = node.child(key)
+	}
+	node.result = result
+	return n.child(path[0])
+}
+
+// child returns the child node with the given key, adding it when missing
+func (n *pathNode) child(key parser.Key) *pathNode {
+	for _, child := range n.children {
+		if child.key == key {
+			return child
+		}
+	}
+	child := &pathNode{key: key}
+	n.children = append(n.children, child)
+	return child
+}
+
+// inner returns the merged table of a node holding the table of another
+// node, for reports
+func (n *pathNode) inner() *merger.Result {
+	for _, child := range n.children {
+		if child.result != nil {
+			return child.result
+		}
+		if result := child.inner(); result != nil {
+			return result
 		}
 	}
+	return nil
+}
 
-	return -1 // Did not find end
+// checkLeaf reports an error when a merged table holds other merged
+// tables, as each of them would be written with its own base entries
+func (n *pathNode) checkLeaf() error {
+	if len(n.children) == 0 {
+		return nil
+	}
+	return fmt.Errorf("table '%s' is inside table '%s', which is merged as well", n.inner().TableName, n.result.TableName)
 }
 
-// ReplaceTablesInText replaces the merged tables in the original text
-func ReplaceTablesInText(originalContent string, mergedResults []merger.Result, tpl *template.Template) (string, error) {
-	// Extract table names
-	tableNames := make([]string, len(mergedResults))
-	for i, result := range mergedResults {
-		tableNames[i] = result.TableName
+// renderDeclaration renders a top-level node of the tree
+func renderDeclaration(top *pathNode, tpl *template.Template) (string, error) {
+	if top.result != nil {
+		if err := top.checkLeaf(); err != nil {
+			return "", err
+		}
+		if len(top.result.Path) <= 1 {
+			return RenderResult(*top.result, tpl)
+		}
 	}
 
-	// Find table positions
-	positions, err := FindTablePositions(originalContent, tableNames)
-	if err != nil {
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, "declaration", merger.Result{TableName: top.key.Str()}); err != nil {
+		return "", fmt.Errorf("error generating Lua for table '%s': %w", top.key.Str(), err)
+	}
+	if err := renderNode(&buf, top, "", tpl); err != nil {
 		return "", err
 	}
+	return buf.String(), nil
+}
 
-	// Sort positions by StartPos (from end to beginning, to avoid affecting offsets)
-	sortedPositions := make([]*TablePosition, 0, len(positions))
-	for _, pos := range positions {
-		sortedPositions = append(sortedPositions, pos)
-	}
+// renderNode renders the table of a node at the given indentation: the
+// merged table itself, or a constructor holding the tables of its children
+func renderNode(buf *bytes.Buffer, node *pathNode, indent string, tpl *template.Template) error {
+	if result := node.result; result != nil {
+		if err := node.checkLeaf(); err != nil {
+			return err
+		}
 
-	// Bubble sort in reverse (from end to beginning)
-	for i := 0; i < len(sortedPositions)-1; i++ {
-		for j := 0; j < len(sortedPositions)-i-1; j++ {
-			if sortedPositions[j].StartPos < sortedPositions[j+1].StartPos {
-				sortedPositions[j], sortedPositions[j+1] = sortedPositions[j+1], sortedPositions[j]
+		if !result.Table.HasSource() {
+			if err := tpl.ExecuteTemplate(buf, "table", tmpl.TableNode{Table: result.Table, Indent: indent}); err != nil {
+				return fmt.Errorf("error generating Lua for table '%s': %w", result.TableName, err)
 			}
+			return nil
+		}
+
+		text, err := result.Table.Text(ValueRenderer(tpl))
+		if err != nil {
+			return fmt.Errorf("error generating Lua for table '%s': %w", result.TableName, err)
 		}
+		buf.WriteString(text)
+		return nil
 	}
 
-	// Create map of results by name
-	resultMap := make(map[string]merger.Result)
-	for _, result := range mergedResults {
-		resultMap[result.TableName] = result
+	buf.WriteString("{\n")
+	for _, child := range node.children {
+		buf.WriteString(indent + "    " + child.key.Source() + " = ")
+		if err := renderNode(buf, child, indent+"    ", tpl); err != nil {
+			return err
+		}
+		buf.WriteString(",\n")
 	}
+	buf.WriteString(indent + "}")
+	return nil
+}
+
+// ReplaceTablesInText applies the changes of the merged tables to the original text.
+// Only the bytes of entries touched by the merge are rewritten.
+func ReplaceTablesInText(originalContent string, mergedResults []merger.Result, tpl *template.Template) (string, error) {
+	render := ValueRenderer(tpl)
 
-	// Replace from end to beginning (to avoid affecting offsets)
-	result := originalContent
-	for _, pos := range sortedPositions {
-		mergedResult, exists := resultMap[pos.Name]
-		if !exists {
+	var edits []parser.Edit
+	for _, result := range mergedResults {
+		for _, call := range result.Calls {
+			callEdits, err := call.Table.Edits(render)
+			if err != nil {
+				return "", fmt.Errorf("error generating Lua for call to '%s' at %s: %w", result.TableName, call.Pos(), err)
+			}
+			edits = append(edits, callEdits...)
+		}
+		if result.Calls != nil {
 			continue
 		}
 
-		// Generate Lua from merged table using template
-		var buf bytes.Buffer
-		if err := tpl.Execute(&buf, mergedResult); err != nil {
-			return "", fmt.Errorf("error generating Lua for table '%s': %w", pos.Name, err)
+		tableEdits, err := result.Table.Edits(render)
+		if err != nil {
+			return "", fmt.Errorf("error generating Lua for table '%s': %w", result.TableName, err)
 		}
+		edits = append(edits, tableEdits...)
+	}
 
-		// Replace the section
-		before := result[:pos.StartPos]
-		after := result[pos.EndPos:]
-		result = before + buf.String() + after
+	result, err := parser.ApplyEdits(originalContent, edits)
+	if err != nil {
+		return "", fmt.Errorf("error replacing tables: %w", err)
 	}
 
 	return result, nil
 }
 
-// MergeWithPreservation performs merge while preserving unspecified items
-func MergeWithPreservation(basePath, sourcePath string, tablesConfig map[string]map[string]any, tpl *template.Template) (string, error) {
-	// Read base file as text
-	baseContent, err := os.ReadFile(basePath)
+// MergeWithPreservation performs merge while preserving unspecified items.
+// Either tablesConfig or callsConfig may be empty, but not both.
+func MergeWithPreservation(basePath, sourcePath string, tablesConfig map[string]map[string]any, callsConfig map[string]merger.CallTarget, options merger.Options, tpl *template.Template) (string, error) {
+	// The merged tables must come from the same parsed base file as the
+	// text they are written into, so the files are loaded once even when
+	// the caller keeps no cache
+	if options.Files == nil {
+		options.Files = merger.NewFileCache()
+	}
+
+	// Read base file as text (bytecode is decompiled to source)
+	baseFile, err := options.LoadBase(basePath)
 	if err != nil {
 		return "", fmt.Errorf("error reading base file: %w", err)
 	}
 
-	// Perform normal merge of specified tables
-	mergedResults, err := merger.MergeTables(basePath, sourcePath, tablesConfig)
-	if err != nil {
-		return "", err
+	// Perform normal merge of specified tables and calls
+	var mergedResults []merger.Result
+	if len(tablesConfig) > 0 || len(callsConfig) == 0 {
+		mergedResults, err = merger.MergeTables(basePath, sourcePath, tablesConfig, options)
+		if err != nil {
+			return "", err
+		}
+	}
+	if len(callsConfig) > 0 {
+		callResults, err := merger.MergeCalls(basePath, sourcePath, callsConfig, options)
+		if err != nil {
+			return "", err
+		}
+		mergedResults = append(mergedResults, callResults...)
+	}
+
+	// Only tables of the base file itself can be edited in its text
+	for _, result := range mergedResults {
+		if result.Table != nil && !result.Table.InFile(baseFile) {
+			return "", fmt.Errorf("table '%s' is defined or extended in a file included by the base file, so it cannot be edited in place (set keepUnmergedItems to false)", result.TableName)
+		}
 	}
 
 	// Replace tables in original text
-	result, err := ReplaceTablesInText(string(baseContent), mergedResults, tpl)
+	result, err := ReplaceTablesInText(baseFile.Source, mergedResults, tpl)
 	if err != nil {
 		return "", err
 	}
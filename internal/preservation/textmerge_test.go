@@ -0,0 +1,560 @@
+package preservation
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"luamerge/internal/merger"
+	tmpl "luamerge/internal/template"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const functionBase = `Buttons = {
+	Ok = {
+		Label = "OK",
+		OnClick = function(self)
+			self.clicked = "base"
+		end,
+	},
+	Cancel = {
+		Label = "Cancel",
+		OnClick = function(self) self.clicked = "cancel" end,
+	},
+}
+`
+
+const functionSource = `Buttons = {
+	Ok = {
+		Label = "Okay",
+		OnClick = function(self)
+			-- the source handler
+			self.clicked = "source" .. (self.count or 0)
+		end,
+		OnHover = function(self, x, y) return x + y end,
+	},
+	Cancel = {
+		Label = "Abort",
+		OnClick = function(self) self.clicked = "source cancel" end,
+	},
+}
+`
+
+// writeFiles writes a base and a source file and returns their paths
+func writeFiles(t *testing.T, base, source string) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.lua")
+	sourcePath := filepath.Join(dir, "source.lua")
+	if err := os.WriteFile(basePath, []byte(base), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(sourcePath, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return basePath, sourcePath
+}
+
+// clicks runs a merged file and calls the OnClick handler of each button
+func clicks(t *testing.T, output string) map[string]string {
+	t.Helper()
+
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(output); err != nil {
+		t.Fatalf("merged output does not load: %v\n%s", err, output)
+	}
+
+	got := map[string]string{}
+	for _, name := range []string{"Ok", "Cancel"} {
+		button, ok := L.GetField(L.GetGlobal("Buttons"), name).(*lua.LTable)
+		if !ok {
+			t.Fatalf("Buttons.%s is not a table\n%s", name, output)
+		}
+		self := L.NewTable()
+		if err := L.CallByParam(lua.P{Fn: L.GetField(button, "OnClick"), Protect: true}, self); err != nil {
+			t.Fatalf("Buttons.%s.OnClick: %v\n%s", name, err, output)
+		}
+		got[name] = L.GetField(button, "Label").String() + ": " + L.GetField(self, "clicked").String()
+	}
+	return got
+}
+
+func TestMergeFunctions(t *testing.T) {
+	basePath, sourcePath := writeFiles(t, functionBase, functionSource)
+	tables := map[string]map[string]any{
+		"Buttons": {"button": map[string]any{"OnClick": true}},
+	}
+	want := map[string]string{"Ok": "OK: source0", "Cancel": "Cancel: source cancel"}
+
+	tpl, err := tmpl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("preserved", func(t *testing.T) {
+		output, err := MergeWithPreservation(basePath, sourcePath, tables, nil, merger.Options{Files: merger.NewFileCache()}, tpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := clicks(t, output); !maps.Equal(got, want) {
+			t.Errorf("got %v, want %v\n%s", got, want, output)
+		}
+	})
+
+	t.Run("rendered", func(t *testing.T) {
+		results, err := merger.MergeTables(basePath, sourcePath, tables, merger.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := RenderResult(results[0], tpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := clicks(t, output); !maps.Equal(got, want) {
+			t.Errorf("got %v, want %v\n%s", got, want, output)
+		}
+	})
+}
+
+func TestRenderLocalTables(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   string
+		source string
+		want   string
+	}{
+		{"base return", "local T = { a = 1, b = 1 }\nreturn T\n", "local T = { a = 2 }\nreturn T\n", "return T"},
+		{"no return", "local T = { a = 1, b = 1 }\n", "local T = { a = 2 }\n", "return T"},
+	}
+
+	tpl, err := tmpl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		basePath, sourcePath := writeFiles(t, tt.base, tt.source)
+		tables := map[string]map[string]any{"T": {}}
+		options := merger.Options{Files: merger.NewFileCache()}
+
+		results, err := merger.MergeTables(basePath, sourcePath, tables, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		base, err := options.LoadBase(basePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		output, err := RenderResults(results, base, tpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(output, "\n\n"+tt.want) {
+			t.Errorf("%s: output does not end with %q\n%s", tt.name, tt.want, output)
+		}
+
+		L := lua.NewState()
+		if err := L.DoString(output); err != nil {
+			t.Fatalf("%s: merged output does not load: %v\n%s", tt.name, err, output)
+		}
+		table, ok := L.Get(-1).(*lua.LTable)
+		if !ok {
+			t.Errorf("%s: merged output returns %s\n%s", tt.name, L.Get(-1).Type(), output)
+		} else if a, b := L.GetField(table, "a").String(), L.GetField(table, "b").String(); a != "2" || b != "1" {
+			t.Errorf("%s: got a = %s, b = %s, want a = 2, b = 1\n%s", tt.name, a, b, output)
+		}
+		L.Close()
+	}
+}
+
+func TestMergeWithoutCache(t *testing.T) {
+	basePath, sourcePath := writeFiles(t,
+		"-- items\nT = { x = { a = 1, b = 1 } }\nAddItem{ id = 1, name = \"x\" }\n",
+		"T = { x = { a = 2, b = 2 } }\nAddItem{ id = 1, name = \"y\" }\n")
+	tables := map[string]map[string]any{"T": {"entry": map[string]any{"a": true}}}
+	calls := map[string]merger.CallTarget{"AddItem": {KeyField: "id"}}
+
+	tpl, err := tmpl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := MergeWithPreservation(basePath, sourcePath, tables, calls, merger.Options{}, tpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-- items\nT = { x = { a = 2, b = 1 } }\nAddItem{ id = 1, name = \"y\" }\n"
+	if output != want {
+		t.Errorf("got\n%s\nwant\n%s", output, want)
+	}
+}
+
+func TestPreserveEncodings(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		output string
+		base   string
+		source string
+		want   string
+	}{
+		{
+			name:   "utf-8",
+			input:  "utf-8",
+			output: "utf-8",
+			base:   "-- 아이템\r\nT = {\r\n\ta = { name = \"검\", x = 1 },\t-- ソ\\\r\n\tb = { name = [[許]] },\r\n}\r\n",
+			source: "T = { a = { name = \"방패\", x = 2 }, b = { name = \"b\" } }",
+			want:   "-- 아이템\r\nT = {\r\n\ta = { name = \"방패\", x = 1 },\t-- ソ\\\r\n\tb = { name = \"b\" },\r\n}\r\n",
+		},
+		{
+			// 검 is b0 cb and 방패 b9 e6 c6 d0 in CP949
+			name:   "cp949",
+			input:  "cp949",
+			output: "cp949",
+			base:   "-- \xbe\xc6\xc0\xcc\xc5\xdb\nT = {\n\ta = { name = \"\xb0\xcb\", x = 1 },\n\tb = { name = \"\xb0\xcb\" },\n}\n",
+			source: "T = { a = { name = \"\xb9\xe6\xc6\xd0\", x = 2 } }",
+			want:   "-- \xbe\xc6\xc0\xcc\xc5\xdb\nT = {\n\ta = { name = \"\xb9\xe6\xc6\xd0\", x = 1 },\n\tb = { name = \"\xb0\xcb\" },\n}\n",
+		},
+		{
+			name:   "utf-8 source into cp949",
+			input:  "utf-8",
+			output: "cp949",
+			base:   "-- \xbe\xc6\xc0\xcc\xc5\xdb\nT = {\n\ta = { name = \"\xb0\xcb\", x = 1 },\n\tb = { name = \"\xb0\xcb\" },\n}\n",
+			source: "T = { a = { name = \"방패\", x = 2 } }",
+			want:   "-- \xbe\xc6\xc0\xcc\xc5\xdb\nT = {\n\ta = { name = \"\xb9\xe6\xc6\xd0\", x = 1 },\n\tb = { name = \"\xb0\xcb\" },\n}\n",
+		},
+		{
+			// 許 is b3 5c in Big5, so the string is written "\xb3\\"
+			name:   "big5",
+			input:  "big5",
+			output: "cp950",
+			base:   "T = {\n\ta = { name = \"\xb3\\\\\", x = 1 },\n\tb = { name = '\xb3\\\\' },\n}\n",
+			source: "T = { a = { name = \"x\", x = 2 }, b = { name = '\xb3\\\\\xb3\\\\' } }",
+			want:   "T = {\n\ta = { name = \"x\", x = 1 },\n\tb = { name = '\xb3\\\\\xb3\\\\' },\n}\n",
+		},
+	}
+
+	tpl, err := tmpl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := map[string]map[string]any{"T": {"*": map[string]any{"name": true}}}
+
+	for _, tt := range tests {
+		basePath, sourcePath := writeFiles(t, tt.base, tt.source)
+		options := merger.Options{InputEncoding: tt.input, OutputEncoding: tt.output}
+		output, err := MergeWithPreservation(basePath, sourcePath, tables, nil, options, tpl)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if output != tt.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.name, output, tt.want)
+		}
+	}
+
+	basePath, sourcePath := writeFiles(t, "T = {}", "T = {}")
+	options := merger.Options{InputEncoding: "utf-8", OutputEncoding: "cp9999"}
+	if _, err := MergeWithPreservation(basePath, sourcePath, tables, nil, options, tpl); err == nil || !strings.Contains(err.Error(), "unknown encoding 'cp9999'") {
+		t.Errorf("got error %v, want an unknown encoding", err)
+	}
+}
+
+func TestPreserveRecover(t *testing.T) {
+	base := "A = { a = { x = 1 } }\nB = { y = = 2,\n  z = 3 } -- broken\nC = { a = { x = 1, y = 1 } }\n"
+	basePath, sourcePath := writeFiles(t, base, "A = { a = { x = 2 } }\nC = { a = { x = 2, y = 2 } }\n")
+	tables := map[string]map[string]any{"A": {"*": map[string]any{"x": true}}, "C": {"*": map[string]any{"x": true}}}
+
+	tpl, err := tmpl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var warnings []string
+	options := merger.Options{ParseMode: merger.ParseRecover, Warn: func(message string) { warnings = append(warnings, message) }}
+	output, err := MergeWithPreservation(basePath, sourcePath, tables, nil, options, tpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "A = { a = { x = 2 } }\nB = { y = = 2,\n  z = 3 } -- broken\nC = { a = { x = 2, y = 1 } }\n"
+	if output != want {
+		t.Errorf("got\n%q\nwant\n%q", output, want)
+	}
+	if len(warnings) != 1 || warnings[0] != basePath+":2:11: unexpected symbol near '=' (statement skipped)" {
+		t.Errorf("got warnings %q, want the broken statement", warnings)
+	}
+
+	// Without recover mode, the merge stops at the broken statement
+	_, err = MergeWithPreservation(basePath, sourcePath, tables, nil, merger.Options{}, tpl)
+	if err == nil || !strings.Contains(err.Error(), basePath+":2:11: unexpected symbol near '='") {
+		t.Errorf("got error %v, want it at %s:2:11", err, basePath)
+	}
+}
+
+func TestPreserveIncludedTable(t *testing.T) {
+	basePath, sourcePath := writeFiles(t, "dofile(\"items.lua\")\nOther = { a = 1 }\n", "T = { a = 2 }\nOther = { a = 2 }\n")
+	root := filepath.Dir(basePath)
+	if err := os.WriteFile(filepath.Join(root, "items.lua"), []byte("T = { a = 1 }\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tpl, err := tmpl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := merger.Options{IncludeRoot: root}
+
+	output, err := MergeWithPreservation(basePath, sourcePath, map[string]map[string]any{"Other": {"a": true}}, nil, options, tpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "dofile(\"items.lua\")\nOther = { a = 2 }\n"; output != want {
+		t.Errorf("got %q, want %q", output, want)
+	}
+
+	_, err = MergeWithPreservation(basePath, sourcePath, map[string]map[string]any{"T": {"a": true}}, nil, options, tpl)
+	if err == nil || !strings.Contains(err.Error(), "table 'T' is defined or extended in a file included by the base file") {
+		t.Errorf("got error %v, want the included table to be refused", err)
+	}
+}
+
+func TestRenderReturnLast(t *testing.T) {
+	basePath, sourcePath := writeFiles(t,
+		"Other = { x = 1 }\nreturn { a = 1 }\n",
+		"Other = { x = 2 }\nreturn { a = 2 }\n")
+	tables := map[string]map[string]any{"return": {}, "Other": {}}
+	options := merger.Options{Files: merger.NewFileCache()}
+
+	tpl, err := tmpl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := merger.MergeTables(basePath, sourcePath, tables, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := options.LoadBase(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The returned table comes first, whatever the order of the results
+	slices.SortFunc(results, func(a, b merger.Result) int {
+		return strings.Compare(b.TableName, a.TableName)
+	})
+	output, err := RenderResults(results, base, tpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "Other = { x = 2 }\n\nreturn { a = 2 }"
+	if output != want {
+		t.Errorf("got\n%s\nwant\n%s", output, want)
+	}
+}
+
+func TestRenderPaths(t *testing.T) {
+	basePath, sourcePath := writeFiles(t,
+		"ItemDB = { Weapons = { a = 1, b = 1 }, Armor = { c = 1 } }\ntbl = { [\"sub.key\"] = { [3] = { name = \"x\" } } }\n",
+		"ItemDB = { Weapons = { a = 2, b = 2 }, Armor = { c = 2 } }\ntbl = { [\"sub.key\"] = { [3] = { name = \"y\" } } }\n")
+	tables := map[string]map[string]any{
+		"ItemDB.Weapons":    {"entry": map[string]any{}, "a": true},
+		"ItemDB.Armor":      {},
+		`tbl["sub.key"][3]`: {},
+	}
+	want := map[string]string{
+		"ItemDB.Weapons.a":       "2",
+		"ItemDB.Armor.c":         "2",
+		`tbl["sub.key"][3].name`: "y",
+	}
+
+	tpl, err := tmpl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := merger.Options{Files: merger.NewFileCache()}
+	results, err := merger.MergeTables(basePath, sourcePath, tables, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := options.LoadBase(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := RenderResults(results, base, tpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(output); err != nil {
+		t.Fatalf("merged output does not load: %v\n%s", err, output)
+	}
+	for expr, value := range want {
+		if err := L.DoString("value = tostring(" + expr + ")"); err != nil {
+			t.Fatalf("%s: %v\n%s", expr, err, output)
+		}
+		if got := L.GetGlobal("value").String(); got != value {
+			t.Errorf("%s = %s, want %s\n%s", expr, got, value, output)
+		}
+	}
+
+	// A merged table cannot be written inside another merged table
+	results, err = merger.MergeTables(basePath, sourcePath, map[string]map[string]any{"ItemDB": {}, "ItemDB.Armor": {}}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RenderResults(results, base, tpl); err == nil || !strings.Contains(err.Error(), "which is merged as well") {
+		t.Errorf("got error %v, want nested tables to be rejected", err)
+	}
+}
+
+// preserveCase is a merge with keepUnmergedItems and its exact output
+type preserveCase struct {
+	name   string
+	base   string
+	source string
+	tables map[string]map[string]any
+	calls  map[string]merger.CallTarget
+	want   string
+}
+
+// runPreserveCases merges each case with MergeWithPreservation and checks
+// its output byte for byte
+func runPreserveCases(t *testing.T, tests []preserveCase) {
+	t.Helper()
+
+	tpl, err := tmpl.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		basePath, sourcePath := writeFiles(t, tt.base, tt.source)
+		output, err := MergeWithPreservation(basePath, sourcePath, tt.tables, tt.calls, merger.Options{}, tpl)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if output != tt.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.name, output, tt.want)
+		}
+	}
+}
+
+func TestPreserveLayout(t *testing.T) {
+	each := func(rules map[string]any) map[string]map[string]any {
+		return map[string]map[string]any{"T": {"*": rules}}
+	}
+
+	runPreserveCases(t, []preserveCase{
+		{
+			name:   "comments and blank lines",
+			base:   "-- header\n\nT = {\n\t-- first\n\ta = { x = 1, y = 1 }, -- keep\n\n\t--[[ block ]]\n\tb = { x = 1 },\n}\n\n-- trailer\n",
+			source: "T = { a = { x = 2, y = 2 }, b = { x = 2 } }",
+			tables: each(map[string]any{"x": true}),
+			want:   "-- header\n\nT = {\n\t-- first\n\ta = { x = 2, y = 1 }, -- keep\n\n\t--[[ block ]]\n\tb = { x = 2 },\n}\n\n-- trailer\n",
+		},
+		{
+			name:   "untouched file",
+			base:   "x = 1;  T = {a={x=1}}\t-- odd   spacing\n",
+			source: "T = { a = { x = 1 } }",
+			tables: each(map[string]any{"y": true}),
+			want:   "x = 1;  T = {a={x=1}}\t-- odd   spacing\n",
+		},
+		{
+			name:   "CRLF",
+			base:   "T = {\r\n\ta = { x = 1 },\r\n\tb = { x = 1 }, -- b\r\n}\r\n",
+			source: "T = {\r\n\ta = { x = 2 },\r\n\tb = { x = 1, z = 3 },\r\n\tc = { x = 3 },\r\n}\r\n",
+			tables: map[string]map[string]any{"T": {"$addMissing": true, "*": map[string]any{"x": true}}},
+			want:   "T = {\r\n\ta = { x = 2 },\r\n\tb = { x = 1 }, -- b\r\n\tc = { x = 3 },\r\n}\r\n",
+		},
+		{
+			name:   "CRLF removal",
+			base:   "T = {\r\n\ta = 1,\r\n\tb = 2,\r\n}\r\nprint(T)\r\n",
+			source: "T = { a = 1 }",
+			tables: map[string]map[string]any{"T": {"$removeMissing": true, "*": map[string]any{}}},
+			want:   "T = {\r\n\ta = 1,\r\n}\r\nprint(T)\r\n",
+		},
+	})
+}
+
+func TestPreserveIncrementalTables(t *testing.T) {
+	runPreserveCases(t, []preserveCase{
+		{
+			name:   "rewrite in statement",
+			base:   "T = {}\nT[501] = { name = \"a\", lvl = 1 } -- a\nT[502] = { name = \"b\", lvl = 1 }\n\nprint(1)\n",
+			source: "T = {}\nT[501] = { name = \"A\", lvl = 5 }\nT[502] = { name = \"B\", lvl = 5 }\n",
+			tables: map[string]map[string]any{"T": {"*": map[string]any{"name": true}}},
+			want:   "T = {}\nT[501] = { name = \"A\", lvl = 1 } -- a\nT[502] = { name = \"B\", lvl = 1 }\n\nprint(1)\n",
+		},
+		{
+			name:   "field statements",
+			base:   "T = { version = 1 }\nT.version = 2\nT.name = \"base\"\n",
+			source: "T = { version = 3, name = \"source\" }",
+			tables: map[string]map[string]any{"T": {}},
+			want:   "T = { version = 1 }\nT.version = 3\nT.name = \"source\"\n",
+		},
+		{
+			name:   "nested field statement",
+			base:   "T = {}\nT[501] = { name = \"a\", lvl = 1 }\nT[501].lvl = 2\n",
+			source: "T = {}\nT[501] = { name = \"A\", lvl = 7 }\n",
+			tables: map[string]map[string]any{"T": {"*": map[string]any{"lvl": true}}},
+			want:   "T = {}\nT[501] = { name = \"a\", lvl = 1 }\nT[501].lvl = 7\n",
+		},
+		{
+			name:   "added after tail",
+			base:   "T = {}\nT[501] = { name = \"a\" }\nT[502] = { name = \"b\" } -- b\n\nprint(1)\n",
+			source: "T = {}\nT[501] = { name = \"a\" }\nT[502] = { name = \"b\" }\nT[503] = { name = \"c\" }\n",
+			tables: map[string]map[string]any{"T": {"$addMissing": true, "*": map[string]any{"name": true}}},
+			want:   "T = {}\nT[501] = { name = \"a\" }\nT[502] = { name = \"b\" } -- b\nT[503] = { name = \"c\" }\n\nprint(1)\n",
+		},
+		{
+			name:   "replaced value drops its statements",
+			base:   "T = {}\nT[501] = { name = \"a\", lvl = 1 }\nT[501].lvl = 2\nT[501].extra = true\nT[502] = { name = \"b\" }\n",
+			source: "T = {}\nT[501] = { name = \"A\" }\n",
+			tables: map[string]map[string]any{"T": {"[501]": true}},
+			want:   "T = {}\nT[501] = { name = \"A\" }\nT[502] = { name = \"b\" }\n",
+		},
+	})
+}
+
+func TestPreserveCalls(t *testing.T) {
+	runPreserveCases(t, []preserveCase{
+		{
+			name:   "keyField",
+			base:   "AddItem{ id = 1, name = \"a\" } -- one\n\nAddItem{\n\tid = 2,\n\tname = \"b\",\n}\n",
+			source: "AddItem{ name = \"B\", id = 2 }\nAddItem{ id = 3, name = \"C\" }\n",
+			calls:  map[string]merger.CallTarget{"AddItem": {KeyField: "id"}},
+			want:   "AddItem{ id = 1, name = \"a\" } -- one\n\nAddItem{\n\tid = 2,\n\tname = \"B\",\n}\n",
+		},
+		{
+			name:   "keyArg",
+			base:   "Register(\"sword\", { dmg = 1 })\nRegister(\"bow\", { dmg = 2, range = 5 }) -- bow\n",
+			source: "Register(\"bow\", { dmg = 7, range = 9 })\n",
+			calls:  map[string]merger.CallTarget{"Register": {KeyArg: 1, Rules: map[string]any{"dmg": true}}},
+			want:   "Register(\"sword\", { dmg = 1 })\nRegister(\"bow\", { dmg = 7, range = 5 }) -- bow\n",
+		},
+		{
+			name:   "keyArg number",
+			base:   "Skill(\"base\", 10, { lv = 1 })\nSkill(\"base\", 11, { lv = 1 })\n",
+			source: "Skill(\"source\", 11, { lv = 2 })\n",
+			calls:  map[string]merger.CallTarget{"Skill": {KeyArg: 2}},
+			want:   "Skill(\"base\", 10, { lv = 1 })\nSkill(\"base\", 11, { lv = 2 })\n",
+		},
+		{
+			name:   "calls and tables",
+			base:   "T = { a = { x = 1 } }\nAddItem{ id = 1, name = \"a\" }\n",
+			source: "T = { a = { x = 2 } }\nAddItem{ id = 1, name = \"b\" }\n",
+			tables: map[string]map[string]any{"T": {}},
+			calls:  map[string]merger.CallTarget{"AddItem": {KeyField: "id"}},
+			want:   "T = { a = { x = 2 } }\nAddItem{ id = 1, name = \"b\" }\n",
+		},
+	})
+}
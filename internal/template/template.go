@@ -1,8 +1,41 @@
 package template
 
-import _ "embed"
+import (
+	_ "embed"
+	"luamerge/internal/parser"
+	"text/template"
+)
 
 // LuaTemplate contains the embedded Lua template for code generation
 //
 //go:embed lua.gotmpl
 var LuaTemplate string
+
+// ValueNode is a value rendered by the "value" definition of LuaTemplate.
+// Indent is the indentation of the line the value starts on; the entries
+// of a table value are indented one level deeper.
+type ValueNode struct {
+	Value  *parser.Value
+	Indent string
+}
+
+// TableNode is a table rendered by the "table" definition of LuaTemplate
+type TableNode struct {
+	Table  *parser.Table
+	Indent string
+}
+
+// Funcs contains the functions LuaTemplate uses to render nested values
+var Funcs = template.FuncMap{
+	"valueNode": func(value *parser.Value, indent string) ValueNode {
+		return ValueNode{Value: value, Indent: indent}
+	},
+	"tableNode": func(table *parser.Table, indent string) TableNode {
+		return TableNode{Table: table, Indent: indent}
+	},
+}
+
+// New parses LuaTemplate with the functions it uses
+func New() (*template.Template, error) {
+	return template.New("lua").Funcs(Funcs).Parse(LuaTemplate)
+}
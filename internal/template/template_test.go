@@ -0,0 +1,86 @@
+package template
+
+import (
+	"luamerge/internal/merger"
+	"luamerge/internal/parser"
+	"strings"
+	"testing"
+	"time"
+)
+
+// render renders the table name of file with LuaTemplate
+func render(t *testing.T, file *parser.File, name string) string {
+	t.Helper()
+
+	table, err := file.FindTable(parser.Path{parser.StringKey(name)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tpl, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sb strings.Builder
+	if err := tpl.Execute(&sb, merger.Result{TableName: name, Table: table}); err != nil {
+		t.Fatal(err)
+	}
+	return sb.String()
+}
+
+func parse(t *testing.T, source string) *parser.File {
+	t.Helper()
+
+	file, err := parser.ParseFile("test.lua", source, parser.Lua51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func eval(t *testing.T, source string) *parser.File {
+	t.Helper()
+
+	file, err := parser.EvalFile("test.lua", source, parser.EvalLimits{Instructions: 1_000_000, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestPositionalEntries(t *testing.T) {
+	got := render(t, parse(t, `T = { "a", "b", x = 1 }`), "T")
+	want := "T = {\n    \"a\",\n    \"b\",\n    x = 1,\n}"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEvalNestedTables(t *testing.T) {
+	source := `
+T = {}
+for i = 1, 2 do
+	T[i] = { name = "Item " .. i, tags = { "a", "b" } }
+end
+`
+	got := render(t, eval(t, source), "T")
+	want := `T = {
+    {
+        name = "Item 1",
+        tags = {
+            "a",
+            "b",
+        },
+    },
+    {
+        name = "Item 2",
+        tags = {
+            "a",
+            "b",
+        },
+    },
+}`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}